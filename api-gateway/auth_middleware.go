@@ -1,25 +1,83 @@
 package main
 
 import (
-	"crypto/rsa"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt"
 )
 
+const (
+	// defaultIssuer is the expected iss claim used when JWT_ISSUER is not set.
+	defaultIssuer = "user-service"
+	// defaultLeeway is the allowed clock skew used when JWT_LEEWAY_SECONDS is not set.
+	defaultLeeway = 30 * time.Second
+)
+
+// User service issues every token for exactly one audience, and each route only accepts the audiences meant for it.
+const (
+	// AudienceApi is the audience of access tokens for the HTTP API.
+	AudienceApi = "chat-app-api"
+	// AudienceAccount is the audience of access tokens that are only valid for managing the user's own account.
+	// They are issued to users who did not verify their email address yet.
+	AudienceAccount = "chat-app-account"
+)
+
 // AuthService provides methods for JWT token validation.
+// Tokens are verified with the key named by their kid header, taken from the JwksCache, and rejected if they
+// were revoked according to the RevocationList.
 type AuthService struct {
-	publicKey *rsa.PublicKey
+	keys        *JwksCache
+	revocations *RevocationList
+	issuer      string
+	leeway      time.Duration
+}
+
+// NewAuthService creates a new AuthService.
+// The expected issuer is read from the JWT_ISSUER environment variable, and the clock skew tolerated when
+// checking the time claims from JWT_LEEWAY_SECONDS.
+func NewAuthService(keys *JwksCache, revocations *RevocationList) (*AuthService, error) {
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = defaultIssuer
+	}
+	leeway := defaultLeeway
+	if leewayString := os.Getenv("JWT_LEEWAY_SECONDS"); leewayString != "" {
+		seconds, err := strconv.Atoi(leewayString)
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid JWT_LEEWAY_SECONDS: %q", leewayString)
+		}
+		leeway = time.Duration(seconds) * time.Second
+	}
+	return &AuthService{
+		keys:        keys,
+		revocations: revocations,
+		issuer:      issuer,
+		leeway:      leeway,
+	}, nil
 }
 
 // JWTMiddleware is the authorization middleware
 // It reads the JWT token from the Authorization header, validates the token, and extracts the user ID from the token claims.
 // The user ID is then appended to X-User-Id header in the request.
 func JWTMiddleware(authService *AuthService, next http.Handler) http.Handler {
+	return jwtMiddleware(authService, next, AudienceApi)
+}
+
+// AccountJWTMiddleware is the authorization middleware for the account endpoints of user service.
+// Unlike JWTMiddleware, it also accepts the restricted access tokens of users who did not verify their email address.
+func AccountJWTMiddleware(authService *AuthService, next http.Handler) http.Handler {
+	return jwtMiddleware(authService, next, AudienceApi, AudienceAccount)
+}
+
+// jwtMiddleware authorizes requests with a bearer token issued for one of the audiences.
+func jwtMiddleware(authService *AuthService, next http.Handler, audiences ...string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -32,17 +90,13 @@ func JWTMiddleware(authService *AuthService, next http.Handler) http.Handler {
 			return
 		}
 
-		claims, err := authService.ValidateTokenWithClaims(tokenString)
+		claims, err := authService.ValidateTokenWithClaims(tokenString, audiences...)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
 			return
 		}
 
-		userId, ok := claims["userId"].(string)
-		if !ok {
-			http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-			return
-		}
+		userId := claims["sub"].(string)
 
 		r.Header.Set("X-User-Id", userId)
 
@@ -50,40 +104,22 @@ func JWTMiddleware(authService *AuthService, next http.Handler) http.Handler {
 	})
 }
 
-// JWTQueryMiddleware reads the JWT token from the query parameter, validates it, and appends the user ID to the X-User-Id header.
-func JWTQueryMiddleware(authService *AuthService, next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        tokenString := r.URL.Query().Get("token")
-        if tokenString == "" {
-            http.Error(w, "Token query parameter missing", http.StatusUnauthorized)
-            return
-        }
-
-        claims, err := authService.ValidateTokenWithClaims(tokenString)
-        if err != nil {
-            http.Error(w, fmt.Sprintf("Invalid token: %v", err), http.StatusUnauthorized)
-            return
-        }
-
-        userId, ok := claims["userId"].(string)
-        if !ok {
-            http.Error(w, "Invalid token claims", http.StatusUnauthorized)
-            return
-        }
-
-        r.Header.Set("X-User-Id", userId)
-
-        next.ServeHTTP(w, r)
-    })
-}
-
 // ValidateTokenWithClaims validates the token and returns the claims if the token is valid.
-func (s *AuthService) ValidateTokenWithClaims(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
+// Besides the signature, it checks that the token was issued by user service for one of the audiences, that it is
+// within its validity period, allowing for the configured leeway, and that it names its subject and ID.
+// Tokens that were revoked are rejected as well.
+func (s *AuthService) ValidateTokenWithClaims(tokenString string, audiences ...string) (jwt.MapClaims, error) {
+	// The time claims are checked below, as the parser of jwt v3 allows no leeway.
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	token, err := parser.Parse(tokenString, func(token *jwt.Token) (any, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
-		return s.publicKey, nil
+		kid, ok := token.Header["kid"].(string)
+		if !ok || kid == "" {
+			return nil, errors.New("missing kid header")
+		}
+		return s.keys.Key(kid)
 	})
 
 	if err != nil {
@@ -94,24 +130,89 @@ func (s *AuthService) ValidateTokenWithClaims(tokenString string) (jwt.MapClaims
 		return nil, errors.New("invalid token")
 	}
 
-	if claims, ok := token.Claims.(jwt.MapClaims); ok {
-		return claims, nil
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("failed to extract claims")
+	}
+
+	if err := s.validateClaims(claims, audiences); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("failed to extract claims")
+	tokenId := claims["jti"].(string)
+	userId := claims["sub"].(string)
+	issuedAt := numericDate(claims["iat"].(float64))
+	if s.revocations.IsRevoked(tokenId, userId, issuedAt) {
+		return nil, errors.New("token has been revoked")
+	}
+
+	return claims, nil
 }
 
-// getRsaPublicKey reads the RSA public key from the environment variable.
-// It parses the RSA public key and returns the parsed public key.
-func getRsaPublicKey() (*rsa.PublicKey, error) {
-	pemData, err := os.ReadFile("public_key.pem")
-	if err != nil {
-		return nil, fmt.Errorf("error reading rsa private key: %w", err)
+// validateClaims checks the registered claims of a token whose signature was verified.
+// iat, nbf and exp must be numbers, and sub and jti non-empty strings.
+func (s *AuthService) validateClaims(claims jwt.MapClaims, audiences []string) error {
+	if issuer, _ := claims["iss"].(string); issuer != s.issuer {
+		return fmt.Errorf("unexpected issuer %q", issuer)
+	}
+	if !hasAudience(claims["aud"], audiences) {
+		return errors.New("token is not valid for this audience")
+	}
+	if subject, _ := claims["sub"].(string); subject == "" {
+		return errors.New("missing sub claim")
+	}
+	if tokenId, _ := claims["jti"].(string); tokenId == "" {
+		return errors.New("missing jti claim")
 	}
 
-	publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pemData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse RSA public key: %v", err)
+	now := time.Now()
+	issuedAt, ok := claims["iat"].(float64)
+	if !ok {
+		return errors.New("missing iat claim")
+	}
+	if time.Unix(int64(issuedAt), 0).After(now.Add(s.leeway)) {
+		return errors.New("token used before issued")
+	}
+	notBefore, ok := claims["nbf"].(float64)
+	if !ok {
+		return errors.New("missing nbf claim")
+	}
+	if time.Unix(int64(notBefore), 0).After(now.Add(s.leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	expiresAt, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if !time.Unix(int64(expiresAt), 0).After(now.Add(-s.leeway)) {
+		return errors.New("token is expired")
+	}
+
+	return nil
+}
+
+// numericDate converts a NumericDate claim, which may have fractional seconds, to a time with a precision of
+// milliseconds.
+func numericDate(seconds float64) time.Time {
+	return time.UnixMilli(int64(math.Round(seconds * 1000)))
+}
+
+// hasAudience reports whether the aud claim, which is either a single string or an array of strings, contains
+// one of the audiences.
+func hasAudience(claim any, audiences []string) bool {
+	var tokenAudiences []any
+	switch aud := claim.(type) {
+	case string:
+		tokenAudiences = []any{aud}
+	case []any:
+		tokenAudiences = aud
+	}
+	for _, a := range tokenAudiences {
+		for _, audience := range audiences {
+			if a == audience {
+				return true
+			}
+		}
 	}
-	return publicKey, nil
+	return false
 }
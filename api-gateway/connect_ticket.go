@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"example.com/chat_app/identity"
+)
+
+// connectTicketTTL is the time a client has to open the WebSocket connection after requesting a ticket.
+const connectTicketTTL = 30 * time.Second
+
+var (
+	// ErrInvalidTicket is returned when a connect ticket is malformed, has a bad signature or has expired.
+	ErrInvalidTicket = errors.New("invalid connect ticket")
+	// ErrTicketReused is returned when a connect ticket that was already redeemed is presented again.
+	ErrTicketReused = errors.New("connect ticket already used")
+)
+
+// connectTicket is the signed payload of a ticket. It binds the ticket to one user and one room.
+// IssuedAt has a precision of milliseconds, like the iat claim of access tokens.
+type connectTicket struct {
+	Id        string  `json:"jti"`
+	UserId    string  `json:"sub"`
+	RoomId    string  `json:"room"`
+	IssuedAt  float64 `json:"iat"`
+	ExpiresAt int64   `json:"exp"`
+}
+
+// RedeemedTickets remembers which connect tickets were redeemed until they expire.
+type RedeemedTickets interface {
+	MarkRedeemed(ctx context.Context, ticketId string, expiresAt time.Time) (bool, error)
+}
+
+// ConnectTickets issues and redeems single-use tickets for opening a WebSocket connection to a room.
+// Tickets are HMAC signed with a key shared by all gateway instances, so any instance can verify a ticket
+// another one issued. Redeemed tickets are recorded in a store shared by all instances, so a ticket can not be
+// replayed against any of them.
+type ConnectTickets struct {
+	activeKid   string
+	secrets     map[string][]byte
+	revocations *RevocationList
+	redeemed    RedeemedTickets
+}
+
+// NewConnectTickets creates a new ConnectTickets.
+// The keys are read from the CONNECT_TICKET_SIGNING_KEYS environment variable, a comma separated list of
+// "keyId:base64Secret" pairs. Tickets are signed with the first key and verified with any of them, so keys can be
+// rotated by prepending a new one and dropping the old one once its tickets have expired.
+func NewConnectTickets(revocations *RevocationList, redeemed RedeemedTickets) (*ConnectTickets, error) {
+	secrets, activeKid, err := identity.ParseKeys("CONNECT_TICKET_SIGNING_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectTickets{
+		activeKid:   activeKid,
+		secrets:     secrets,
+		revocations: revocations,
+		redeemed:    redeemed,
+	}, nil
+}
+
+// Issue issues a ticket for the user to connect to the room.
+// The ticket has the form "keyId.payload.signature", with the payload and signature base64url encoded.
+func (t *ConnectTickets) Issue(userId, roomId string) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed generating ticket id: %v", err)
+	}
+	now := time.Now()
+	payload, err := json.Marshal(connectTicket{
+		Id:        base64.RawURLEncoding.EncodeToString(nonce),
+		UserId:    userId,
+		RoomId:    roomId,
+		IssuedAt:  float64(now.UnixMilli()) / 1000,
+		ExpiresAt: now.Add(connectTicketTTL).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := t.activeKid + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + identity.SignValue(t.secrets[t.activeKid], signed), nil
+}
+
+// Redeem verifies the ticket and marks it as used.
+// It returns the ID of the user the ticket was issued to, or ErrInvalidTicket if the ticket is not valid for
+// the room or the user's sessions were revoked after it was issued, and ErrTicketReused if it was redeemed before.
+func (t *ConnectTickets) Redeem(ctx context.Context, ticketString, roomId string) (string, error) {
+	kid, rest, _ := strings.Cut(ticketString, ".")
+	encodedPayload, signature, ok := strings.Cut(rest, ".")
+	secret, known := t.secrets[kid]
+	if !ok || !known {
+		return "", ErrInvalidTicket
+	}
+	expected := identity.SignValue(secret, kid+"."+encodedPayload)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", ErrInvalidTicket
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", ErrInvalidTicket
+	}
+	var ticket connectTicket
+	if err := json.Unmarshal(payload, &ticket); err != nil {
+		return "", ErrInvalidTicket
+	}
+
+	expiresAt := time.Unix(ticket.ExpiresAt, 0)
+	if ticket.Id == "" || ticket.UserId == "" || ticket.RoomId != roomId || !expiresAt.After(time.Now()) {
+		return "", ErrInvalidTicket
+	}
+	if t.revocations.IsRevoked("", ticket.UserId, numericDate(ticket.IssuedAt)) {
+		return "", ErrInvalidTicket
+	}
+
+	first, err := t.redeemed.MarkRedeemed(ctx, ticket.Id, expiresAt)
+	if err != nil {
+		return "", err
+	}
+	if !first {
+		return "", ErrTicketReused
+	}
+	return ticket.UserId, nil
+}
+
+// ticketRequest is the body of a request for a connect ticket.
+type ticketRequest struct {
+	RoomId string `json:"roomId"`
+}
+
+// ticketResponse carries a connect ticket and its lifetime in seconds.
+type ticketResponse struct {
+	Ticket    string `json:"ticket"`
+	ExpiresIn int64  `json:"expiresIn"`
+}
+
+// TicketHandler issues a connect ticket for the room in the request body to the authenticated user.
+// It must be wrapped by JWTMiddleware, which sets the X-User-Id header. Whether the user is a member of the room
+// is checked by chat service when the connection is opened.
+func TicketHandler(tickets *ConnectTickets) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req ticketRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RoomId == "" {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		ticket, err := tickets.Issue(r.Header.Get("X-User-Id"), req.RoomId)
+		if err != nil {
+			log.Printf("Failed issuing connect ticket: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(ticketResponse{
+			Ticket:    ticket,
+			ExpiresIn: int64(connectTicketTTL.Seconds()),
+		}); err != nil {
+			log.Printf("Failed writing connect ticket response: %v", err)
+		}
+	})
+}
+
+// ConnectTicketMiddleware redeems the ticket from the ticket query parameter for the room in the path, and
+// appends the user ID to the X-User-Id header. The ticket is removed from the query before the request is
+// forwarded.
+func ConnectTicketMiddleware(tickets *ConnectTickets, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		ticket := query.Get("ticket")
+		if ticket == "" {
+			http.Error(w, "Ticket query parameter missing", http.StatusUnauthorized)
+			return
+		}
+
+		userId, err := tickets.Redeem(r.Context(), ticket, r.PathValue("roomId"))
+		switch {
+		case err == ErrInvalidTicket || err == ErrTicketReused:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case err != nil:
+			log.Printf("Failed redeeming connect ticket: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		query.Del("ticket")
+		r.URL.RawQuery = query.Encode()
+		r.Header.Set("X-User-Id", userId)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"net/http"
+
+	"example.com/chat_app/identity"
+)
+
+// StripIdentityMiddleware removes identity headers supplied by the client, so that only identities the gateway
+// authenticated itself are forwarded to the services.
+func StripIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(identity.UserIdHeader)
+		r.Header.Del(identity.AssertionHeader)
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/chat_app/identity"
+)
+
+const (
+	// defaultJwksRefreshInterval is the time between two refreshes used when JWKS_REFRESH_INTERVAL_SECONDS is not set.
+	defaultJwksRefreshInterval = 5 * time.Minute
+	// jwksMinRefreshInterval limits how often a token with an unknown kid can trigger a refresh.
+	jwksMinRefreshInterval = 30 * time.Second
+)
+
+// ErrUnknownKey is returned when a token names a key that is not in the JWKS.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// jwk is an RSA public key in JSON Web Key format.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JwksCache caches the public keys user service signs tokens with, as published in its JWKS.
+// It is refreshed in the background, and on demand when a token names a key it does not know yet, so that a
+// newly activated key is picked up right away.
+type JwksCache struct {
+	jwksURL    string
+	interval   time.Duration
+	httpClient *http.Client
+
+	lock      sync.RWMutex
+	keys      map[string]*rsa.PublicKey
+	lastFetch time.Time
+}
+
+// NewJwksCache creates a new JwksCache for the JWKS at the URL.
+// The time between two refreshes is read from the JWKS_REFRESH_INTERVAL_SECONDS environment variable.
+// Requests to user service are signed with the identity signer.
+func NewJwksCache(jwksURL string, signer *identity.Signer) (*JwksCache, error) {
+	interval := defaultJwksRefreshInterval
+	if intervalString := os.Getenv("JWKS_REFRESH_INTERVAL_SECONDS"); intervalString != "" {
+		seconds, err := strconv.Atoi(intervalString)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid JWKS_REFRESH_INTERVAL_SECONDS: %q", intervalString)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	return &JwksCache{
+		jwksURL:    jwksURL,
+		interval:   interval,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: signer.Transport(nil)},
+		keys:       make(map[string]*rsa.PublicKey),
+	}, nil
+}
+
+// Start refreshes the keys right away and then every interval until the context is cancelled.
+// Failed refreshes are logged and the keys fetched before are kept.
+func (c *JwksCache) Start(ctx context.Context) {
+	if err := c.Refresh(ctx); err != nil {
+		log.Printf("Failed fetching jwks: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := c.Refresh(ctx); err != nil {
+					log.Printf("Failed refreshing jwks: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Refresh fetches the JWKS and replaces the cached keys with it.
+func (c *JwksCache) Refresh(ctx context.Context) error {
+	c.lock.Lock()
+	c.lastFetch = time.Now()
+	c.lock.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.jwksURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from jwks: %d", resp.StatusCode)
+	}
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("failed decoding jwks: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Kty != "RSA" || key.Kid == "" {
+			continue
+		}
+		publicKey, err := parseRsaJwk(key)
+		if err != nil {
+			log.Printf("Skipping invalid key %q in jwks: %v", key.Kid, err)
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keys = keys
+	return nil
+}
+
+// Key returns the public key with the kid. If it is not cached, the JWKS is fetched again, at most once every
+// jwksMinRefreshInterval, so that tokens with made up kids can not flood user service.
+func (c *JwksCache) Key(kid string) (*rsa.PublicKey, error) {
+	c.lock.RLock()
+	key, ok := c.keys[kid]
+	lastFetch := c.lastFetch
+	c.lock.RUnlock()
+	if ok {
+		return key, nil
+	}
+	if time.Since(lastFetch) < jwksMinRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		return nil, fmt.Errorf("failed refreshing jwks: %w", err)
+	}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if key, ok := c.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// parseRsaJwk converts an RSA JSON Web Key into a public key.
+func parseRsaJwk(key jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, fmt.Errorf("invalid modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exponent: %w", err)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -8,27 +10,79 @@ import (
 	"net/url"
 	"os"
 	"time"
+
+	"example.com/chat_app/identity"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func main() {
-	publicKey, err := getRsaPublicKey()
+	mongoUri := os.Getenv("MONGO_URI")
+	port := os.Getenv("PORT")
+
+	mongoClient, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongoUri))
 	if err != nil {
-		log.Fatalf("Failed to load RSA public key: %v", err)
+		log.Fatalf("Failed connecting to MongoDB: %v", err)
+	}
+	defer mongoClient.Disconnect(context.TODO())
+	if err := mongoClient.Ping(context.TODO(), nil); err != nil {
+		log.Fatalf("Failed connecting to MongoDB: %v", err)
 	}
 
-	port := os.Getenv("PORT")
+	// Redeemed connect tickets are shared by all gateway instances, so that every ticket is used only once.
+	redeemedTickets := NewMongoRedeemedTickets(mongoClient, "gatewaydb", "redeemedtickets")
+	if err := redeemedTickets.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatalf("Failed creating redeemed ticket indexes: %v", err)
+	}
 
-	authService := &AuthService{publicKey: publicKey}
+	signer, err := identity.NewSigner("api-gateway")
+	if err != nil {
+		log.Fatalf("Failed creating identity signer: %v", err)
+	}
+
+	revocations, err := NewRevocationList("http://user-service:8081/internal/revocations", signer)
+	if err != nil {
+		log.Fatalf("Failed creating revocation list: %v", err)
+	}
+	revocations.Start(context.Background())
+
+	jwksCache, err := NewJwksCache("http://user-service:8081/.well-known/jwks.json", signer)
+	if err != nil {
+		log.Fatalf("Failed creating jwks cache: %v", err)
+	}
+	jwksCache.Start(context.Background())
+
+	authService, err := NewAuthService(jwksCache, revocations)
+	if err != nil {
+		log.Fatalf("Failed creating auth service: %v", err)
+	}
+
+	tickets, err := NewConnectTickets(revocations, redeemedTickets)
+	if err != nil {
+		log.Fatalf("Failed creating connect tickets: %v", err)
+	}
 
 	mux := http.NewServeMux()
 
-	mux.Handle("/users/", JWTMiddleware(authService, proxyHandler("http://user-service:8081")))
-	mux.Handle("/connect/", JWTQueryMiddleware(authService, proxyHandler("http://chat-service:8082")))
-	mux.Handle("/auth/", proxyHandler("http://user-service:8081"))
-	mux.Handle("/chats/", JWTMiddleware(authService, http.StripPrefix("/chats", proxyHandler("http://chat-service:8082"))))
-	mux.Handle("/media/", JWTMiddleware(authService, http.StripPrefix("/media", proxyHandler("http://media-service:8083"))))
+	mux.Handle("/users/", AccountJWTMiddleware(authService, proxyHandler("http://user-service:8081", signer)))
+	// The user directory is only open to verified users, like the chats it is used for.
+	userDirectoryProxy := JWTMiddleware(authService, proxyHandler("http://user-service:8081", signer))
+	mux.Handle("GET /users/search", userDirectoryProxy)
+	mux.Handle("POST /users/batch", userDirectoryProxy)
+	// WebSocket connections are authorized with single-use tickets, so that access tokens never end up in URLs.
+	mux.Handle("POST /connect/ticket", JWTMiddleware(authService, TicketHandler(tickets)))
+	mux.Handle("GET /connect/room/{roomId}", ConnectTicketMiddleware(tickets, proxyHandler("http://chat-service:8082", signer)))
+	mux.Handle("/auth/", proxyHandler("http://user-service:8081", signer))
+	mux.Handle("GET /.well-known/jwks.json", proxyHandler("http://user-service:8081", signer))
+	mux.Handle("/chats/", JWTMiddleware(authService, http.StripPrefix("/chats", proxyHandler("http://chat-service:8082", signer))))
+	// Media service is only reached through signed URLs, which carry their own authorization and are verified by
+	// media service. Uploads go through chat service, which enforces room membership and media quotas, and
+	// deleting and listing blobs is reserved for it. Blobs are not downloaded by their ID, since blob IDs are
+	// content hashes that anyone who knows a file could fetch it by.
+	mux.Handle("GET /files/", http.StripPrefix("/files", proxyHandler("http://media-service:8083/signed", signer)))
 
-	handler := CORSMiddleware(mux)
+	handler := CORSMiddleware(StripIdentityMiddleware(mux))
 
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%s", port),
@@ -43,7 +97,9 @@ func main() {
 }
 
 // proxyHandler creates a new reverse proxy handler that forwards requests to the target URL.
-func proxyHandler(target string) http.Handler {
+// Each forwarded request carries an identity assertion for the user in its X-User-Id header, which the services
+// verify before trusting that header.
+func proxyHandler(target string, signer *identity.Signer) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		url, err := url.Parse(target)
 		if err != nil {
@@ -52,7 +108,14 @@ func proxyHandler(target string) http.Handler {
 		}
 
 		proxy := httputil.NewSingleHostReverseProxy(url)
+		// The assertion is bound to the request the service sees, so it is signed by the transport once the
+		// director has joined the target path.
+		proxy.Transport = signer.Transport(nil)
 		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			if errors.Is(err, identity.ErrBodyTooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
 			http.Error(w, fmt.Sprintf("Proxy error: %v", err), http.StatusBadGateway)
 		}
 		proxy.ServeHTTP(w, r)
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoRedeemedTickets records the IDs of redeemed connect tickets in a collection shared by all gateway
+// instances, so that a ticket is redeemed only once no matter which instance it is presented to.
+type MongoRedeemedTickets struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRedeemedTickets creates a new MongoRedeemedTickets.
+func NewMongoRedeemedTickets(client *mongo.Client, dbName, collectionName string) *MongoRedeemedTickets {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoRedeemedTickets{collection: collection}
+}
+
+// EnsureIndexes creates the TTL index that lets MongoDB remove the IDs of tickets once they expired, as expired
+// tickets are rejected anyway.
+func (repo *MongoRedeemedTickets) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// MarkRedeemed records the ticket ID as redeemed. The ID is the document ID, so of concurrent attempts to
+// redeem the same ticket only one is inserted. It reports false if the ticket was already redeemed.
+func (repo *MongoRedeemedTickets) MarkRedeemed(ctx context.Context, ticketId string, expiresAt time.Time) (bool, error) {
+	_, err := repo.collection.InsertOne(ctx, bson.M{"_id": ticketId, "expiresAt": expiresAt})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error recording redeemed ticket: %w", err)
+	}
+	return true, nil
+}
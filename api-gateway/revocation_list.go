@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/chat_app/identity"
+)
+
+const (
+	// defaultRevocationSyncInterval is the time between two syncs used when REVOCATION_SYNC_INTERVAL_SECONDS is not set.
+	defaultRevocationSyncInterval = 5 * time.Second
+	// revocationSyncOverlap is subtracted from the time of the last sync, so that revocations stored with a
+	// slightly earlier timestamp than the last one seen are not missed. Syncing a revocation twice is harmless.
+	revocationSyncOverlap = 5 * time.Second
+)
+
+// revocation is an access token revocation as published by user service.
+type revocation struct {
+	TokenId      string     `json:"jti"`
+	UserId       string     `json:"userId"`
+	IssuedBefore *time.Time `json:"issuedBefore"`
+	RevokedAt    time.Time  `json:"revokedAt"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+}
+
+// userRevocation revokes all tokens of a user issued before a point in time.
+type userRevocation struct {
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+// RevocationList is a local denylist of revoked access tokens, kept in sync with the revocations published by
+// user service. Tokens are checked against it without calling user service.
+type RevocationList struct {
+	sourceURL  string
+	interval   time.Duration
+	httpClient *http.Client
+
+	lock     sync.RWMutex
+	tokens   map[string]time.Time
+	users    map[string]userRevocation
+	lastSeen time.Time
+}
+
+// NewRevocationList creates a new RevocationList that syncs with the revocations at the source URL.
+// The time between two syncs is read from the REVOCATION_SYNC_INTERVAL_SECONDS environment variable.
+// Requests to user service are signed with the identity signer.
+func NewRevocationList(sourceURL string, signer *identity.Signer) (*RevocationList, error) {
+	interval := defaultRevocationSyncInterval
+	if intervalString := os.Getenv("REVOCATION_SYNC_INTERVAL_SECONDS"); intervalString != "" {
+		seconds, err := strconv.Atoi(intervalString)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid REVOCATION_SYNC_INTERVAL_SECONDS: %q", intervalString)
+		}
+		interval = time.Duration(seconds) * time.Second
+	}
+	return &RevocationList{
+		sourceURL:  sourceURL,
+		interval:   interval,
+		httpClient: &http.Client{Timeout: 10 * time.Second, Transport: signer.Transport(nil)},
+		tokens:     make(map[string]time.Time),
+		users:      make(map[string]userRevocation),
+	}, nil
+}
+
+// Start syncs the list right away and then every interval until the context is cancelled.
+// Failed syncs are logged and retried; the tokens revoked so far stay revoked in the meantime.
+func (l *RevocationList) Start(ctx context.Context) {
+	if err := l.Sync(ctx); err != nil {
+		log.Printf("Failed syncing revoked tokens: %v", err)
+	}
+	go func() {
+		ticker := time.NewTicker(l.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := l.Sync(ctx); err != nil {
+					log.Printf("Failed syncing revoked tokens: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// Sync fetches the revocations made since the last sync and drops the ones that have expired.
+// The next sync continues from the latest revocation time seen, as stamped by user service, so that the clock of
+// the gateway does not matter. Until a revocation was seen, every revocation that has not expired is fetched.
+func (l *RevocationList) Sync(ctx context.Context) error {
+	l.lock.RLock()
+	since := l.lastSeen
+	l.lock.RUnlock()
+
+	requestURL := l.sourceURL
+	if !since.IsZero() {
+		requestURL += "?since=" + url.QueryEscape(since.Add(-revocationSyncOverlap).Format(time.RFC3339Nano))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := l.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from revocations: %d", resp.StatusCode)
+	}
+	var revocations []revocation
+	if err := json.NewDecoder(resp.Body).Decode(&revocations); err != nil {
+		return fmt.Errorf("failed decoding revocations: %w", err)
+	}
+
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, rev := range revocations {
+		switch {
+		case rev.TokenId != "":
+			l.tokens[rev.TokenId] = rev.ExpiresAt
+		case rev.IssuedBefore != nil:
+			if existing, ok := l.users[rev.UserId]; !ok || existing.issuedBefore.Before(*rev.IssuedBefore) {
+				l.users[rev.UserId] = userRevocation{issuedBefore: *rev.IssuedBefore, expiresAt: rev.ExpiresAt}
+			}
+		}
+		if rev.RevokedAt.After(l.lastSeen) {
+			l.lastSeen = rev.RevokedAt
+		}
+	}
+	for tokenId, expiresAt := range l.tokens {
+		if now.After(expiresAt) {
+			delete(l.tokens, tokenId)
+		}
+	}
+	for userId, userRev := range l.users {
+		if now.After(userRev.expiresAt) {
+			delete(l.users, userId)
+		}
+	}
+	return nil
+}
+
+// IsRevoked reports whether the token with the ID, issued to the user at the given time, was revoked.
+func (l *RevocationList) IsRevoked(tokenId, userId string, issuedAt time.Time) bool {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if _, ok := l.tokens[tokenId]; ok {
+		return true
+	}
+	userRev, ok := l.users[userId]
+	return ok && issuedAt.Before(userRev.issuedBefore)
+}
@@ -4,13 +4,62 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
+
+	"example.com/chat_app/identity"
+)
+
+var (
+	// ErrMediaNotFound is returned when the media service has no blob for the requested media.
+	ErrMediaNotFound = errors.New("media not found")
+	// ErrUnsupportedMedia is returned when the media service rejects an upload because of its format.
+	ErrUnsupportedMedia = errors.New("unsupported media format")
+	// ErrMediaTooLarge is returned when the media service rejects an upload because of its size or dimensions.
+	ErrMediaTooLarge = errors.New("media too large")
+	// ErrMediaScanPending is returned when media is downloaded before the media service scanned it for malware.
+	ErrMediaScanPending = errors.New("media is being scanned for malware")
+	// ErrMediaInfected is returned when the media service found malware in the media.
+	ErrMediaInfected = errors.New("media contains malware")
+	// ErrUploadNotFound is returned when a resumable upload does not exist or has expired.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadOffsetMismatch is returned when a chunk does not start at the current offset of the upload.
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrUploadIncomplete is returned when an upload is finalized before all of its bytes were received.
+	ErrUploadIncomplete = errors.New("upload incomplete")
 )
 
+// BlobMetadata describes the content of a blob as recorded by the media service.
+type BlobMetadata struct {
+	BlobId      string    `json:"blobId"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Checksum    string    `json:"checksum"`
+	ScanStatus  string    `json:"scanStatus"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// StoredBlob describes a blob stored in the media service.
+type StoredBlob struct {
+	BlobId    string    `json:"blobId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// UploadStatus describes the state of a resumable upload in the media service.
+type UploadStatus struct {
+	UploadId  string    `json:"uploadId"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
 // MediaServiceClient is an http client wrapper for communication with media service.
 type MediaServiceClient struct {
 	BaseURL    string
@@ -19,7 +68,8 @@ type MediaServiceClient struct {
 
 // NewMediaClient creates a new MediaServiceClient.
 // It reads the base URL for the media service from the MEDIA_SERVICE_URL environment variable.
-func NewMediaClient() (*MediaServiceClient, error) {
+// Requests are signed with the identity signer, as media service only accepts requests with an identity assertion.
+func NewMediaClient(signer *identity.Signer) (*MediaServiceClient, error) {
 	baseURL := os.Getenv("MEDIA_SERVICE_URL")
 	if baseURL == "" {
 		return nil, fmt.Errorf("MEDIA_SERVICE_URL environment variable not set")
@@ -27,54 +77,93 @@ func NewMediaClient() (*MediaServiceClient, error) {
 
 	return &MediaServiceClient{
 		BaseURL:    baseURL,
-		HTTPClient: &http.Client{},
+		HTTPClient: &http.Client{Transport: signer.Transport(nil)},
 	}, nil
 }
 
 // UploadMedia uploads media to the media service.
 // It sends a POST request to the media service with the media type and media bytes.
-// It returns the blob ID of the uploaded media.
-func (c *MediaServiceClient) UploadMedia(ctx context.Context, mediaType string, mediaBytes []byte) (string, error) {
+// It returns the metadata of the stored blob.
+func (c *MediaServiceClient) UploadMedia(ctx context.Context, mediaType string, mediaBytes []byte) (*BlobMetadata, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.getMediaURL(mediaType, ""), bytes.NewReader(mediaBytes))
 	if err != nil {
-		return "", fmt.Errorf("failed to create upload image request: %v", err)
+		return nil, fmt.Errorf("failed to create upload image request: %v", err)
 	}
 
 	log.Printf("Sending request to %s", req.URL.String())
 
 	resp, err := c.HTTPClient.Do(req)
+	if errors.Is(err, identity.ErrBodyTooLarge) {
+		return nil, ErrMediaTooLarge
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to send upload image request: %v", err)
+		return nil, fmt.Errorf("failed to send upload image request: %v", err)
 	}
 	defer resp.Body.Close()
 
+	switch resp.StatusCode {
+	case http.StatusUnsupportedMediaType:
+		return nil, ErrUnsupportedMedia
+	case http.StatusRequestEntityTooLarge:
+		return nil, ErrMediaTooLarge
+	case http.StatusUnprocessableEntity:
+		return nil, ErrMediaInfected
+	}
 	if resp.StatusCode != http.StatusCreated {
-		return "", fmt.Errorf("unexpected status code from upload image : %d", resp.StatusCode)
+		return nil, fmt.Errorf("unexpected status code from upload image : %d", resp.StatusCode)
+	}
+
+	var metadata BlobMetadata
+	respBytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload image response: %w", err)
 	}
 
-	payload := struct {
-		BlobId string `json:"blobId"`
-	}{
-		BlobId: "",
+	if err := json.Unmarshal(respBytes, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload image response: %w", err)
 	}
 
-	respBytes, err := io.ReadAll(resp.Body)
+	return &metadata, nil
+}
+
+// GetMediaMetadata retrieves the metadata of a blob from the media service.
+func (c *MediaServiceClient) GetMediaMetadata(ctx context.Context, blobId, mediaType string) (*BlobMetadata, error) {
+	metadataURL := fmt.Sprintf("%s/metadata/%s/%s", c.BaseURL, mediaType, blobId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to read upload image response: %w", err)
+		return nil, fmt.Errorf("failed to create media metadata request: %v", err)
 	}
 
-	if err := json.Unmarshal(respBytes, &payload); err != nil {
-		return "", fmt.Errorf("failed to unmarshal upload image response: %w", err)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send media metadata request: %v", err)
 	}
+	defer resp.Body.Close()
 
-	return payload.BlobId, nil
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrMediaNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from media metadata request: %d", resp.StatusCode)
+	}
+
+	var metadata BlobMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal media metadata response: %w", err)
+	}
+	return &metadata, nil
 }
 
 // DownloadMedia downloads media from the media service.
 // It sends a GET request to the media service with the blob ID and media type.
+// If variant is not empty, the resized image variant with that name is downloaded instead of the original.
 // It returns the media bytes.
-func (c *MediaServiceClient) DownloadMedia(ctx context.Context, blobId, mediaType string) ([]byte, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.getMediaURL(mediaType, blobId), nil)
+func (c *MediaServiceClient) DownloadMedia(ctx context.Context, blobId, mediaType, variant string) ([]byte, error) {
+	mediaURL := c.getMediaURL(mediaType, blobId)
+	if variant != "" {
+		mediaURL = fmt.Sprintf("%s?variant=%s", mediaURL, url.QueryEscape(variant))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create download image request: %v", err)
 	}
@@ -87,6 +176,14 @@ func (c *MediaServiceClient) DownloadMedia(ctx context.Context, blobId, mediaTyp
 	}
 	defer resp.Body.Close()
 
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrMediaNotFound
+	case http.StatusLocked:
+		return nil, ErrMediaScanPending
+	case http.StatusForbidden:
+		return nil, ErrMediaInfected
+	}
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status code from download image request: %d", resp.StatusCode)
 	}
@@ -94,6 +191,196 @@ func (c *MediaServiceClient) DownloadMedia(ctx context.Context, blobId, mediaTyp
 	return io.ReadAll(resp.Body)
 }
 
+// DeleteMedia removes one reference from a blob in the media service.
+// The media service deletes the blob once no media file references it anymore.
+func (c *MediaServiceClient) DeleteMedia(ctx context.Context, blobId, mediaType string) error {
+	return c.deleteMedia(ctx, c.getMediaURL(mediaType, blobId))
+}
+
+// PurgeMedia deletes a blob from the media service regardless of its references.
+func (c *MediaServiceClient) PurgeMedia(ctx context.Context, blobId, mediaType string) error {
+	return c.deleteMedia(ctx, c.getMediaURL(mediaType, blobId)+"?purge=true")
+}
+
+// deleteMedia sends a DELETE request for a blob to the media service.
+func (c *MediaServiceClient) deleteMedia(ctx context.Context, mediaURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, mediaURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete media request: %v", err)
+	}
+
+	log.Printf("Sending request to %s", req.URL.String())
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send delete media request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status code from delete media request: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ListMedia lists the blobs the media service stores for the media type.
+func (c *MediaServiceClient) ListMedia(ctx context.Context, mediaType string) ([]StoredBlob, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.getMediaURL(mediaType, ""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create list media request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send list media request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from list media request: %d", resp.StatusCode)
+	}
+
+	var blobs []StoredBlob
+	if err := json.NewDecoder(resp.Body).Decode(&blobs); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal list media response: %w", err)
+	}
+	return blobs, nil
+}
+
+// CreateUpload starts a resumable upload of the given total length in the media service.
+func (c *MediaServiceClient) CreateUpload(ctx context.Context, mediaType string, length int64) (*UploadStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.getUploadURL(mediaType, ""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload creation request: %v", err)
+	}
+	req.Header.Set("Upload-Length", strconv.FormatInt(length, 10))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send upload creation request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, uploadError(resp, "upload creation")
+	}
+
+	var status UploadStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload creation response: %w", err)
+	}
+	return &status, nil
+}
+
+// GetUploadOffset returns the number of bytes of a resumable upload the media service has received so far.
+func (c *MediaServiceClient) GetUploadOffset(ctx context.Context, uploadId string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.getUploadURL("", uploadId), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create upload offset request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send upload offset request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, uploadError(resp, "upload offset")
+	}
+	return parseUploadOffset(resp)
+}
+
+// AppendUploadChunk sends a chunk of a resumable upload starting at the given offset to the media service.
+// It returns the offset of the upload after the chunk was appended. If the offset does not match, it
+// returns ErrUploadOffsetMismatch together with the current offset of the upload.
+func (c *MediaServiceClient) AppendUploadChunk(ctx context.Context, uploadId string, offset int64, chunk io.Reader) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, c.getUploadURL("", uploadId), chunk)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create upload chunk request: %v", err)
+	}
+	req.Header.Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send upload chunk request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		currentOffset, err := parseUploadOffset(resp)
+		if err != nil {
+			return 0, err
+		}
+		return currentOffset, ErrUploadOffsetMismatch
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		return 0, uploadError(resp, "upload chunk")
+	}
+	return parseUploadOffset(resp)
+}
+
+// FinalizeUpload completes a resumable upload in the media service and returns the metadata of the stored blob.
+func (c *MediaServiceClient) FinalizeUpload(ctx context.Context, uploadId string) (*BlobMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.getUploadURL("", uploadId)+"/finalize", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload finalize request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send upload finalize request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusConflict {
+		return nil, ErrUploadIncomplete
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, uploadError(resp, "upload finalize")
+	}
+
+	var metadata BlobMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload finalize response: %w", err)
+	}
+	return &metadata, nil
+}
+
+// getUploadURL returns the URL for the resumable upload endpoints of the media service.
+func (c *MediaServiceClient) getUploadURL(mediaType, uploadId string) string {
+	if uploadId == "" {
+		return fmt.Sprintf("%s/uploads/%s", c.BaseURL, mediaType)
+	}
+	return fmt.Sprintf("%s/uploads/%s", c.BaseURL, uploadId)
+}
+
+// uploadError maps an unexpected status code of a resumable upload request to an error.
+func uploadError(resp *http.Response, request string) error {
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return ErrUploadNotFound
+	case http.StatusRequestEntityTooLarge:
+		return ErrMediaTooLarge
+	case http.StatusUnsupportedMediaType:
+		return ErrUnsupportedMedia
+	case http.StatusUnprocessableEntity:
+		return ErrMediaInfected
+	default:
+		return fmt.Errorf("unexpected status code from %s request: %d", request, resp.StatusCode)
+	}
+}
+
+// parseUploadOffset reads the Upload-Offset header of a resumable upload response.
+func parseUploadOffset(resp *http.Response) (int64, error) {
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Upload-Offset header in response: %w", err)
+	}
+	return offset, nil
+}
+
 // getMediaURL returns the URL for the media service endpoint.
 func (c *MediaServiceClient) getMediaURL(mediaType, blobId string) string {
 	if blobId == "" {
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"example.com/chat_app/identity"
+)
+
+// maxUserBatchSize is the largest number of users the user service looks up in one request.
+const maxUserBatchSize = 100
+
+// UserSummary is the public profile of a user as returned by the user service.
+type UserSummary struct {
+	Id          string `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+}
+
+// UserServiceClient is an http client wrapper for communication with user service.
+type UserServiceClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewUserClient creates a new UserServiceClient.
+// It reads the base URL for the user service from the USER_SERVICE_URL environment variable.
+// Requests are signed with the identity signer, as user service only accepts requests with an identity assertion.
+// They time out quickly, since they are made while answering requests for rooms.
+func NewUserClient(signer *identity.Signer) (*UserServiceClient, error) {
+	baseURL := os.Getenv("USER_SERVICE_URL")
+	if baseURL == "" {
+		return nil, fmt.Errorf("USER_SERVICE_URL environment variable not set")
+	}
+
+	return &UserServiceClient{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Timeout: 5 * time.Second, Transport: signer.Transport(nil)},
+	}, nil
+}
+
+// GetUsers looks up the users with the IDs in the user service. IDs without a user are left out.
+// IDs are sent in batches of at most 100, the most the user service accepts at once.
+func (c *UserServiceClient) GetUsers(ctx context.Context, ids []string) ([]UserSummary, error) {
+	users := make([]UserSummary, 0, len(ids))
+	for start := 0; start < len(ids); start += maxUserBatchSize {
+		end := min(start+maxUserBatchSize, len(ids))
+		batch, err := c.getUserBatch(ctx, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, batch...)
+	}
+	return users, nil
+}
+
+// getUserBatch looks up a single batch of users in the user service.
+func (c *UserServiceClient) getUserBatch(ctx context.Context, ids []string) ([]UserSummary, error) {
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal user batch request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/users/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user batch request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send user batch request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code from user batch request: %d", resp.StatusCode)
+	}
+
+	var users []UserSummary
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal user batch response: %w", err)
+	}
+	return users, nil
+}
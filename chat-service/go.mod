@@ -3,6 +3,7 @@ module example.com/chat_app/chat_service
 go 1.23.2
 
 require (
+	example.com/chat_app/identity v0.0.0-00010101000000-000000000000
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
@@ -21,3 +22,5 @@ require (
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )
+
+replace example.com/chat_app/identity => ../identity
@@ -4,8 +4,20 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"example.com/chat_app/chat_service/service"
+	"example.com/chat_app/chat_service/structs"
+)
+
+const (
+	// maxUploadChunkSize is the largest chunk accepted in a single resumable upload request.
+	maxUploadChunkSize = 32 << 20
+	// defaultMediaPageSize is the number of media files listed per page if no limit is given.
+	defaultMediaPageSize = 50
+	// maxMediaPageSize is the largest number of media files listed per page.
+	maxMediaPageSize = 100
 )
 
 // MediaHandler handles media upload and download requests.
@@ -22,6 +34,8 @@ func NewMediaHandler(ms *service.MediaService) *MediaHandler {
 // It reads the file from the multipart form data and uploads it to the specified room and media type.
 // It reads the binary file data from the "file" field in the form data.
 // It returns the metadata of the uploaded media.
+// Images are stripped of their metadata by the media service; images it cannot process are rejected
+// with a 415 Unsupported Media Type error and oversized ones with a 413 Request Entity Too Large error.
 func (mh *MediaHandler) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	roomId := r.URL.Query().Get("roomId")
 	if roomId == "" {
@@ -56,7 +70,18 @@ func (mh *MediaHandler) UploadMedia(w http.ResponseWriter, r *http.Request) {
 	// Pass the file to the service
 	fileDocument, err := mh.mediaService.CreateMediaResource(ctx, roomId, mediaType, userId, fileBytes)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "User doesn't belong to room", http.StatusForbidden)
+		case service.ErrUnsupportedMedia:
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case service.ErrMediaTooLarge, service.ErrQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case service.ErrMediaInfected:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 	writeJsonResponse(w, fileDocument)
@@ -64,12 +89,20 @@ func (mh *MediaHandler) UploadMedia(w http.ResponseWriter, r *http.Request) {
 }
 
 // GetMediaMetadata returns the metadata of the specified media as a JSON response.
+// The metadata contains short-lived signed URLs under which the media and its variants can be downloaded
+// without an Authorization header, e.g. from <img> and <video> tags.
+// If the user is not a member of the room the media was shared in, it returns a 403 Forbidden error.
 func (mh *MediaHandler) GetMediaMetadata(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	mediaId := r.PathValue("mediaId")
+	userId := r.Header.Get("X-User-Id")
 
-	fileMetadata, err := mh.mediaService.GetMediaMetadata(ctx, mediaId)
+	fileMetadata, err := mh.mediaService.GetMediaMetadata(ctx, mediaId, userId)
 	if err != nil {
+		if err == service.ErrInsufficientPermissions {
+			http.Error(w, "User doesn't belong to room", http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -81,26 +114,300 @@ func (mh *MediaHandler) GetMediaMetadata(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-// GetMediaFile retrieves the binary image data from the media service and returns it with the appropriate content type.
+// GetMediaFile retrieves the binary image data from the media service and returns it with the content type
+// recorded by the media service.
+// The optional "variant" query parameter selects a resized variant of an image, e.g. "thumb" or "preview".
+// If the variant has not been generated yet, it returns a 404 Not Found error.
+// Media is only served after the media service scanned it for malware: until then it returns a 423 Locked
+// error and for infected media a 403 Forbidden error.
+// If the user is not a member of the room the media was shared in, it returns a 403 Forbidden error.
 func (mh *MediaHandler) GetMediaFile(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	mediaId := r.PathValue("mediaId")
+	userId := r.Header.Get("X-User-Id")
+	variant := r.URL.Query().Get("variant")
 
-	fileBytes, err := mh.mediaService.GetMediaBinary(ctx, mediaId)
+	fileBytes, contentType, err := mh.mediaService.GetMediaBinary(ctx, mediaId, variant, userId)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "User doesn't belong to room", http.StatusForbidden)
+		case service.ErrUnknownVariant:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case service.ErrMediaNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case service.ErrMediaScanPending:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusLocked)
+		case service.ErrMediaInfected:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
 		return
 	}
 
-	if len(fileBytes) < 512 {
-		fileBytes = append(fileBytes, make([]byte, 512-len(fileBytes))...)
-	}
-	contentType := http.DetectContentType(fileBytes[:512])
-
 	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusOK)
 	if _, err := w.Write(fileBytes); err != nil {
 		http.Error(w, "Failed to write file", http.StatusInternalServerError)
 		return
 	}
 }
+
+// GetRoomMedia lists the media shared in the room, newest first.
+// The listing can be filtered with the "type", "uploadedBy", "from" and "to" query parameters, the latter two
+// as RFC 3339 timestamps. At most "limit" files are returned per page; the "nextCursor" of a page is passed as
+// the "cursor" query parameter to fetch the next one.
+// If the user is not a member of the room, it returns a 403 Forbidden error.
+func (mh *MediaHandler) GetRoomMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	query := r.URL.Query()
+
+	filter := structs.MediaFilter{
+		RoomId:    r.PathValue("roomId"),
+		CreatedBy: query.Get("uploadedBy"),
+		Limit:     defaultMediaPageSize,
+	}
+	if typeStr := query.Get("type"); typeStr != "" {
+		mediaType, err := structs.ParseMediaType(typeStr)
+		if err != nil {
+			http.Error(w, "Invalid type query parameter", http.StatusBadRequest)
+			return
+		}
+		filter.Type = &mediaType
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			http.Error(w, "Invalid from query parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			http.Error(w, "Invalid to query parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxMediaPageSize {
+			http.Error(w, "Invalid limit query parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := mh.mediaService.ListRoomMedia(ctx, filter, query.Get("cursor"), userId)
+	if err != nil {
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "User doesn't belong to room", http.StatusForbidden)
+		case service.ErrInvalidCursor:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJsonResponse(w, page)
+}
+
+// DeleteMedia deletes the specified media.
+// Only the user who uploaded the media and admins of the room it was shared in may delete it,
+// otherwise it returns a 403 Forbidden error.
+func (mh *MediaHandler) DeleteMedia(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mediaId := r.PathValue("mediaId")
+	userId := r.Header.Get("X-User-Id")
+
+	err := mh.mediaService.DeleteMedia(ctx, mediaId, userId)
+	if err != nil {
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "Only the uploader or a room admin can delete media", http.StatusForbidden)
+		case service.ErrMediaNotFound:
+			http.Error(w, "Media not found", http.StatusNotFound)
+		case service.ErrAvatarInUse:
+			http.Error(w, "Media is the avatar of its room, replace or remove the avatar first", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetMediaUsage returns how many bytes of media the requesting user has uploaded and their quota.
+func (mh *MediaHandler) GetMediaUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+
+	usage, err := mh.mediaService.GetUserUsage(ctx, userId)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, usage)
+}
+
+// GetRoomMediaUsage returns how many bytes of media are shared in the room and the quota of the room.
+// If the user is not a member of the room, it returns a 403 Forbidden error.
+func (mh *MediaHandler) GetRoomMediaUsage(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	roomId := r.PathValue("roomId")
+	userId := r.Header.Get("X-User-Id")
+
+	usage, err := mh.mediaService.GetRoomUsage(ctx, roomId, userId)
+	if err != nil {
+		if err == service.ErrInsufficientPermissions {
+			http.Error(w, "User doesn't belong to room", http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, usage)
+}
+
+// RaiseRoomMediaQuota raises the media quota of the room to the "limit" in bytes given in the JSON body.
+// If the requesting user is not an operator admin, it returns a 403 Forbidden error. If the limit is
+// lower than the current quota or above the maximum room quota, it returns a 400 Bad Request error.
+func (mh *MediaHandler) RaiseRoomMediaQuota(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	roomId := r.PathValue("roomId")
+	userId := r.Header.Get("X-User-Id")
+
+	var request struct {
+		Limit int64 `json:"limit"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	usage, err := mh.mediaService.RaiseRoomQuota(ctx, roomId, userId, request.Limit)
+	if err != nil {
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "This action requires admin privileges", http.StatusForbidden)
+		case service.ErrInvalidQuota:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJsonResponse(w, usage)
+}
+
+// CreateUpload starts a resumable upload to the room given in the "roomId" query parameter.
+// The media type is read from the "mediaType" query parameter and the total length of the upload in bytes
+// from the Upload-Length header. It returns the upload session, whose ID is used to send the chunks.
+func (mh *MediaHandler) CreateUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	roomId := r.URL.Query().Get("roomId")
+	if roomId == "" {
+		http.Error(w, "Missing roomId query parameter", http.StatusBadRequest)
+		return
+	}
+	mediaType := r.URL.Query().Get("mediaType")
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	upload, err := mh.mediaService.CreateUpload(ctx, roomId, mediaType, userId, length)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJsonResponse(w, upload)
+}
+
+// GetUploadOffset returns the number of bytes received so far in the Upload-Offset header,
+// so that an interrupted upload can be resumed from there.
+func (mh *MediaHandler) GetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	uploadId := r.PathValue("uploadId")
+
+	upload, err := mh.mediaService.GetUpload(ctx, uploadId, userId)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// AppendUploadChunk appends the request body to a resumable upload.
+// The Upload-Offset header must match the number of bytes received so far, otherwise a 409 Conflict
+// error is returned together with the current offset. The new offset is returned in the Upload-Offset header.
+func (mh *MediaHandler) AppendUploadChunk(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	uploadId := r.PathValue("uploadId")
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	chunk := http.MaxBytesReader(w, r.Body, maxUploadChunkSize)
+	newOffset, err := mh.mediaService.AppendUploadChunk(ctx, uploadId, userId, offset, chunk)
+	if err != nil {
+		if err == service.ErrUploadOffsetMismatch {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		}
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// FinalizeUpload completes a resumable upload once all of its bytes were received.
+// It returns the metadata of the uploaded media.
+func (mh *MediaHandler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	uploadId := r.PathValue("uploadId")
+
+	fileDocument, err := mh.mediaService.FinalizeUpload(ctx, uploadId, userId)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	writeJsonResponse(w, fileDocument)
+}
+
+// writeUploadError maps errors of resumable uploads to HTTP error responses.
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case service.ErrUploadNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case service.ErrInsufficientPermissions:
+		http.Error(w, "Upload belongs to another user or user doesn't belong to room", http.StatusForbidden)
+	case service.ErrUploadOffsetMismatch, service.ErrUploadIncomplete:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case service.ErrMediaTooLarge, service.ErrQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case service.ErrUnsupportedMedia:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case service.ErrMediaInfected:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -193,3 +193,51 @@ func (rh *RoomHandler) DeleteUserFromRoom(w http.ResponseWriter, r *http.Request
 	writeJsonResponse(w, response)
 	w.WriteHeader(http.StatusOK)
 }
+
+// SetRoomAvatar makes an image shared in the room the avatar of the room.
+// The image is uploaded to the room through the media upload endpoints first and referenced by its media ID.
+// If the requesting user is not an admin of the room, it returns a 403 Forbidden error.
+func (rh *RoomHandler) SetRoomAvatar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	roomId := r.PathValue("roomId")
+
+	var req structs.RoomAvatarDto
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MediaId == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	room, err := rh.roomService.SetRoomAvatar(ctx, roomId, req.MediaId, userId)
+	if err != nil {
+		switch err {
+		case service.ErrInsufficientPermissions:
+			http.Error(w, "This action requires admin privileges", http.StatusForbidden)
+		case service.ErrInvalidAvatar:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJsonResponse(w, room)
+}
+
+// RemoveRoomAvatar removes the avatar of the room. The image stays shared in the room.
+// If the requesting user is not an admin of the room, it returns a 403 Forbidden error.
+func (rh *RoomHandler) RemoveRoomAvatar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	roomId := r.PathValue("roomId")
+
+	room, err := rh.roomService.RemoveRoomAvatar(ctx, roomId, userId)
+	if err != nil {
+		if err == service.ErrInsufficientPermissions {
+			http.Error(w, "This action requires admin privileges", http.StatusForbidden)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJsonResponse(w, room)
+}
@@ -11,6 +11,7 @@ import (
 	"example.com/chat_app/chat_service/handler"
 	"example.com/chat_app/chat_service/repository"
 	"example.com/chat_app/chat_service/service"
+	"example.com/chat_app/identity"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -39,8 +40,30 @@ func main() {
 
 	chatRoomRepo := repository.NewMongoChatRoomRepository(mongoClient, "chatdb", "chatrooms")
 	mediaRepo := repository.NewMongoFileRepository(mongoClient, "chatdb", "mediafiles")
+	if err := mediaRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	uploadRepo := repository.NewMongoUploadRepository(mongoClient, "chatdb", "uploadsessions")
+	if err := uploadRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+
+	identitySigner, err := identity.NewSigner("chat-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mediaServiceClient, err := client.NewMediaClient(identitySigner)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	mediaServiceClient, err := client.NewMediaClient()
+	userServiceClient, err := client.NewUserClient(identitySigner)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	urlSigner, err := identity.NewUrlSigner()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -50,10 +73,21 @@ func main() {
 		log.Fatal(err)
 	}
 
+	mediaQuotas, err := service.NewMediaQuotas()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	roomManager := service.NewRoomManager()
-	chatService := service.NewChatService(chatRoomRepo, roomManager, aiClient)
-	roomService := service.NewRoomService(chatRoomRepo)
-	mediaService := service.NewMediaService(mediaRepo, mediaServiceClient)
+	chatService := service.NewChatService(chatRoomRepo, mediaRepo, roomManager, aiClient)
+	mediaService := service.NewMediaService(mediaRepo, uploadRepo, chatRoomRepo, mediaServiceClient, urlSigner, mediaQuotas)
+	roomService := service.NewRoomService(chatRoomRepo, mediaService, roomManager, userServiceClient)
+
+	mediaSweeper, err := service.NewMediaSweeper(mediaService)
+	if err != nil {
+		log.Fatal(err)
+	}
+	mediaSweeper.Start(context.Background())
 
 	wsHandler := handler.NewWebsocketHandler(chatService)
 	roomHandler := handler.NewRoomHandler(roomService)
@@ -64,7 +98,7 @@ func main() {
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%s", port),
-		Handler: router,
+		Handler: identity.Middleware(identitySigner, router),
 	}
 
 	log.Printf("Chat Service listening on port %s...", port)
@@ -78,14 +112,25 @@ func initializeRoutes(ws *handler.WebsocketHandler, rh *handler.RoomHandler, mh
 	mux.Handle("GET /room/{roomId}", http.HandlerFunc(rh.GetRoom))
 	mux.Handle("GET /room", http.HandlerFunc(rh.ListRoomsForUser))
 	mux.Handle("POST /room", http.HandlerFunc(rh.CreateRoom))
-	mux.Handle("DELETE /room", http.HandlerFunc(rh.DeleteRoom))
+	mux.Handle("DELETE /room/{roomId}", http.HandlerFunc(rh.DeleteRoom))
 	mux.Handle("POST /room/{roomId}/users/add", http.HandlerFunc(rh.AddUsersToRoom))
 	mux.Handle("PATCH /room/{roomId}/users/{userId}/promote", http.HandlerFunc(rh.PromoteUser))
 	mux.Handle("PATCH /room/{roomId}/users/{userId}/demote", http.HandlerFunc(rh.DemoteUser))
 	mux.Handle("DELETE /room/{roomId}/users/{userId}", http.HandlerFunc(rh.DeleteUserFromRoom))
 	mux.Handle("DELETE /room/{roomId}/users/me", http.HandlerFunc(rh.LeaveRoom))
+	mux.Handle("PUT /room/{roomId}/avatar", http.HandlerFunc(rh.SetRoomAvatar))
+	mux.Handle("DELETE /room/{roomId}/avatar", http.HandlerFunc(rh.RemoveRoomAvatar))
+	mux.Handle("GET /room/{roomId}/media", http.HandlerFunc(mh.GetRoomMedia))
+	mux.Handle("GET /room/{roomId}/media/usage", http.HandlerFunc(mh.GetRoomMediaUsage))
+	mux.Handle("PUT /room/{roomId}/media/quota", http.HandlerFunc(mh.RaiseRoomMediaQuota))
 	mux.Handle("POST /media/upload", http.HandlerFunc(mh.UploadMedia))
+	mux.Handle("POST /media/upload/sessions", http.HandlerFunc(mh.CreateUpload))
+	mux.Handle("HEAD /media/upload/sessions/{uploadId}", http.HandlerFunc(mh.GetUploadOffset))
+	mux.Handle("PATCH /media/upload/sessions/{uploadId}", http.HandlerFunc(mh.AppendUploadChunk))
+	mux.Handle("POST /media/upload/sessions/{uploadId}/finalize", http.HandlerFunc(mh.FinalizeUpload))
+	mux.Handle("GET /media/usage", http.HandlerFunc(mh.GetMediaUsage))
 	mux.Handle("GET /media/{mediaId}/download", http.HandlerFunc(mh.GetMediaFile))
 	mux.Handle("GET /media/{mediaId}", http.HandlerFunc(mh.GetMediaMetadata))
+	mux.Handle("DELETE /media/{mediaId}", http.HandlerFunc(mh.DeleteMedia))
 	return mux
 }
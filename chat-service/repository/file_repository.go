@@ -7,6 +7,7 @@ import (
 	"example.com/chat_app/chat_service/structs"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // MongoFileRepository provides methods to interact with the file collection in MongoDB.
@@ -22,6 +23,17 @@ func NewMongoFileRepository(client *mongo.Client, dbName, collection string) *Mo
 	}
 }
 
+// EnsureIndexes creates the compound index used to list the media of a room by type and creation time.
+func (repo *MongoFileRepository) EnsureIndexes(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys: bson.D{{Key: "roomId", Value: 1}, {Key: "type", Value: 1}, {Key: "createdAt", Value: -1}},
+	}
+	if _, err := repo.collection.Indexes().CreateOne(ctx, index); err != nil {
+		return fmt.Errorf("error creating media file index: %w", err)
+	}
+	return nil
+}
+
 // GetFile retrieves a file from the MongoDB collection by its ID.
 func (repo *MongoFileRepository) GetFile(ctx context.Context, id string) (*structs.MediaFile, error) {
 	var file structs.MediaFile
@@ -51,3 +63,114 @@ func (repo *MongoFileRepository) SaveFile(ctx context.Context, file *structs.Med
 	}
 	return nil
 }
+
+// GetFilesByRoom retrieves all files shared in a room from the MongoDB collection.
+func (repo *MongoFileRepository) GetFilesByRoom(ctx context.Context, roomId string) ([]structs.MediaFile, error) {
+	return repo.findFiles(ctx, bson.M{"roomId": roomId})
+}
+
+// GetFilesByType retrieves all files of a media type from the MongoDB collection.
+func (repo *MongoFileRepository) GetFilesByType(ctx context.Context, mediaType structs.MediaType) ([]structs.MediaFile, error) {
+	return repo.findFiles(ctx, bson.M{"type": mediaType})
+}
+
+// GetFilesPage retrieves the files matching the filter from the MongoDB collection, newest first.
+func (repo *MongoFileRepository) GetFilesPage(ctx context.Context, filter structs.MediaFilter) ([]structs.MediaFile, error) {
+	query := bson.M{"roomId": filter.RoomId}
+	if filter.Type != nil {
+		query["type"] = *filter.Type
+	}
+	if filter.CreatedBy != "" {
+		query["createdBy"] = filter.CreatedBy
+	}
+	createdAt := bson.M{}
+	if !filter.From.IsZero() {
+		createdAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdAt["$lt"] = filter.To
+	}
+	if len(createdAt) > 0 {
+		query["createdAt"] = createdAt
+	}
+	if filter.After != nil {
+		query["$or"] = bson.A{
+			bson.M{"createdAt": bson.M{"$lt": filter.After.CreatedAt}},
+			bson.M{"createdAt": filter.After.CreatedAt, "id": bson.M{"$lt": filter.After.Id}},
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "id", Value: -1}}).
+		SetLimit(filter.Limit)
+	cursor, err := repo.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	files := []structs.MediaFile{}
+	if err := cursor.All(ctx, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// findFiles retrieves all files matching the filter from the MongoDB collection.
+func (repo *MongoFileRepository) findFiles(ctx context.Context, filter bson.M) ([]structs.MediaFile, error) {
+	cursor, err := repo.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var files []structs.MediaFile
+	for cursor.Next(ctx) {
+		var file structs.MediaFile
+		if err := cursor.Decode(&file); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, nil
+}
+
+// GetUserUsage sums up the sizes of all files uploaded by a user in the MongoDB collection.
+func (repo *MongoFileRepository) GetUserUsage(ctx context.Context, userId string) (int64, error) {
+	return repo.sumFileSizes(ctx, bson.D{{Key: "createdBy", Value: userId}})
+}
+
+// GetRoomUsage sums up the sizes of all files shared in a room in the MongoDB collection.
+func (repo *MongoFileRepository) GetRoomUsage(ctx context.Context, roomId string) (int64, error) {
+	return repo.sumFileSizes(ctx, bson.D{{Key: "roomId", Value: roomId}})
+}
+
+// sumFileSizes sums up the sizes of all files matching the filter in the MongoDB collection.
+func (repo *MongoFileRepository) sumFileSizes(ctx context.Context, filter bson.D) (int64, error) {
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "total", Value: bson.D{{Key: "$sum", Value: "$size"}}},
+		}}},
+	}
+
+	cursor, err := repo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	if !cursor.Next(ctx) {
+		return 0, nil
+	}
+
+	var result struct {
+		Total int64 `bson:"total"`
+	}
+	if err := cursor.Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Total, nil
+}
@@ -112,6 +112,29 @@ func (repo *MongoChatRoomRepository) ChangeUserRole(ctx context.Context, roomId
 	return err
 }
 
+// SetMediaQuota sets the number of bytes of media that can be shared in a chat room in the MongoDB collection.
+func (repo *MongoChatRoomRepository) SetMediaQuota(ctx context.Context, roomId string, quota int64) error {
+	filter := bson.M{"id": roomId}
+	update := bson.M{
+		"$set": bson.M{
+			"mediaQuota": quota,
+		},
+	}
+	_, err := repo.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// SetAvatar sets the avatar of a chat room in the MongoDB collection, or removes it if avatar is nil.
+func (repo *MongoChatRoomRepository) SetAvatar(ctx context.Context, roomId string, avatar *structs.MediaFile) error {
+	filter := bson.M{"id": roomId}
+	update := bson.M{"$set": bson.M{"avatar": avatar}}
+	if avatar == nil {
+		update = bson.M{"$unset": bson.M{"avatar": ""}}
+	}
+	_, err := repo.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
 // DeleteUserFromRoom removes a user from a chat room in the MongoDB collection.
 func (repo *MongoChatRoomRepository) DeleteUserFromRoom(ctx context.Context, roomId string, userId string) error {
 	filter := bson.M{"id": roomId}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+
+	"example.com/chat_app/chat_service/structs"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoUploadRepository provides methods to interact with the upload session collection in MongoDB.
+type MongoUploadRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoUploadRepository creates a new instance of MongoUploadRepository.
+// It takes a MongoDB client, database name, and collection name as parameters.
+func NewMongoUploadRepository(client *mongo.Client, dbName, collection string) *MongoUploadRepository {
+	return &MongoUploadRepository{
+		collection: client.Database(dbName).Collection(collection),
+	}
+}
+
+// EnsureIndexes creates a TTL index so that MongoDB removes upload sessions once they expire.
+func (repo *MongoUploadRepository) EnsureIndexes(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	if _, err := repo.collection.Indexes().CreateOne(ctx, index); err != nil {
+		return fmt.Errorf("error creating upload session index: %w", err)
+	}
+	return nil
+}
+
+// GetUpload retrieves an upload session from the MongoDB collection by its ID.
+func (repo *MongoUploadRepository) GetUpload(ctx context.Context, id string) (*structs.UploadSession, error) {
+	var upload structs.UploadSession
+	filter := bson.M{"id": id}
+	err := repo.collection.FindOne(ctx, filter).Decode(&upload)
+	if err != nil {
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// SaveUpload inserts a new upload session into the MongoDB collection.
+func (repo *MongoUploadRepository) SaveUpload(ctx context.Context, upload *structs.UploadSession) error {
+	_, err := repo.collection.InsertOne(ctx, upload)
+	if err != nil {
+		return fmt.Errorf("error creating upload session: %w", err)
+	}
+	return nil
+}
+
+// DeleteUpload removes an upload session from the MongoDB collection by its ID.
+func (repo *MongoUploadRepository) DeleteUpload(ctx context.Context, id string) error {
+	filter := bson.M{"id": id}
+	_, err := repo.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("error deleting upload session: %w", err)
+	}
+	return nil
+}
@@ -13,22 +13,37 @@ import (
 type ChatRoom struct {
 	Id         string
 	Members    map[*Connection]bool
-	Text       chan structs.Message
+	Text       chan TextMessage
 	Seen       chan structs.SeenMessage
 	Delete     chan structs.DeleteMessage
+	Update     chan RoomUpdate
 	Register   chan *Connection
 	Unregister chan *Connection
 }
 
+// TextMessage is a message sent to the room, together with the connection it was sent from, which is told if
+// the message is rejected.
+type TextMessage struct {
+	Message structs.Message
+	Sender  *Connection
+}
+
+// RoomUpdate announces changed details of a room, such as its avatar, to the connected members.
+// The details are mapped for every member separately, as they contain URLs signed for the member.
+type RoomUpdate struct {
+	MapForUser func(userId string) *structs.RoomDto
+}
+
 // NewChatRoom creates a new instance of ChatRoom.
 // It takes a room ID as a parameter and initializes the channels and members map.
 func NewChatRoom(roomId string) *ChatRoom {
 	return &ChatRoom{
 		Id:         roomId,
 		Members:    make(map[*Connection]bool),
-		Text:       make(chan structs.Message),
+		Text:       make(chan TextMessage),
 		Seen:       make(chan structs.SeenMessage),
 		Delete:     make(chan structs.DeleteMessage),
+		Update:     make(chan RoomUpdate),
 		Register:   make(chan *Connection),
 		Unregister: make(chan *Connection),
 	}
@@ -60,11 +75,12 @@ func (r *ChatRoom) Run(service *ChatService) {
 				close(conn.sendMessage)
 			}
 
-		case message := <-r.Text:
-			log.Printf("Broadcasting message to room %s: %s", r.Id, string(message.Content))
-			message, err := service.processAndSaveMessage(ctx, r.Id, &message)
+		case text := <-r.Text:
+			log.Printf("Broadcasting message to room %s: %s", r.Id, string(text.Message.Content))
+			message, err := service.processAndSaveMessage(ctx, r.Id, &text.Message)
 			if err != nil {
-				log.Printf("Error saving message %q in room %s", string(message.Content), r.Id)
+				log.Printf("Error saving message %q in room %s: %v", string(message.Content), r.Id, err)
+				r.rejectMessage(text.Sender, message, err)
 				break
 			}
 			for conn := range r.Members {
@@ -107,6 +123,34 @@ func (r *ChatRoom) Run(service *ChatService) {
 					delete(r.Members, conn)
 				}
 			}
+
+		case update := <-r.Update:
+			log.Printf("Broadcasting room update to room %s", r.Id)
+			for conn := range r.Members {
+				select {
+				case conn.sendUpdate <- *update.MapForUser(conn.user.Id):
+				default:
+					close(conn.sendUpdate)
+					delete(r.Members, conn)
+				}
+			}
 		}
 	}
 }
+
+// rejectMessage tells the sender of a message that it was not saved, if the sender is still connected.
+func (r *ChatRoom) rejectMessage(sender *Connection, message structs.Message, err error) {
+	if _, ok := r.Members[sender]; !ok {
+		return
+	}
+	reason := "message could not be saved"
+	if err == ErrInvalidAttachment {
+		reason = err.Error()
+	}
+	select {
+	case sender.sendError <- structs.ErrorMessage{Error: reason, Content: message.Content}:
+	default:
+		close(sender.sendError)
+		delete(r.Members, sender)
+	}
+}
@@ -13,20 +13,31 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
-// ErrRoomNotFound is an error indicating that the chat room was not found.
-var ErrRoomNotFound = errors.New("room not found")
+// maxAttachments is the largest number of media files that can be attached to a single message.
+const maxAttachments = 10
+
+var (
+	// ErrRoomNotFound is an error indicating that the chat room was not found.
+	ErrRoomNotFound = errors.New("room not found")
+	// ErrInvalidAttachment is an error indicating that a message references media that does not exist, was shared
+	// in another room or was uploaded by another user.
+	ErrInvalidAttachment = errors.New("invalid attachment")
+)
 
 // ChatService provides methods to manage chat rooms and handle connections.
 type ChatService struct {
 	roomRepo    ChatRoomRepository
+	mediaRepo   MediaRepository
 	roomManager RoomManager
 	ai          *client.AiAssistantClient
 }
 
 // NewChatService creates a new instance of ChatService.
-func NewChatService(roomRepo ChatRoomRepository, roomManager RoomManager, ai *client.AiAssistantClient) *ChatService {
+// The MediaRepository is used to validate the media attached to messages.
+func NewChatService(roomRepo ChatRoomRepository, mediaRepo MediaRepository, roomManager RoomManager, ai *client.AiAssistantClient) *ChatService {
 	return &ChatService{
 		roomRepo:    roomRepo,
+		mediaRepo:   mediaRepo,
 		roomManager: roomManager,
 		ai:          ai,
 	}
@@ -95,10 +106,50 @@ func (s *ChatService) pumpExistingMessages(conn *Connection, messages []structs.
 }
 
 // processAndSaveMessage processes and saves a message to a chat room.
+// The attachments of the message are validated and filled in with the metadata of their media files.
+// Legacy embedded media is dropped, as it is not validated.
 func (s *ChatService) processAndSaveMessage(ctx context.Context, roomId string, message *structs.Message) (structs.Message, error) {
+	message.EmbeddedMedia = nil
+	if err := s.resolveAttachments(ctx, roomId, message); err != nil {
+		return *message, err
+	}
 	message.Id = uuid.New().String()
 	message.SentAt = time.Now()
 	message.ChatRoomId = roomId
 	message.SeenBy = []string{message.SentBy}
 	return *message, s.roomRepo.AddMessageToRoom(ctx, roomId, message)
 }
+
+// resolveAttachments checks that every attachment of a message references a distinct media file that was
+// uploaded to the room by the sender of the message, and fills in the metadata of the media file.
+func (s *ChatService) resolveAttachments(ctx context.Context, roomId string, message *structs.Message) error {
+	if len(message.Attachments) > maxAttachments {
+		return ErrInvalidAttachment
+	}
+	seen := make(map[string]bool, len(message.Attachments))
+	for i, attachment := range message.Attachments {
+		if seen[attachment.MediaId] {
+			return ErrInvalidAttachment
+		}
+		seen[attachment.MediaId] = true
+
+		file, err := s.mediaRepo.GetFile(ctx, attachment.MediaId)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				return ErrInvalidAttachment
+			}
+			return err
+		}
+		if file.RoomId != roomId || file.CreatedBy != message.SentBy {
+			return ErrInvalidAttachment
+		}
+		message.Attachments[i] = structs.Attachment{
+			MediaId:     file.Id,
+			Type:        file.Type,
+			Size:        file.Size,
+			CreatedAt:   file.CreatedAt,
+			ContentType: file.ContentType,
+		}
+	}
+	return nil
+}
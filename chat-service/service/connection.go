@@ -16,6 +16,8 @@ type Connection struct {
 	sendMessage chan structs.Message
 	sendSeen    chan structs.SeenMessage
 	sendDelete  chan structs.DeleteMessage
+	sendUpdate  chan structs.RoomDto
+	sendError   chan structs.ErrorMessage
 	room        *ChatRoom
 }
 
@@ -30,6 +32,8 @@ func handleConnection(ws *websocket.Conn, room *ChatRoom, user structs.UserDetai
 		sendMessage: make(chan structs.Message, 256),
 		sendSeen:    make(chan structs.SeenMessage, 256),
 		sendDelete:  make(chan structs.DeleteMessage, 256),
+		sendUpdate:  make(chan structs.RoomDto, 256),
+		sendError:   make(chan structs.ErrorMessage, 256),
 		room:        room,
 	}
 
@@ -80,7 +84,7 @@ func (c *Connection) readPump() {
 				break
 			}
 			msg.SentBy = c.user.Id
-			c.room.Text <- msg
+			c.room.Text <- TextMessage{Message: msg, Sender: c}
 			log.Printf("Received structs.Message: %+v", msg)
 
 		case structs.TypeSeenMessage:
@@ -145,6 +149,26 @@ func (c *Connection) writePump() {
 				log.Printf("Error writing delete message: %v to websocket connection: %s", err, c.ws.RemoteAddr().String())
 				return
 			}
+
+		case roomUpdate, ok := <-c.sendUpdate:
+			if !ok {
+				log.Println("roomUpdate channel closed")
+				return
+			}
+			if err := c.writeMessage(structs.TypeRoomUpdate, roomUpdate); err != nil {
+				log.Printf("Error writing room update: %v to websocket connection: %s", err, c.ws.RemoteAddr().String())
+				return
+			}
+
+		case errorMessage, ok := <-c.sendError:
+			if !ok {
+				log.Println("sendError channel closed")
+				return
+			}
+			if err := c.writeMessage(structs.TypeError, errorMessage); err != nil {
+				log.Printf("Error writing error message: %v to websocket connection: %s", err, c.ws.RemoteAddr().String())
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"example.com/chat_app/chat_service/structs"
+)
+
+const (
+	// defaultUserMediaQuota is the number of bytes a user may upload when MEDIA_USER_QUOTA_BYTES is not set.
+	defaultUserMediaQuota = 1 << 30
+	// defaultRoomMediaQuota is the number of bytes a room may hold when MEDIA_ROOM_QUOTA_BYTES is not set.
+	defaultRoomMediaQuota = 5 << 30
+	// defaultMaxRoomMediaQuota caps raised room quotas when MEDIA_ROOM_QUOTA_MAX_BYTES is not set.
+	defaultMaxRoomMediaQuota = 50 << 30
+)
+
+var (
+	// ErrQuotaExceeded is an error indicating that an upload would exceed the media quota of the user or the room.
+	ErrQuotaExceeded = errors.New("media quota exceeded")
+	// ErrInvalidQuota is an error indicating that a room quota can not be set to the requested value.
+	ErrInvalidQuota = errors.New("invalid media quota")
+)
+
+// MediaQuotas holds the limits of how many bytes of media users and rooms may store.
+type MediaQuotas struct {
+	userLimit    int64
+	roomLimit    int64
+	maxRoomLimit int64
+	admins       map[string]bool
+}
+
+// NewMediaQuotas creates a new MediaQuotas.
+// The limits are read from the MEDIA_USER_QUOTA_BYTES and MEDIA_ROOM_QUOTA_BYTES environment variables.
+// The operators listed by user ID in ADMIN_USER_IDS, separated by commas, can raise the quota of a room up to
+// MEDIA_ROOM_QUOTA_MAX_BYTES. Admins of a room can not, as any user can create a room and become its admin.
+func NewMediaQuotas() (*MediaQuotas, error) {
+	userLimit, err := readQuota("MEDIA_USER_QUOTA_BYTES", defaultUserMediaQuota)
+	if err != nil {
+		return nil, err
+	}
+	roomLimit, err := readQuota("MEDIA_ROOM_QUOTA_BYTES", defaultRoomMediaQuota)
+	if err != nil {
+		return nil, err
+	}
+	maxRoomLimit, err := readQuota("MEDIA_ROOM_QUOTA_MAX_BYTES", defaultMaxRoomMediaQuota)
+	if err != nil {
+		return nil, err
+	}
+	if maxRoomLimit < roomLimit {
+		return nil, fmt.Errorf("MEDIA_ROOM_QUOTA_MAX_BYTES must not be lower than MEDIA_ROOM_QUOTA_BYTES")
+	}
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+	return &MediaQuotas{userLimit: userLimit, roomLimit: roomLimit, maxRoomLimit: maxRoomLimit, admins: admins}, nil
+}
+
+// readQuota reads a quota in bytes from an environment variable, falling back to the default if it is not set.
+func readQuota(name string, defaultQuota int64) (int64, error) {
+	quotaString := os.Getenv(name)
+	if quotaString == "" {
+		return defaultQuota, nil
+	}
+	quota, err := strconv.ParseInt(quotaString, 10, 64)
+	if err != nil || quota <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, quotaString)
+	}
+	return quota, nil
+}
+
+// roomLimitOf returns the quota of a room, which is the default room quota unless an admin raised it.
+func (q *MediaQuotas) roomLimitOf(room *structs.ChatRoomEntity) int64 {
+	return max(room.MediaQuota, q.roomLimit)
+}
+
+// GetUserUsage reports how many bytes of media the user has uploaded and how many they may upload.
+func (s *MediaService) GetUserUsage(ctx context.Context, userId string) (*structs.MediaUsage, error) {
+	used, err := s.repo.GetUserUsage(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return &structs.MediaUsage{Used: used, Limit: s.quotas.userLimit}, nil
+}
+
+// GetRoomUsage reports how many bytes of media are shared in a room and how many may be shared.
+// Only members of the room can see its usage.
+func (s *MediaService) GetRoomUsage(ctx context.Context, roomId, userId string) (*structs.MediaUsage, error) {
+	room, err := s.roomRepo.GetRoom(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+	if !checkIfUserBelongsToRoom(room, userId) {
+		return nil, ErrInsufficientPermissions
+	}
+	used, err := s.repo.GetRoomUsage(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+	return &structs.MediaUsage{Used: used, Limit: s.quotas.roomLimitOf(room)}, nil
+}
+
+// RaiseRoomQuota raises the media quota of a room if the user is an operator listed in ADMIN_USER_IDS.
+// The quota can only be raised, and not beyond the configured maximum room quota.
+func (s *MediaService) RaiseRoomQuota(ctx context.Context, roomId, userId string, limit int64) (*structs.MediaUsage, error) {
+	if !s.quotas.admins[userId] {
+		return nil, ErrInsufficientPermissions
+	}
+	room, err := s.roomRepo.GetRoom(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+	if limit < s.quotas.roomLimitOf(room) || limit > s.quotas.maxRoomLimit {
+		return nil, ErrInvalidQuota
+	}
+	if err := s.roomRepo.SetMediaQuota(ctx, roomId, limit); err != nil {
+		return nil, err
+	}
+	log.Printf("Admin %s raised media quota of room %s to %d bytes", userId, roomId, limit)
+	room.MediaQuota = limit
+	used, err := s.repo.GetRoomUsage(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+	return &structs.MediaUsage{Used: used, Limit: s.quotas.roomLimitOf(room)}, nil
+}
+
+// checkQuota checks that the user is a member of the room and that storing size more bytes of media stays within
+// the quotas of the user and the room, so that outsiders can neither attach files to a room nor use up its quota.
+func (s *MediaService) checkQuota(ctx context.Context, roomId, userId string, size int64) error {
+	room, err := s.roomRepo.GetRoom(ctx, roomId)
+	if err != nil {
+		return err
+	}
+	if !checkIfUserBelongsToRoom(room, userId) {
+		return ErrInsufficientPermissions
+	}
+	userUsage, err := s.repo.GetUserUsage(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if userUsage+size > s.quotas.userLimit {
+		return ErrQuotaExceeded
+	}
+	roomUsage, err := s.repo.GetRoomUsage(ctx, roomId)
+	if err != nil {
+		return err
+	}
+	if roomUsage+size > s.quotas.roomLimitOf(room) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
@@ -2,11 +2,42 @@ package service
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
+	"example.com/chat_app/chat_service/client"
 	"example.com/chat_app/chat_service/structs"
+	"example.com/chat_app/identity"
 	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrUnknownVariant is an error indicating that the requested media variant does not exist.
+	ErrUnknownVariant = errors.New("unknown media variant")
+	// ErrInvalidCursor is an error indicating that a paging cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrMediaNotFound is an error indicating that the media service has no binary data for the media file.
+	ErrMediaNotFound = client.ErrMediaNotFound
+	// ErrUnsupportedMedia is an error indicating that the uploaded media is not in a supported format.
+	ErrUnsupportedMedia = client.ErrUnsupportedMedia
+	// ErrMediaTooLarge is an error indicating that the uploaded media exceeds the allowed size or dimensions.
+	ErrMediaTooLarge = client.ErrMediaTooLarge
+	// ErrMediaScanPending is an error indicating that the media has not been scanned for malware yet.
+	ErrMediaScanPending = client.ErrMediaScanPending
+	// ErrMediaInfected is an error indicating that malware was found in the media.
+	ErrMediaInfected = client.ErrMediaInfected
+	// ErrUploadNotFound is an error indicating that a resumable upload does not exist or has expired.
+	ErrUploadNotFound = client.ErrUploadNotFound
+	// ErrUploadOffsetMismatch is an error indicating that a chunk does not start at the current offset of the upload.
+	ErrUploadOffsetMismatch = client.ErrUploadOffsetMismatch
+	// ErrUploadIncomplete is an error indicating that an upload was finalized before all of its bytes were received.
+	ErrUploadIncomplete = client.ErrUploadIncomplete
 )
 
 // MediaRepository provides methods to interact with the media file storage.
@@ -14,77 +45,377 @@ type MediaRepository interface {
 	GetFile(ctx context.Context, id string) (*structs.MediaFile, error)
 	DeleteFile(ctx context.Context, id string) error
 	SaveFile(ctx context.Context, file *structs.MediaFile) error
+	GetFilesByRoom(ctx context.Context, roomId string) ([]structs.MediaFile, error)
+	GetFilesByType(ctx context.Context, mediaType structs.MediaType) ([]structs.MediaFile, error)
+	GetUserUsage(ctx context.Context, userId string) (int64, error)
+	GetRoomUsage(ctx context.Context, roomId string) (int64, error)
+	GetFilesPage(ctx context.Context, filter structs.MediaFilter) ([]structs.MediaFile, error)
+}
+
+// UploadRepository provides methods to interact with the resumable upload session storage.
+type UploadRepository interface {
+	GetUpload(ctx context.Context, id string) (*structs.UploadSession, error)
+	SaveUpload(ctx context.Context, upload *structs.UploadSession) error
+	DeleteUpload(ctx context.Context, id string) error
 }
 
 // Client is an interface for interacting with the media storage service.
 type Client interface {
-	UploadMedia(ctx context.Context, mediaType string, mediaBytes []byte) (string, error)
-	DownloadMedia(ctx context.Context, blobId, mediaType string) ([]byte, error)
+	UploadMedia(ctx context.Context, mediaType string, mediaBytes []byte) (*client.BlobMetadata, error)
+	GetMediaMetadata(ctx context.Context, blobId, mediaType string) (*client.BlobMetadata, error)
+	DownloadMedia(ctx context.Context, blobId, mediaType, variant string) ([]byte, error)
+	DeleteMedia(ctx context.Context, blobId, mediaType string) error
+	PurgeMedia(ctx context.Context, blobId, mediaType string) error
+	ListMedia(ctx context.Context, mediaType string) ([]client.StoredBlob, error)
+	CreateUpload(ctx context.Context, mediaType string, length int64) (*client.UploadStatus, error)
+	GetUploadOffset(ctx context.Context, uploadId string) (int64, error)
+	AppendUploadChunk(ctx context.Context, uploadId string, offset int64, chunk io.Reader) (int64, error)
+	FinalizeUpload(ctx context.Context, uploadId string) (*client.BlobMetadata, error)
 }
 
 // MediaService provides methods to manage media files.
 type MediaService struct {
-	repo   MediaRepository
-	client Client
+	repo       MediaRepository
+	uploadRepo UploadRepository
+	roomRepo   ChatRoomRepository
+	client     Client
+	signer     *identity.UrlSigner
+	quotas     *MediaQuotas
 }
 
 // NewMediaService creates a new instance of MediaService.
-// It takes a MediaRepository and a Client as dependencies.
-func NewMediaService(repo MediaRepository, client Client) *MediaService {
+// It takes a MediaRepository, an UploadRepository, a ChatRoomRepository, a Client, a UrlSigner and the
+// MediaQuotas as dependencies.
+func NewMediaService(repo MediaRepository, uploadRepo UploadRepository, roomRepo ChatRoomRepository, client Client, signer *identity.UrlSigner, quotas *MediaQuotas) *MediaService {
 	return &MediaService{
-		repo:   repo,
-		client: client,
+		repo:       repo,
+		uploadRepo: uploadRepo,
+		roomRepo:   roomRepo,
+		client:     client,
+		signer:     signer,
+		quotas:     quotas,
 	}
 }
 
 // CreateMediaResource creates a new media resource.
 // It uploads the media to the media service and saves the metadata in the repository.
+// If the user is not a member of the room, ErrInsufficientPermissions is returned, and if the media would exceed
+// the quota of the user or the room, ErrQuotaExceeded.
 func (s *MediaService) CreateMediaResource(ctx context.Context, roomId, mediaTypeStr, userId string, mediaBytes []byte) (*structs.MediaFile, error) {
 	log.Printf("Uploading media of type %s\n to room %s", mediaTypeStr, roomId)
-	blobId, err := s.client.UploadMedia(ctx, mediaTypeStr, mediaBytes)
+	mediaType, err := structs.ParseMediaType(mediaTypeStr)
 	if err != nil {
 		return nil, err
 	}
-	mediaType, err := structs.ParseMediaType(mediaTypeStr)
+	if err := s.checkQuota(ctx, roomId, userId, int64(len(mediaBytes))); err != nil {
+		return nil, err
+	}
+	blob, err := s.client.UploadMedia(ctx, mediaType.String(), mediaBytes)
 	if err != nil {
 		return nil, err
 	}
 	file := &structs.MediaFile{
-		Id:        uuid.New().String(),
-		RoomId:    roomId,
-		Type:      mediaType,
-		CreatedAt: time.Now(),
-		BlobId:    blobId,
-		CreatedBy: userId,
+		Id:          uuid.New().String(),
+		RoomId:      roomId,
+		Type:        mediaType,
+		CreatedAt:   time.Now(),
+		BlobId:      blob.BlobId,
+		CreatedBy:   userId,
+		Size:        blob.Size,
+		ContentType: blob.ContentType,
 	}
 	err = s.repo.SaveFile(ctx, file)
 	if err != nil {
 		return nil, err
 	}
+	s.addSignedUrls(file, userId)
 	return file, nil
 }
 
-// GetMediaMetadata retrieves a media file by its ID.
-// It downloads the media from the media service and returns the metadata and binary data.
-func (s *MediaService) GetMediaMetadata(ctx context.Context, id string) (*structs.MediaFile, error) {
+// GetMediaMetadata retrieves a media file by its ID if the user belongs to the room it was shared in.
+// The returned metadata contains short-lived download URLs signed for the user.
+func (s *MediaService) GetMediaMetadata(ctx context.Context, id, userId string) (*structs.MediaFile, error) {
 	fileMetadata, err := s.repo.GetFile(ctx, id)
 	if err != nil {
 		return nil, err
 	}
+	room, err := s.roomRepo.GetRoom(ctx, fileMetadata.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	if !checkIfUserBelongsToRoom(room, userId) {
+		return nil, ErrInsufficientPermissions
+	}
+	s.addSignedUrls(fileMetadata, userId)
 	return fileMetadata, nil
 }
 
-// GetMediaBinary retrieves the binary data of a media file by its ID.
+// GetMediaBinary retrieves the binary data of a media file by its ID together with its content type.
 // It downloads the media from the media service and returns the binary data.
-func (s *MediaService) GetMediaBinary(ctx context.Context, id string) ([]byte, error) {
+// If variant is not empty, the resized image variant with that name is returned instead of the original.
+// Variants are encoded in the format of their image, so they share its content type.
+// Only members of the room the media was shared in can download it.
+func (s *MediaService) GetMediaBinary(ctx context.Context, id, variant, userId string) ([]byte, string, error) {
 	fileMetadata, err := s.repo.GetFile(ctx, id)
+	if err != nil {
+		return nil, "", err
+	}
+	room, err := s.roomRepo.GetRoom(ctx, fileMetadata.RoomId)
+	if err != nil {
+		return nil, "", err
+	}
+	if !checkIfUserBelongsToRoom(room, userId) {
+		return nil, "", ErrInsufficientPermissions
+	}
+	if variant != "" && !structs.IsValidVariant(variant) {
+		return nil, "", ErrUnknownVariant
+	}
+	imageBytes, err := s.client.DownloadMedia(ctx, fileMetadata.BlobId, fileMetadata.Type.String(), variant)
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := fileMetadata.ContentType
+	if contentType == "" {
+		// Media files saved before the media service tracked content types.
+		blob, err := s.client.GetMediaMetadata(ctx, fileMetadata.BlobId, fileMetadata.Type.String())
+		if err != nil {
+			return nil, "", err
+		}
+		contentType = blob.ContentType
+	}
+	return imageBytes, contentType, nil
+}
+
+// ListRoomMedia lists the media files shared in a room that match the filter, newest first.
+// The cursor returned with a page continues the listing at the next page. Only members of the room can list
+// its media; every returned file contains download URLs signed for the user.
+func (s *MediaService) ListRoomMedia(ctx context.Context, filter structs.MediaFilter, cursor, userId string) (*structs.MediaPage, error) {
+	room, err := s.roomRepo.GetRoom(ctx, filter.RoomId)
+	if err != nil {
+		return nil, err
+	}
+	if !checkIfUserBelongsToRoom(room, userId) {
+		return nil, ErrInsufficientPermissions
+	}
+	if cursor != "" {
+		filter.After, err = decodeMediaCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Fetch one file more than requested to find out whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	files, err := s.repo.GetFilesPage(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &structs.MediaPage{Items: files}
+	if int64(len(files)) > limit {
+		page.Items = files[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeMediaCursor(structs.MediaCursor{CreatedAt: last.CreatedAt, Id: last.Id})
+	}
+	for i := range page.Items {
+		s.addSignedUrls(&page.Items[i], userId)
+	}
+	return page, nil
+}
+
+// encodeMediaCursor encodes the position of a media file into an opaque cursor.
+func encodeMediaCursor(cursor structs.MediaCursor) string {
+	raw := strconv.FormatInt(cursor.CreatedAt.UnixMilli(), 10) + ":" + cursor.Id
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeMediaCursor decodes a cursor created by encodeMediaCursor.
+func decodeMediaCursor(cursor string) (*structs.MediaCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	millis, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	createdAt, err := strconv.ParseInt(millis, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &structs.MediaCursor{CreatedAt: time.UnixMilli(createdAt), Id: id}, nil
+}
+
+// DeleteMedia deletes a media file if the user uploaded it or is an admin of the room it was shared in.
+// The avatar of a room can only be deleted after it was replaced or removed.
+// The reference to its blob is released in the media service before the metadata is removed.
+func (s *MediaService) DeleteMedia(ctx context.Context, id, userId string) error {
+	file, err := s.repo.GetFile(ctx, id)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrMediaNotFound
+		}
+		return err
+	}
+	if file.CreatedBy != userId {
+		permissions, err := s.roomRepo.GetUsersPermissions(ctx, file.RoomId, userId)
+		if err != nil || permissions.Role != structs.Admin {
+			return ErrInsufficientPermissions
+		}
+	}
+	room, err := s.roomRepo.GetRoom(ctx, file.RoomId)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	if room != nil && room.Avatar != nil && room.Avatar.Id == file.Id {
+		return ErrAvatarInUse
+	}
+	return s.deleteFile(ctx, file)
+}
+
+// DeleteRoomMedia deletes all media files shared in a room.
+// It is called when the room is deleted; files that cannot be deleted are left to the MediaSweeper.
+func (s *MediaService) DeleteRoomMedia(ctx context.Context, roomId string) error {
+	files, err := s.repo.GetFilesByRoom(ctx, roomId)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i := range files {
+		if err := s.deleteFile(ctx, &files[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	log.Printf("Deleted %d of %d media files of room %s", len(files)-len(errs), len(files), roomId)
+	return errors.Join(errs...)
+}
+
+// deleteFile releases the blob of a media file in the media service and removes its metadata.
+func (s *MediaService) deleteFile(ctx context.Context, file *structs.MediaFile) error {
+	if err := s.client.DeleteMedia(ctx, file.BlobId, file.Type.String()); err != nil {
+		return err
+	}
+	return s.repo.DeleteFile(ctx, file.Id)
+}
+
+// CreateUpload starts a resumable upload of media of the given total length to a room.
+// If the media would exceed the quota of the user or the room, ErrQuotaExceeded is returned.
+func (s *MediaService) CreateUpload(ctx context.Context, roomId, mediaTypeStr, userId string, length int64) (*structs.UploadSession, error) {
+	mediaType, err := structs.ParseMediaType(mediaTypeStr)
 	if err != nil {
 		return nil, err
 	}
-	imageBytes, err := s.client.DownloadMedia(ctx, fileMetadata.BlobId, fileMetadata.Type.String())
+	if err := s.checkQuota(ctx, roomId, userId, length); err != nil {
+		return nil, err
+	}
+	status, err := s.client.CreateUpload(ctx, mediaType.String(), length)
 	if err != nil {
 		return nil, err
 	}
+	upload := &structs.UploadSession{
+		Id:             uuid.New().String(),
+		RoomId:         roomId,
+		Type:           mediaType,
+		CreatedBy:      userId,
+		Length:         length,
+		RemoteUploadId: status.UploadId,
+		CreatedAt:      time.Now(),
+		ExpiresAt:      status.ExpiresAt,
+	}
+	if err := s.uploadRepo.SaveUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+	log.Printf("Created upload %s of %d bytes to room %s", upload.Id, length, roomId)
+	return upload, nil
+}
 
-	return imageBytes, nil
+// GetUpload retrieves a resumable upload of the user together with the number of bytes received so far.
+func (s *MediaService) GetUpload(ctx context.Context, uploadId, userId string) (*structs.UploadSession, error) {
+	upload, err := s.getUsersUpload(ctx, uploadId, userId)
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset, err = s.client.GetUploadOffset(ctx, upload.RemoteUploadId)
+	if err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// AppendUploadChunk appends a chunk starting at the given offset to a resumable upload of the user.
+// It returns the offset of the upload after the chunk was appended.
+func (s *MediaService) AppendUploadChunk(ctx context.Context, uploadId, userId string, offset int64, chunk io.Reader) (int64, error) {
+	upload, err := s.getUsersUpload(ctx, uploadId, userId)
+	if err != nil {
+		return 0, err
+	}
+	return s.client.AppendUploadChunk(ctx, upload.RemoteUploadId, offset, chunk)
+}
+
+// FinalizeUpload completes a resumable upload of the user and registers the stored media as a new media file.
+// The quotas are checked again, since other media may have been uploaded while the upload was in progress.
+func (s *MediaService) FinalizeUpload(ctx context.Context, uploadId, userId string) (*structs.MediaFile, error) {
+	upload, err := s.getUsersUpload(ctx, uploadId, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkQuota(ctx, upload.RoomId, userId, upload.Length); err != nil {
+		return nil, err
+	}
+	blob, err := s.client.FinalizeUpload(ctx, upload.RemoteUploadId)
+	if err != nil {
+		return nil, err
+	}
+	file := &structs.MediaFile{
+		Id:          uuid.New().String(),
+		RoomId:      upload.RoomId,
+		Type:        upload.Type,
+		CreatedAt:   time.Now(),
+		BlobId:      blob.BlobId,
+		CreatedBy:   userId,
+		Size:        blob.Size,
+		ContentType: blob.ContentType,
+	}
+	if err := s.repo.SaveFile(ctx, file); err != nil {
+		return nil, err
+	}
+	if err := s.uploadRepo.DeleteUpload(ctx, uploadId); err != nil {
+		log.Printf("Failed deleting finalized upload %s: %v", uploadId, err)
+	}
+	s.addSignedUrls(file, userId)
+	return file, nil
+}
+
+// getUsersUpload retrieves an unexpired upload session and checks that it was created by the user.
+func (s *MediaService) getUsersUpload(ctx context.Context, uploadId, userId string) (*structs.UploadSession, error) {
+	upload, err := s.uploadRepo.GetUpload(ctx, uploadId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	if time.Now().After(upload.ExpiresAt) {
+		return nil, ErrUploadNotFound
+	}
+	if upload.CreatedBy != userId {
+		return nil, ErrInsufficientPermissions
+	}
+	return upload, nil
+}
+
+// addSignedUrls fills in the signed download URLs of the media file and of the resized variants of an image.
+func (s *MediaService) addSignedUrls(file *structs.MediaFile, userId string) {
+	url, expiresAt := s.signer.SignMediaUrl(file.Type.String(), file.BlobId, "", userId)
+	file.Url = url
+	file.UrlExpiresAt = &expiresAt
+	if file.Type != structs.Image {
+		return
+	}
+	file.Variants = make(map[string]string, len(structs.ImageVariants))
+	for _, variant := range structs.ImageVariants {
+		file.Variants[variant], _ = s.signer.SignMediaUrl(file.Type.String(), file.BlobId, variant, userId)
+	}
 }
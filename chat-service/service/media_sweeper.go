@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/chat_app/chat_service/structs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultSweepInterval is the time between two sweeps used when MEDIA_SWEEP_INTERVAL_MINUTES is not set.
+	defaultSweepInterval = time.Hour
+	// sweepGracePeriod protects media that is still being created: a blob is uploaded before its media file
+	// is saved, so neither side is touched by the sweeper until it is older than this.
+	sweepGracePeriod = time.Hour
+)
+
+// sweptMediaTypes lists the media types whose records and blobs are reconciled by the MediaSweeper.
+var sweptMediaTypes = []structs.MediaType{structs.Image, structs.Video, structs.Audio, structs.Other}
+
+// MediaSweeper periodically reconciles the media file records with the blobs stored in the media service.
+// It deletes media files of rooms that no longer exist, media files whose blob is missing and blobs that
+// no media file references anymore.
+type MediaSweeper struct {
+	mediaService *MediaService
+	interval     time.Duration
+}
+
+// NewMediaSweeper creates a new MediaSweeper.
+// The time between two sweeps is read from the MEDIA_SWEEP_INTERVAL_MINUTES environment variable.
+func NewMediaSweeper(mediaService *MediaService) (*MediaSweeper, error) {
+	interval := defaultSweepInterval
+	if intervalString := os.Getenv("MEDIA_SWEEP_INTERVAL_MINUTES"); intervalString != "" {
+		minutes, err := strconv.Atoi(intervalString)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("invalid MEDIA_SWEEP_INTERVAL_MINUTES: %q", intervalString)
+		}
+		interval = time.Duration(minutes) * time.Minute
+	}
+	return &MediaSweeper{mediaService: mediaService, interval: interval}, nil
+}
+
+// Start sweeps the media every interval until the context is cancelled.
+func (s *MediaSweeper) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.Sweep(ctx)
+			}
+		}
+	}()
+}
+
+// Sweep reconciles the media file records of every media type with the stored blobs once.
+func (s *MediaSweeper) Sweep(ctx context.Context) {
+	rooms := make(map[string]bool)
+	for _, mediaType := range sweptMediaTypes {
+		if err := s.sweepMediaType(ctx, mediaType, rooms); err != nil {
+			log.Printf("Failed sweeping %s media: %v", mediaType, err)
+		}
+	}
+}
+
+// sweepMediaType reconciles the media file records of one media type with the blobs stored for it.
+// The existence of rooms is cached in rooms for the duration of a sweep.
+func (s *MediaSweeper) sweepMediaType(ctx context.Context, mediaType structs.MediaType, rooms map[string]bool) error {
+	ms := s.mediaService
+	blobs, err := ms.client.ListMedia(ctx, mediaType.String())
+	if err != nil {
+		return err
+	}
+	files, err := ms.repo.GetFilesByType(ctx, mediaType)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-sweepGracePeriod)
+	storedBlobs := make(map[string]bool, len(blobs))
+	for _, blob := range blobs {
+		storedBlobs[blob.BlobId] = true
+	}
+
+	referencedBlobs := make(map[string]bool, len(files))
+	deletedFiles := 0
+	for i := range files {
+		file := &files[i]
+		roomExists, err := s.roomExists(ctx, file.RoomId, rooms)
+		if err != nil {
+			return err
+		}
+		blobMissing := !storedBlobs[file.BlobId] && file.CreatedAt.Before(cutoff)
+		if roomExists && !blobMissing {
+			referencedBlobs[file.BlobId] = true
+			continue
+		}
+		if err := ms.deleteFile(ctx, file); err != nil {
+			log.Printf("Failed deleting orphaned media file %s: %v", file.Id, err)
+			referencedBlobs[file.BlobId] = true
+			continue
+		}
+		deletedFiles++
+	}
+
+	purgedBlobs := 0
+	for _, blob := range blobs {
+		if referencedBlobs[blob.BlobId] || !blob.CreatedAt.Before(cutoff) {
+			continue
+		}
+		if err := ms.client.PurgeMedia(ctx, blob.BlobId, mediaType.String()); err != nil {
+			log.Printf("Failed purging unreferenced blob %s: %v", blob.BlobId, err)
+			continue
+		}
+		purgedBlobs++
+	}
+
+	if deletedFiles > 0 || purgedBlobs > 0 {
+		log.Printf("Swept %s media: deleted %d orphaned media files and purged %d unreferenced blobs", mediaType, deletedFiles, purgedBlobs)
+	}
+	return nil
+}
+
+// roomExists checks whether a room exists, caching the result in rooms.
+func (s *MediaSweeper) roomExists(ctx context.Context, roomId string, rooms map[string]bool) (bool, error) {
+	if exists, ok := rooms[roomId]; ok {
+		return exists, nil
+	}
+	_, err := s.mediaService.roomRepo.GetRoom(ctx, roomId)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return false, err
+	}
+	rooms[roomId] = err == nil
+	return rooms[roomId], nil
+}
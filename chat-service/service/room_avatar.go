@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"example.com/chat_app/chat_service/client"
+	"example.com/chat_app/chat_service/structs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	// ErrInvalidAvatar is an error indicating that a media file can not be used as the avatar of a room.
+	ErrInvalidAvatar = errors.New("avatar must be an image shared in the room")
+	// ErrAvatarInUse is an error indicating that a media file can not be deleted while it is the avatar of its room.
+	ErrAvatarInUse = errors.New("media is the avatar of its room")
+)
+
+// SetRoomAvatar makes an image shared in the room its avatar if the user has admin privileges.
+// The image is uploaded through the regular media upload first. The change is announced to the connected members.
+func (s *RoomService) SetRoomAvatar(ctx context.Context, roomId, mediaId, userId string) (*structs.RoomDto, error) {
+	if err := s.validateAdminPrivileges(ctx, roomId, userId); err != nil {
+		return nil, err
+	}
+	file, err := s.mediaService.repo.GetFile(ctx, mediaId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidAvatar
+		}
+		return nil, err
+	}
+	if file.RoomId != roomId || file.Type != structs.Image {
+		return nil, ErrInvalidAvatar
+	}
+	if err := s.repo.SetAvatar(ctx, roomId, file); err != nil {
+		return nil, err
+	}
+	log.Printf("User %s set media %s as avatar of room %s", userId, mediaId, roomId)
+	return s.announceRoomUpdate(ctx, roomId, userId)
+}
+
+// RemoveRoomAvatar removes the avatar of the room if the user has admin privileges.
+// The image itself stays shared in the room.
+func (s *RoomService) RemoveRoomAvatar(ctx context.Context, roomId, userId string) (*structs.RoomDto, error) {
+	if err := s.validateAdminPrivileges(ctx, roomId, userId); err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetAvatar(ctx, roomId, nil); err != nil {
+		return nil, err
+	}
+	return s.announceRoomUpdate(ctx, roomId, userId)
+}
+
+// announceRoomUpdate sends the current details of the room to its connected members
+// and returns them as seen by the user.
+func (s *RoomService) announceRoomUpdate(ctx context.Context, roomId, userId string) (*structs.RoomDto, error) {
+	room, err := s.repo.GetRoom(ctx, roomId)
+	if err != nil {
+		return nil, err
+	}
+	// The members are looked up once here, as the room maps its details for every connected member.
+	members := s.lookupMembers(ctx, room)
+	if chatRoom, active := s.roomManager.GetActiveRoom(roomId); active {
+		chatRoom.Update <- RoomUpdate{
+			MapForUser: func(memberId string) *structs.RoomDto {
+				return s.mapRoomForUser(room, memberId, members)
+			},
+		}
+	}
+	return s.mapRoomForUser(room, userId, members), nil
+}
+
+// mapRoomForUser maps a room to its DTO, with the profiles of the members and the avatar URLs signed for the user.
+func (s *RoomService) mapRoomForUser(room *structs.ChatRoomEntity, userId string, members map[string]client.UserSummary) *structs.RoomDto {
+	roomDto := MapRoomEntityToDto(room)
+	addMemberProfiles(roomDto, members)
+	roomDto.Avatar = s.mediaService.signAvatar(room.Avatar, userId)
+	return roomDto
+}
+
+// signAvatar returns the signed URLs of an avatar image and its thumbnail for the user,
+// or nil if there is no avatar.
+func (s *MediaService) signAvatar(avatar *structs.MediaFile, userId string) *structs.AvatarDto {
+	if avatar == nil {
+		return nil
+	}
+	url, expiresAt := s.signer.SignMediaUrl(avatar.Type.String(), avatar.BlobId, "", userId)
+	thumbUrl, _ := s.signer.SignMediaUrl(avatar.Type.String(), avatar.BlobId, structs.VariantThumb, userId)
+	return &structs.AvatarDto{
+		MediaId:   avatar.Id,
+		Url:       url,
+		ThumbUrl:  thumbUrl,
+		ExpiresAt: expiresAt,
+	}
+}
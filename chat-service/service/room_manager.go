@@ -8,6 +8,7 @@ import (
 // RoomManager is an interface for managing chat rooms.
 type RoomManager interface {
 	ManageRoom(roomId string) *ChatRoom
+	GetActiveRoom(roomId string) (*ChatRoom, bool)
 }
 
 // InMemoryRoomManager is an implementation of RoomManager that stores chat rooms in memory.
@@ -36,3 +37,11 @@ func (m *InMemoryRoomManager) ManageRoom(roomId string) *ChatRoom {
 	}
 	return room
 }
+
+// GetActiveRoom returns the chat room if it is managed, without creating it.
+func (m *InMemoryRoomManager) GetActiveRoom(roomId string) (*ChatRoom, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	room, exists := m.rooms[roomId]
+	return room, exists
+}
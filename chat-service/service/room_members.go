@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"log"
+
+	"example.com/chat_app/chat_service/client"
+	"example.com/chat_app/chat_service/structs"
+)
+
+// UserDirectory is an interface for looking up the profiles of users in the user service.
+type UserDirectory interface {
+	GetUsers(ctx context.Context, ids []string) ([]client.UserSummary, error)
+}
+
+// lookupMembers looks up the profiles of the members of the rooms with a single request, by user ID.
+// Rooms are still listed if the user service can not be reached, so failures are logged and leave the
+// profiles out.
+func (s *RoomService) lookupMembers(ctx context.Context, rooms ...*structs.ChatRoomEntity) map[string]client.UserSummary {
+	ids := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, room := range rooms {
+		for _, member := range room.Users {
+			if !seen[member.UserId] {
+				seen[member.UserId] = true
+				ids = append(ids, member.UserId)
+			}
+		}
+	}
+	members := make(map[string]client.UserSummary, len(ids))
+	if len(ids) == 0 {
+		return members
+	}
+	users, err := s.users.GetUsers(ctx, ids)
+	if err != nil {
+		log.Printf("Failed looking up room members: %v", err)
+		return members
+	}
+	for _, user := range users {
+		members[user.Id] = user
+	}
+	return members
+}
+
+// addMemberProfiles adds the usernames and display names of the members to the room DTO.
+func addMemberProfiles(roomDto *structs.RoomDto, members map[string]client.UserSummary) {
+	for i := range roomDto.Members {
+		if user, ok := members[roomDto.Members[i].Id]; ok {
+			roomDto.Members[i].Username = user.Username
+			roomDto.Members[i].DisplayName = user.DisplayName
+		}
+	}
+}
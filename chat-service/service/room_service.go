@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"errors"
+	"log"
 
 	"example.com/chat_app/chat_service/structs"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -19,6 +20,8 @@ type ChatRoomRepository interface {
 	DeleteUserFromRoom(ctx context.Context, roomId string, userId string) error
 	GetUsersPermissions(ctx context.Context, roomId string, userId string) (*structs.UserPermissions, error)
 	ChangeUserRole(ctx context.Context, roomId string, userId string, role structs.Role) error
+	SetMediaQuota(ctx context.Context, roomId string, quota int64) error
+	SetAvatar(ctx context.Context, roomId string, avatar *structs.MediaFile) error
 	GetUnseenMessages(ctx context.Context, roomId, userId string) ([]structs.Message, error)
 	GetUsersRooms(ctx context.Context, userId string) ([]structs.ChatRoomEntity, error)
 }
@@ -28,12 +31,18 @@ var ErrInsufficientPermissions = errors.New("insufficient permissions")
 
 // RoomService provides methods to manage chat rooms and handle user permissions.
 type RoomService struct {
-	repo ChatRoomRepository
+	repo         ChatRoomRepository
+	mediaService *MediaService
+	roomManager  RoomManager
+	users        UserDirectory
 }
 
 // NewRoomService creates a new instance of RoomService.
-func NewRoomService(repo ChatRoomRepository) *RoomService {
-	return &RoomService{repo: repo}
+// The MediaService is used to delete the media shared in a room together with the room and to sign the URLs of
+// room avatars. Changes of the room details are announced to the members connected through the RoomManager.
+// The UserDirectory is used to show the usernames of the members.
+func NewRoomService(repo ChatRoomRepository, mediaService *MediaService, roomManager RoomManager, users UserDirectory) *RoomService {
+	return &RoomService{repo: repo, mediaService: mediaService, roomManager: roomManager, users: users}
 }
 
 // GetRoomDto retrieves a chat room DTO if the user belongs to the room.
@@ -45,8 +54,7 @@ func (s *RoomService) GetRoomDto(ctx context.Context, roomId string, userId stri
 	if !checkIfUserBelongsToRoom(room, userId) {
 		return nil, ErrInsufficientPermissions
 	}
-	roomDto := MapRoomEntityToDto(room)
-	return roomDto, nil
+	return s.mapRoomForUser(room, userId, s.lookupMembers(ctx, room)), nil
 }
 
 // CreateRoom creates a new chat room and adds the creating user as an admin.
@@ -62,12 +70,19 @@ func (s *RoomService) CreateRoom(ctx context.Context, userId, name string) (*str
 	return room, nil
 }
 
-// DeleteRoom deletes a chat room if the user has admin privileges.
+// DeleteRoom deletes a chat room together with its media if the user has admin privileges.
+// Media that cannot be deleted right away is cleaned up later by the MediaSweeper.
 func (s *RoomService) DeleteRoom(ctx context.Context, roomId string, userId string) error {
 	if err := s.validateAdminPrivileges(ctx, roomId, userId); err != nil {
 		return err
 	}
-	return s.repo.DeleteRoom(ctx, roomId)
+	if err := s.repo.DeleteRoom(ctx, roomId); err != nil {
+		return err
+	}
+	if err := s.mediaService.DeleteRoomMedia(ctx, roomId); err != nil {
+		log.Printf("Failed deleting media of room %s: %v", roomId, err)
+	}
+	return nil
 }
 
 // AddUserToRoom adds a user to a chat room if the requesting user has admin privileges.
@@ -160,9 +175,15 @@ func (s *RoomService) ListRoomsForUser(ctx context.Context, userId string) ([]st
 		return nil, err
 	}
 
+	roomPointers := make([]*structs.ChatRoomEntity, 0, len(rooms))
+	for i := range rooms {
+		roomPointers = append(roomPointers, &rooms[i])
+	}
+	members := s.lookupMembers(ctx, roomPointers...)
+
 	roomDtos := make([]structs.RoomDto, 0, len(rooms))
-	for _, room := range rooms {
-		roomDto := MapRoomEntityToDto(&room)
+	for _, room := range roomPointers {
+		roomDto := s.mapRoomForUser(room, userId, members)
 		roomDtos = append(roomDtos, *roomDto)
 	}
 
@@ -1,11 +1,27 @@
 package structs
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 type RoomDto struct {
-	Id      string    `json:"id"`
-	Name    string    `json:"name"`
-	Members []UserDto `json:"members"`
+	Id      string     `json:"id"`
+	Name    string     `json:"name"`
+	Members []UserDto  `json:"members"`
+	Avatar  *AvatarDto `json:"avatar,omitempty"`
+}
+
+// AvatarDto holds short-lived signed URLs of an avatar image and of its thumbnail.
+type AvatarDto struct {
+	MediaId   string    `json:"mediaId"`
+	Url       string    `json:"url"`
+	ThumbUrl  string    `json:"thumbUrl"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type RoomAvatarDto struct {
+	MediaId string `json:"mediaId"`
 }
 
 type RoomCreateDto struct {
@@ -15,6 +31,9 @@ type RoomCreateDto struct {
 type UserDto struct {
 	Id   string `json:"id"`
 	Role string `json:"role"`
+	// Username and DisplayName are looked up in the user service and left out if it can not be reached.
+	Username    string `json:"username,omitempty"`
+	DisplayName string `json:"displayName,omitempty"`
 }
 
 type SeenMessage struct {
@@ -39,12 +39,77 @@ func ParseMediaType(s string) (MediaType, error) {
 	}
 }
 
+const (
+	VariantThumb   = "thumb"
+	VariantPreview = "preview"
+)
+
+// ImageVariants lists the resized variants media service generates for every image.
+var ImageVariants = []string{VariantThumb, VariantPreview}
+
+func IsValidVariant(s string) bool {
+	for _, variant := range ImageVariants {
+		if variant == s {
+			return true
+		}
+	}
+	return false
+}
+
 type MediaFile struct {
-	Id        string    `bson:"id" json:"id"`
-	RoomId    string    `bson:"roomId" json:"roomId"`
-	Type      MediaType `bson:"type" json:"type"`
-	BlobId    string    `bson:"blobId" json:"blobId"`
-	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
-	CreatedBy string    `bson:"createdBy" json:"createdBy"`
-	Size      int64     `bson:"size" json:"size"`
+	Id           string            `bson:"id" json:"id"`
+	RoomId       string            `bson:"roomId" json:"roomId"`
+	Type         MediaType         `bson:"type" json:"type"`
+	BlobId       string            `bson:"blobId" json:"blobId"`
+	CreatedAt    time.Time         `bson:"createdAt" json:"createdAt"`
+	CreatedBy    string            `bson:"createdBy" json:"createdBy"`
+	Size         int64             `bson:"size" json:"size"`
+	ContentType  string            `bson:"contentType,omitempty" json:"contentType,omitempty"`
+	Url          string            `bson:"-" json:"url,omitempty"`
+	UrlExpiresAt *time.Time        `bson:"-" json:"urlExpiresAt,omitempty"`
+	Variants     map[string]string `bson:"-" json:"variants,omitempty"`
+}
+
+// UploadSession tracks a resumable upload from its creation until it is finalized into a MediaFile.
+type UploadSession struct {
+	Id             string    `bson:"id" json:"uploadId"`
+	RoomId         string    `bson:"roomId" json:"roomId"`
+	Type           MediaType `bson:"type" json:"type"`
+	CreatedBy      string    `bson:"createdBy" json:"createdBy"`
+	Length         int64     `bson:"length" json:"length"`
+	Offset         int64     `bson:"-" json:"offset"`
+	RemoteUploadId string    `bson:"remoteUploadId" json:"-"`
+	CreatedAt      time.Time `bson:"createdAt" json:"createdAt"`
+	ExpiresAt      time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// MediaUsage reports how many bytes of media a user or room has stored and how many it may store.
+type MediaUsage struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+// MediaFilter selects the media files shared in a room, newest first.
+// Zero values leave the respective criterion unrestricted.
+type MediaFilter struct {
+	RoomId    string
+	Type      *MediaType
+	CreatedBy string
+	From      time.Time
+	To        time.Time
+	// After continues the listing after the given media file, as returned in the previous page.
+	After *MediaCursor
+	Limit int64
+}
+
+// MediaCursor marks the position of a media file in a listing ordered by creation time.
+type MediaCursor struct {
+	CreatedAt time.Time
+	Id        string
+}
+
+// MediaPage is one page of a media file listing.
+type MediaPage struct {
+	Items      []MediaFile `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
 }
@@ -13,6 +13,9 @@ const (
 	TypeTextMessage MessageType = iota
 	TypeSeenMessage
 	TypeDeleteMessage
+	TypeRoomUpdate
+	// TypeError tells the sender of a message that it was rejected.
+	TypeError
 )
 
 type Role int
@@ -28,25 +31,49 @@ type UserPermissions struct {
 }
 
 type ChatRoomEntity struct {
-	Id       string            `bson:"id" json:"id"`
-	Name     string            `json:"name"`
-	Messages []Message         `bson:"messages" json:"messages"`
-	Users    []UserPermissions `bson:"users" json:"users"`
+	Id         string            `bson:"id" json:"id"`
+	Name       string            `json:"name"`
+	Messages   []Message         `bson:"messages" json:"messages"`
+	Users      []UserPermissions `bson:"users" json:"users"`
+	MediaQuota int64             `bson:"mediaQuota,omitempty" json:"mediaQuota,omitempty"`
+	// Avatar is the image media file of the room shown as its avatar.
+	Avatar *MediaFile `bson:"avatar,omitempty" json:"avatar,omitempty"`
 }
 
 type Message struct {
-	Id            string         `bson:"id" json:"id"`
-	Content       string         `bson:"content" json:"content"`
-	EmbeddedMedia *EmbeddedMedia `bson:"embeddedMedia" json:"embeddedMedia"`
+	Id          string       `bson:"id" json:"id"`
+	Content     string       `bson:"content" json:"content"`
+	Attachments []Attachment `bson:"attachments,omitempty" json:"attachments,omitempty"`
+	// EmbeddedMedia is the media of messages sent before attachments were validated. It is still returned for
+	// those messages, but is no longer accepted from clients.
+	EmbeddedMedia *EmbeddedMedia `bson:"embeddedMedia,omitempty" json:"embeddedMedia,omitempty"`
 	ChatRoomId    string         `bson:"chatRoomId" json:"chatRoomId"`
 	SentBy        string         `bson:"sentBy" json:"sentBy"`
 	SentAt        time.Time      `bson:"sentAt" json:"sentAt"`
 	SeenBy        []string       `bson:"seenBy" json:"seenBy"`
 }
 
+// EmbeddedMedia is the legacy media of a message, a URL given by the client.
 type EmbeddedMedia struct {
 	ContentType string `bson:"contentType" json:"contentType"`
-	Url         string `bosn:"url" json:"url"`
+	Url         string `bson:"url" json:"url"`
+}
+
+// Attachment references a media file uploaded to the room of the message.
+// Clients only send the MediaId; the remaining fields are filled in from the media file by the server.
+type Attachment struct {
+	MediaId     string    `bson:"mediaId" json:"mediaId"`
+	Type        MediaType `bson:"type" json:"type"`
+	Size        int64     `bson:"size" json:"size"`
+	ContentType string    `bson:"contentType,omitempty" json:"contentType,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// ErrorMessage tells the sender of a message why it was rejected.
+type ErrorMessage struct {
+	Error string `json:"error"`
+	// Content is the content of the rejected message, so that the client can tell which message it was.
+	Content string `json:"content"`
 }
 
 type UserDetails struct {
@@ -65,6 +92,10 @@ func (mt MessageType) String() string {
 		return "SeenMessage"
 	case TypeDeleteMessage:
 		return "DeleteMessage"
+	case TypeRoomUpdate:
+		return "RoomUpdate"
+	case TypeError:
+		return "Error"
 	default:
 		return "Unknown"
 	}
@@ -78,6 +109,10 @@ func MessageTypeFromString(s string) (MessageType, error) {
 		return TypeSeenMessage, nil
 	case "DeleteMessage":
 		return TypeDeleteMessage, nil
+	case "RoomUpdate":
+		return TypeRoomUpdate, nil
+	case "Error":
+		return TypeError, nil
 	default:
 		return -1, fmt.Errorf("unknown message type: %s", s)
 	}
@@ -100,6 +135,10 @@ func (mt *MessageType) UnmarshalJSON(data []byte) error {
 		*mt = TypeSeenMessage
 	case "DeleteMessage":
 		*mt = TypeDeleteMessage
+	case "RoomUpdate":
+		*mt = TypeRoomUpdate
+	case "Error":
+		*mt = TypeError
 	default:
 		return errors.New("invalid MessageType")
 	}
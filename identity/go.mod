@@ -0,0 +1,3 @@
+module example.com/chat_app/identity
+
+go 1.22.2
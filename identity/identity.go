@@ -0,0 +1,231 @@
+// Package identity propagates the identity of the caller from the api gateway to the services, and between
+// services. The gateway authenticates the user and forwards a short-lived HMAC signed assertion of who made the
+// request, and the services only trust the X-User-Id header after verifying that assertion in Middleware.
+package identity
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// AssertionHeader is the header carrying the signed identity assertion.
+	AssertionHeader = "X-Identity-Assertion"
+	// UserIdHeader is the header the services read the ID of the authenticated user from.
+	UserIdHeader = "X-User-Id"
+	// assertionTTL is the time an assertion is accepted after it was issued.
+	assertionTTL = 30 * time.Second
+	// maxBodyLength is the largest request body an assertion is issued for. Bodies are hashed in memory, and the
+	// largest ones are upload chunks of at most 32 MiB.
+	maxBodyLength = 64 << 20
+)
+
+var (
+	// ErrMissingAssertion is returned when a request carries no identity assertion.
+	ErrMissingAssertion = errors.New("identity assertion missing")
+	// ErrInvalidAssertion is returned when an assertion is malformed, has a bad signature, has expired or was
+	// issued for a different request.
+	ErrInvalidAssertion = errors.New("invalid identity assertion")
+	// ErrBodyTooLarge is returned when an assertion is to be issued for a request body over the maximum length.
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+// Assertion states who made a request. It is bound to the method, path, query and body of the request, so that it
+// can not be replayed against another endpoint or with other parameters or content.
+type Assertion struct {
+	// Issuer is the name of the component that issued the assertion.
+	Issuer string `json:"iss"`
+	// UserId is the ID of the authenticated user, or empty if the request is not made on behalf of a user.
+	UserId string `json:"sub,omitempty"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	// BodyHash is the base64url encoded SHA-256 of the request body, or empty if the request has no body.
+	BodyHash  string `json:"bodyHash,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// Signer issues and verifies identity assertions with keys shared by the gateway and the services.
+type Signer struct {
+	issuer    string
+	activeKid string
+	secrets   map[string][]byte
+}
+
+// NewSigner creates a new Signer that issues assertions in the name of the issuer.
+// The keys are read from the IDENTITY_ASSERTION_KEYS environment variable, a comma separated list of
+// "keyId:base64Secret" pairs. Assertions are signed with the first key and verified with any of them, so keys
+// can be rotated by prepending a new one everywhere and dropping the old one afterwards.
+func NewSigner(issuer string) (*Signer, error) {
+	secrets, activeKid, err := ParseKeys("IDENTITY_ASSERTION_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		issuer:    issuer,
+		activeKid: activeKid,
+		secrets:   secrets,
+	}, nil
+}
+
+// Sign sets the assertion header of the outgoing request. The request is asserted to be made by the user in its
+// X-User-Id header, which the caller must have authenticated, or by no user if the header is empty.
+// The assertion has the form "keyId.payload.signature", with the payload and signature base64url encoded.
+// The body is read to be hashed and replaced with a copy; bodies over 64 MiB are rejected with ErrBodyTooLarge.
+func (s *Signer) Sign(r *http.Request) error {
+	body, err := bufferBody(r, maxBodyLength)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	payload, err := json.Marshal(Assertion{
+		Issuer:    s.issuer,
+		UserId:    r.Header.Get(UserIdHeader),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Query:     r.URL.RawQuery,
+		BodyHash:  hashBody(body),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(assertionTTL).Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode identity assertion: %v", err)
+	}
+	signed := s.activeKid + "." + base64.RawURLEncoding.EncodeToString(payload)
+	r.Header.Set(AssertionHeader, signed+"."+SignValue(s.secrets[s.activeKid], signed))
+	return nil
+}
+
+// Verify verifies the assertion header of the incoming request and returns the assertion.
+func (s *Signer) Verify(r *http.Request) (*Assertion, error) {
+	assertionString := r.Header.Get(AssertionHeader)
+	if assertionString == "" {
+		return nil, ErrMissingAssertion
+	}
+	kid, rest, _ := strings.Cut(assertionString, ".")
+	encodedPayload, signature, ok := strings.Cut(rest, ".")
+	secret, known := s.secrets[kid]
+	if !ok || !known {
+		return nil, ErrInvalidAssertion
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignValue(secret, kid+"."+encodedPayload))) {
+		return nil, ErrInvalidAssertion
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, ErrInvalidAssertion
+	}
+	var assertion Assertion
+	if err := json.Unmarshal(payload, &assertion); err != nil {
+		return nil, ErrInvalidAssertion
+	}
+
+	now := time.Now()
+	if !time.Unix(assertion.ExpiresAt, 0).After(now) || time.Unix(assertion.IssuedAt, 0).After(now.Add(assertionTTL)) {
+		return nil, ErrInvalidAssertion
+	}
+	if assertion.Method != r.Method || assertion.Path != r.URL.Path || assertion.Query != r.URL.RawQuery {
+		return nil, ErrInvalidAssertion
+	}
+	body, err := bufferBody(r, maxBodyLength)
+	if err != nil {
+		return nil, ErrInvalidAssertion
+	}
+	if !hmac.Equal([]byte(assertion.BodyHash), []byte(hashBody(body))) {
+		return nil, ErrInvalidAssertion
+	}
+	return &assertion, nil
+}
+
+// bufferBody reads the body of the request, failing with ErrBodyTooLarge if it is longer than limit, and
+// replaces it with a copy so that it can be read again.
+func bufferBody(r *http.Request, limit int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// hashBody returns the base64url encoded SHA-256 of the body, or an empty string if the body is empty.
+func hashBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	hash := sha256.Sum256(body)
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Transport returns an http.RoundTripper that signs every request before sending it with the base RoundTripper,
+// or http.DefaultTransport if base is nil. It is used by clients calling other services.
+func (s *Signer) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// A RoundTripper must not modify the request it was given.
+		r = r.Clone(r.Context())
+		if err := s.Sign(r); err != nil {
+			return nil, err
+		}
+		return base.RoundTrip(r)
+	})
+}
+
+// Middleware rejects requests without a valid identity assertion with 401 Unauthorized.
+// For the others, it replaces the X-User-Id header with the user ID from the assertion, so that handlers can
+// keep reading it from there.
+func Middleware(s *Signer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertion, err := s.Verify(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		r.Header.Del(AssertionHeader)
+		if assertion.UserId == "" {
+			r.Header.Del(UserIdHeader)
+		} else {
+			r.Header.Set(UserIdHeader, assertion.UserId)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// roundTripperFunc adapts a function to the http.RoundTripper interface.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// SignValue returns the base64url encoded HMAC-SHA256 of the value.
+func SignValue(secret []byte, value string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,155 @@
+package identity
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultMediaUrlTTL is the lifetime of signed media URLs used when MEDIA_URL_TTL_SECONDS is not set.
+const defaultMediaUrlTTL = 5 * time.Minute
+
+var (
+	// ErrInvalidSignature is returned when a signed media URL was tampered with or signed with an unknown key.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrUrlExpired is returned when a signed media URL is past its expiry time.
+	ErrUrlExpired = errors.New("url expired")
+)
+
+// SignedUrlParams holds the parameters of a signed media URL.
+type SignedUrlParams struct {
+	MediaType string
+	BlobId    string
+	Variant   string
+	UserId    string
+	Expiry    string
+	KeyId     string
+	Signature string
+}
+
+// UrlSigner issues and verifies short-lived HMAC signed download URLs for media blobs.
+// Chat service and user service sign the URLs and media service verifies them, so browsers can load media
+// without an Authorization header.
+type UrlSigner struct {
+	baseUrl   string
+	activeKid string
+	secrets   map[string][]byte
+	ttl       time.Duration
+}
+
+// NewUrlSigner creates a new UrlSigner.
+// The keys are read from the MEDIA_URL_SIGNING_KEYS environment variable, a comma separated list of
+// "keyId:base64Secret" pairs. URLs are signed with the first key and verified with any of them, so that URLs
+// signed before a key rotation stay valid until they expire. The URL lifetime is read from MEDIA_URL_TTL_SECONDS
+// and the public base URL of the signed download endpoint from MEDIA_PUBLIC_URL.
+func NewUrlSigner() (*UrlSigner, error) {
+	secrets, activeKid, err := ParseKeys("MEDIA_URL_SIGNING_KEYS")
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := defaultMediaUrlTTL
+	if ttlString := os.Getenv("MEDIA_URL_TTL_SECONDS"); ttlString != "" {
+		seconds, err := strconv.Atoi(ttlString)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid MEDIA_URL_TTL_SECONDS: %q", ttlString)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	baseUrl := os.Getenv("MEDIA_PUBLIC_URL")
+	if baseUrl == "" {
+		baseUrl = "/files"
+	}
+
+	return &UrlSigner{
+		baseUrl:   strings.TrimSuffix(baseUrl, "/"),
+		activeKid: activeKid,
+		secrets:   secrets,
+		ttl:       ttl,
+	}, nil
+}
+
+// SignMediaUrl returns a download URL for the blob, or its variant if one is given, that is only valid
+// for the given user until the returned expiry time.
+func (s *UrlSigner) SignMediaUrl(mediaType, blobId, variant, userId string) (string, time.Time) {
+	expiresAt := time.Now().Add(s.ttl).Truncate(time.Second)
+	params := SignedUrlParams{
+		MediaType: mediaType,
+		BlobId:    blobId,
+		Variant:   variant,
+		UserId:    userId,
+		Expiry:    strconv.FormatInt(expiresAt.Unix(), 10),
+		KeyId:     s.activeKid,
+	}
+	params.Signature = SignValue(s.secrets[s.activeKid], params.payload())
+
+	query := url.Values{}
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+	query.Set("uid", params.UserId)
+	query.Set("exp", params.Expiry)
+	query.Set("kid", params.KeyId)
+	query.Set("sig", params.Signature)
+
+	return fmt.Sprintf("%s/%s/%s?%s", s.baseUrl, url.PathEscape(mediaType), url.PathEscape(blobId), query.Encode()), expiresAt
+}
+
+// VerifyMediaUrl checks that the signature of the URL parameters is valid and that the URL has not expired.
+func (s *UrlSigner) VerifyMediaUrl(params SignedUrlParams) error {
+	secret, ok := s.secrets[params.KeyId]
+	if !ok {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(params.Signature), []byte(SignValue(secret, params.payload()))) {
+		return ErrInvalidSignature
+	}
+
+	expiry, err := strconv.ParseInt(params.Expiry, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if time.Now().After(time.Unix(expiry, 0)) {
+		return ErrUrlExpired
+	}
+	return nil
+}
+
+// payload returns the string covered by the signature of the URL.
+func (p SignedUrlParams) payload() string {
+	return strings.Join([]string{p.MediaType, p.BlobId, p.Variant, p.UserId, p.Expiry}, "\n")
+}
+
+// ParseKeys parses the environment variable as a comma separated list of "keyId:base64Secret" pairs.
+// It returns the secrets by their key ID and the ID of the first key, which signs new values.
+func ParseKeys(variable string) (map[string][]byte, string, error) {
+	keysString := os.Getenv(variable)
+	if keysString == "" {
+		return nil, "", fmt.Errorf("%s environment variable not set", variable)
+	}
+
+	secrets := make(map[string][]byte)
+	activeKid := ""
+	for _, pair := range strings.Split(keysString, ",") {
+		kid, encodedSecret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || kid == "" {
+			return nil, "", fmt.Errorf("invalid %s entry %q, expected keyId:base64Secret", variable, pair)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encodedSecret)
+		if err != nil || len(secret) < 32 {
+			return nil, "", fmt.Errorf("key %q of %s must be a base64 encoded secret of at least 32 bytes", kid, variable)
+		}
+		if activeKid == "" {
+			activeKid = kid
+		}
+		secrets[kid] = secret
+	}
+	return secrets, activeKid, nil
+}
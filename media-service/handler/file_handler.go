@@ -1,23 +1,34 @@
 package handler
 
 import (
+	"bytes"
+	"example.com/chat_app/identity"
+	"fmt"
 	"io"
 	"media_service/service"
+	"media_service/structs"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // FileHandler handles file upload and download requests.
 type FileHandler struct {
-	service *service.AzureBlobStorageService
+	service *service.MediaService
+	signer  *identity.UrlSigner
 }
 
-// NewFileHandler creates a new FileHandler with the provided AzureBlobStorageService.
-func NewFileHandler(s *service.AzureBlobStorageService) *FileHandler {
-	return &FileHandler{service: s}
+// NewFileHandler creates a new FileHandler with the provided MediaService and UrlSigner.
+func NewFileHandler(s *service.MediaService, signer *identity.UrlSigner) *FileHandler {
+	return &FileHandler{service: s, signer: signer}
 }
 
 // HandleMediaUpload handles file upload requests.
-// It reads the file from the request body and uploads it to the specified media type container.
+// It reads the file from the request body, uploads it to the specified media type container and returns
+// the metadata of the stored blob.
+// Images that are not in a supported format are rejected with a 415 Unsupported Media Type error and
+// images exceeding the allowed pixel count with a 413 Request Entity Too Large error.
+// Content that was already found to contain malware is rejected with a 422 Unprocessable Entity error.
 func (h *FileHandler) HandleMediaUpload(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	mediaType := r.PathValue("mediaType")
@@ -28,19 +39,25 @@ func (h *FileHandler) HandleMediaUpload(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	blobId, err := h.service.UploadFile(ctx, mediaType, fileBytes)
+	blob, err := h.service.UploadMedia(ctx, mediaType, bytes.NewReader(fileBytes))
 	if err != nil {
-		http.Error(w, "Unable to upload file to storage", http.StatusInternalServerError)
+		switch err {
+		case service.ErrUnsupportedImage:
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case service.ErrImageTooLarge, service.ErrImageFileTooLarge:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case service.ErrMediaInfected:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case service.ErrContentPending:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "Unable to upload file to storage", http.StatusInternalServerError)
+		}
 		return
 	}
 
-	response := struct {
-		BlobId string `json:"blobId"`
-	}{
-		BlobId: blobId,
-	}
-
-	if err := writeJsonResponse(w, response, http.StatusCreated); err != nil {
+	if err := writeJsonResponse(w, blob, http.StatusCreated); err != nil {
 		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
 		return
 	}
@@ -48,17 +65,176 @@ func (h *FileHandler) HandleMediaUpload(w http.ResponseWriter, r *http.Request)
 
 // HandleMediaDownload handles file download requests.
 // It retrieves the file from the specified media type container and writes it to the response.
+// The optional "variant" query parameter selects a resized variant of an image instead of the original.
+// Variants are generated asynchronously after upload, so a 404 Not Found is returned until they are ready.
+// Files are only served once they were scanned for malware: until then a 423 Locked error is returned and
+// for infected files a 403 Forbidden error.
 func (h *FileHandler) HandleMediaDownload(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	mediaType := r.PathValue("mediaType")
 	blobId := r.PathValue("blobId")
+	variant := r.URL.Query().Get("variant")
 
-	fileBytes, err := h.service.DownloadFile(ctx, mediaType, blobId)
+	fileBytes, err := h.service.DownloadMedia(ctx, mediaType, blobId, variant)
 	if err != nil {
-		http.Error(w, "Unable to download file from storage", http.StatusInternalServerError)
+		switch err {
+		case service.ErrUnknownVariant:
+			http.Error(w, "Unknown variant", http.StatusBadRequest)
+		case service.ErrBlobNotFound:
+			http.Error(w, "File not found", http.StatusNotFound)
+		case service.ErrScanPending:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "File is being scanned for malware", http.StatusLocked)
+		case service.ErrMediaInfected:
+			http.Error(w, "File was quarantined because it contains malware", http.StatusForbidden)
+		default:
+			http.Error(w, "Unable to download file from storage", http.StatusInternalServerError)
+		}
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.Write(fileBytes)
 }
+
+// HandleMediaMetadata returns the metadata of a blob as JSON: its size, content type, checksum, creation time
+// and scan status.
+func (h *FileHandler) HandleMediaMetadata(w http.ResponseWriter, r *http.Request) {
+	blob, ok := h.getMediaMetadata(w, r)
+	if !ok {
+		return
+	}
+	if err := writeJsonResponse(w, blob, http.StatusOK); err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleMediaHead returns the metadata of a blob in the response headers, without its content.
+// The scan status is returned in the X-Scan-Status header.
+func (h *FileHandler) HandleMediaHead(w http.ResponseWriter, r *http.Request) {
+	blob, ok := h.getMediaMetadata(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", blob.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(blob.Size, 10))
+	w.Header().Set("ETag", strconv.Quote(blob.Checksum))
+	w.Header().Set("Last-Modified", blob.CreatedAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("X-Scan-Status", string(blob.ScanStatus))
+	w.WriteHeader(http.StatusOK)
+}
+
+// getMediaMetadata retrieves the metadata of the blob in the request path.
+// If it fails, it writes the error response and returns false.
+func (h *FileHandler) getMediaMetadata(w http.ResponseWriter, r *http.Request) (*structs.BlobEntity, bool) {
+	ctx := r.Context()
+	mediaType := r.PathValue("mediaType")
+	blobId := r.PathValue("blobId")
+
+	blob, err := h.service.GetMediaMetadata(ctx, mediaType, blobId)
+	if err != nil {
+		if err == service.ErrBlobNotFound {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return nil, false
+		}
+		http.Error(w, "Unable to retrieve file metadata", http.StatusInternalServerError)
+		return nil, false
+	}
+	return blob, true
+}
+
+// HandleMediaDelete handles file deletion requests.
+// It removes one reference from the blob; the blob is deleted from storage once it is no longer referenced.
+// If the "purge" query parameter is set to true, the blob is deleted regardless of its references.
+func (h *FileHandler) HandleMediaDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mediaType := r.PathValue("mediaType")
+	blobId := r.PathValue("blobId")
+
+	var err error
+	if r.URL.Query().Get("purge") == "true" {
+		err = h.service.PurgeMedia(ctx, mediaType, blobId)
+	} else {
+		err = h.service.ReleaseMedia(ctx, mediaType, blobId)
+	}
+	if err != nil {
+		http.Error(w, "Unable to delete file from storage", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMediaList lists the blobs stored in the specified media type container.
+func (h *FileHandler) HandleMediaList(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	mediaType := r.PathValue("mediaType")
+
+	files, err := h.service.ListMedia(ctx, mediaType)
+	if err != nil {
+		http.Error(w, "Unable to list files in storage", http.StatusInternalServerError)
+		return
+	}
+
+	if err := writeJsonResponse(w, files, http.StatusOK); err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleSignedMediaDownload handles downloads through signed URLs issued by chat service.
+// It does not require any authentication besides the signature in the query parameters, so that the URL
+// can be used directly in <img> and <video> tags.
+// If the signature is invalid it returns a 403 Forbidden error and if the URL has expired a 410 Gone error.
+func (h *FileHandler) HandleSignedMediaDownload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	params := identity.SignedUrlParams{
+		MediaType: r.PathValue("mediaType"),
+		BlobId:    r.PathValue("blobId"),
+		Variant:   query.Get("variant"),
+		UserId:    query.Get("uid"),
+		Expiry:    query.Get("exp"),
+		KeyId:     query.Get("kid"),
+		Signature: query.Get("sig"),
+	}
+
+	if err := h.signer.VerifyMediaUrl(params); err != nil {
+		switch err {
+		case identity.ErrUrlExpired:
+			http.Error(w, "Link expired", http.StatusGone)
+		default:
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+		}
+		return
+	}
+
+	fileBytes, err := h.service.DownloadMedia(ctx, params.MediaType, params.BlobId, params.Variant)
+	if err != nil {
+		switch err {
+		case service.ErrUnknownVariant:
+			http.Error(w, "Unknown variant", http.StatusBadRequest)
+		case service.ErrBlobNotFound:
+			http.Error(w, "File not found", http.StatusNotFound)
+		case service.ErrScanPending:
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "File is being scanned for malware", http.StatusLocked)
+		case service.ErrMediaInfected:
+			http.Error(w, "File was quarantined because it contains malware", http.StatusForbidden)
+		default:
+			http.Error(w, "Unable to download file from storage", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// The response may be cached by the browser, but not beyond the lifetime of the URL.
+	expiry, _ := strconv.ParseInt(params.Expiry, 10, 64)
+	maxAge := max(0, int(time.Until(time.Unix(expiry, 0)).Seconds()))
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("Content-Type", http.DetectContentType(fileBytes))
+	// Uploaded files are served from the API origin, so never let the browser run them as a document.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Write(fileBytes)
+}
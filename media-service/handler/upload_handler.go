@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"media_service/service"
+	"net/http"
+	"strconv"
+)
+
+// UploadHandler handles resumable upload requests.
+// The protocol follows a simple offset based design: the total length is announced on creation, every chunk
+// carries the offset it starts at in the Upload-Offset header and the current offset can be queried at any time.
+type UploadHandler struct {
+	service *service.UploadService
+}
+
+// NewUploadHandler creates a new UploadHandler with the provided UploadService.
+func NewUploadHandler(s *service.UploadService) *UploadHandler {
+	return &UploadHandler{service: s}
+}
+
+// HandleCreateUpload starts a resumable upload to the specified media type container.
+// The total length of the upload is read from the Upload-Length header.
+func (h *UploadHandler) HandleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	mediaType := r.PathValue("mediaType")
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Length header", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.service.CreateUpload(mediaType, length)
+	if err != nil {
+		if err == service.ErrUploadTooLarge {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	if err := writeJsonResponse(w, session, http.StatusCreated); err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleGetUploadOffset returns the current offset and total length of an upload in the
+// Upload-Offset and Upload-Length headers.
+func (h *UploadHandler) HandleGetUploadOffset(w http.ResponseWriter, r *http.Request) {
+	uploadId := r.PathValue("uploadId")
+
+	session, err := h.service.GetUpload(uploadId)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleAppendChunk appends the request body to an upload.
+// The chunk must start at the offset given in the Upload-Offset header, which has to match the current
+// offset of the upload, otherwise a 409 Conflict error is returned.
+// The new offset is returned in the Upload-Offset header.
+func (h *UploadHandler) HandleAppendChunk(w http.ResponseWriter, r *http.Request) {
+	uploadId := r.PathValue("uploadId")
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	newOffset, err := h.service.AppendChunk(uploadId, offset, r.Body)
+	if err != nil {
+		if err == service.ErrUploadOffsetMismatch {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		}
+		writeUploadError(w, err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleFinalizeUpload stores a completely received upload and returns the metadata of the new blob.
+func (h *UploadHandler) HandleFinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	uploadId := r.PathValue("uploadId")
+
+	blob, err := h.service.FinalizeUpload(ctx, uploadId)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	if err := writeJsonResponse(w, blob, http.StatusCreated); err != nil {
+		http.Error(w, "Unable to encode response", http.StatusInternalServerError)
+		return
+	}
+}
+
+// writeUploadError maps errors of the upload service to HTTP error responses.
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case service.ErrUploadNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case service.ErrUploadOffsetMismatch, service.ErrUploadIncomplete:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case service.ErrUploadTooLarge, service.ErrImageTooLarge, service.ErrImageFileTooLarge:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case service.ErrUnsupportedImage:
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+	case service.ErrMediaInfected:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	case service.ErrContentPending:
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Unable to process upload", http.StatusInternalServerError)
+	}
+}
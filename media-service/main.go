@@ -5,10 +5,13 @@ import (
 	"fmt"
 	"log"
 	"media_service/handler"
+	"media_service/repository"
 	"media_service/service"
 	"net/http"
 	"os"
+	"time"
 
+	"example.com/chat_app/identity"
 	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -30,29 +33,82 @@ func main() {
 		log.Fatal(err)
 	}
 
-	storageService, err := service.NewAzureBlobStorageService()
+	azureStorage, err := service.NewAzureBlobStorageService()
 	if err != nil {
 		log.Fatal(err)
 	}
+	blobRepo := repository.NewMongoBlobRepository(client, "mediadb", "blobs")
+	if err := blobRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+
+	storageService, err := service.NewEncryptedBlobStorage(azureStorage, blobRepo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := blobRepo.MigratePlaintextFlags(context.TODO(), storageService.HasDataKey); err != nil {
+		log.Fatal(err)
+	}
+	// Keys are re-wrapped before serving requests, so that uploads do not store keys concurrently.
+	if err := storageService.RewrapKeys(context.TODO()); err != nil {
+		log.Printf("Failed re-wrapping data keys: %v", err)
+	}
+
+	imageService, err := service.NewImageService(storageService)
+	if err != nil {
+		log.Fatal(err)
+	}
+	scanner, err := service.NewScanner()
+	if err != nil {
+		log.Fatal(err)
+	}
+	mediaService := service.NewMediaService(storageService, blobRepo, imageService, scanner)
+	mediaService.StartRescan(context.Background(), 5*time.Minute)
+
+	uploadService, err := service.NewUploadService(mediaService)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uploadService.StartCleanup(context.Background(), 10*time.Minute)
+
+	urlSigner, err := identity.NewUrlSigner()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fileHandler := handler.NewFileHandler(mediaService, urlSigner)
+	uploadHandler := handler.NewUploadHandler(uploadService)
 
-	fileHandler := handler.NewFileHandler(storageService)
+	router := initializeRoutes(fileHandler, uploadHandler)
 
-	router := initializeRoutes(*fileHandler)
+	identitySigner, err := identity.NewSigner("media-service")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	port := os.Getenv("PORT")
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%s", port),
-		Handler: router,
+		Handler: identity.Middleware(identitySigner, router),
 	}
 
 	log.Printf("Media Service listening on port %s...", port)
 	log.Fatal(server.ListenAndServe())
 }
 
-func initializeRoutes(fh handler.FileHandler) *http.ServeMux {
+func initializeRoutes(fh *handler.FileHandler, uh *handler.UploadHandler) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.Handle("GET /{mediaType}/{blobId}", http.HandlerFunc(fh.HandleMediaDownload))
+	mux.Handle("HEAD /{mediaType}/{blobId}", http.HandlerFunc(fh.HandleMediaHead))
+	mux.Handle("GET /metadata/{mediaType}/{blobId}", http.HandlerFunc(fh.HandleMediaMetadata))
+	mux.Handle("GET /signed/{mediaType}/{blobId}", http.HandlerFunc(fh.HandleSignedMediaDownload))
 	mux.Handle("POST /{mediaType}", http.HandlerFunc(fh.HandleMediaUpload))
+	mux.Handle("DELETE /{mediaType}/{blobId}", http.HandlerFunc(fh.HandleMediaDelete))
+	mux.Handle("GET /{mediaType}", http.HandlerFunc(fh.HandleMediaList))
+	mux.Handle("POST /uploads/{mediaType}", http.HandlerFunc(uh.HandleCreateUpload))
+	mux.Handle("HEAD /uploads/{uploadId}", http.HandlerFunc(uh.HandleGetUploadOffset))
+	mux.Handle("PATCH /uploads/{uploadId}", http.HandlerFunc(uh.HandleAppendChunk))
+	mux.Handle("POST /uploads/{uploadId}/finalize", http.HandlerFunc(uh.HandleFinalizeUpload))
 	return mux
 }
@@ -0,0 +1,254 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"media_service/structs"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoBlobRepository provides methods to interact with the blob collection in MongoDB.
+type MongoBlobRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoBlobRepository creates a new instance of MongoBlobRepository.
+// It takes a MongoDB client, database name, and collection name as parameters.
+func NewMongoBlobRepository(client *mongo.Client, dbName, collection string) *MongoBlobRepository {
+	return &MongoBlobRepository{
+		collection: client.Database(dbName).Collection(collection),
+	}
+}
+
+// EnsureIndexes creates a unique index on the container and blob ID, so that concurrent uploads of the
+// same content always update a single reference counter.
+func (repo *MongoBlobRepository) EnsureIndexes(ctx context.Context) error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{{Key: "container", Value: 1}, {Key: "blobId", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := repo.collection.Indexes().CreateOne(ctx, index); err != nil {
+		return fmt.Errorf("error creating blob index: %w", err)
+	}
+	return nil
+}
+
+// AcquireBlob adds a reference to a blob, creating its record with the metadata, store status and store token
+// of the given blob if it does not exist yet. It returns the record after the update; if it carries the store
+// token of the given blob, the record was created and the content still has to be stored. Records that are being
+// deleted are not acquired; the upsert then fails with a duplicate key error on the unique index.
+func (repo *MongoBlobRepository) AcquireBlob(ctx context.Context, blob *structs.BlobEntity) (*structs.BlobEntity, error) {
+	now := time.Now()
+	filter := bson.M{"container": blob.Container, "blobId": blob.BlobId, "deleting": bson.M{"$ne": true}}
+	update := bson.M{
+		"$inc": bson.M{"refCount": 1},
+		"$setOnInsert": bson.M{
+			"createdAt":   now,
+			"size":        blob.Size,
+			"contentType": blob.ContentType,
+			"checksum":    blob.Checksum,
+			"scanStatus":  structs.ScanPending,
+			"plaintext":   blob.Plaintext,
+			"storeStatus": blob.StoreStatus,
+			"storeToken":  blob.StoreToken,
+			"storingAt":   now,
+		},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var acquired structs.BlobEntity
+	if err := repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&acquired); err != nil {
+		return nil, fmt.Errorf("error acquiring blob: %w", err)
+	}
+	return &acquired, nil
+}
+
+// ClaimBlobUpload makes the upload with the token the one storing the content of a blob whose upload failed, or
+// whose upload started before staleBefore and was presumably abandoned. It reports whether the blob was claimed.
+func (repo *MongoBlobRepository) ClaimBlobUpload(ctx context.Context, container, blobId, token string, staleBefore time.Time) (bool, error) {
+	filter := bson.M{
+		"container": container,
+		"blobId":    blobId,
+		"deleting":  bson.M{"$ne": true},
+		"$or": bson.A{
+			bson.M{"storeStatus": structs.StoreFailed},
+			bson.M{"storeStatus": structs.StoreStoring, "storingAt": bson.M{"$lt": staleBefore}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"storeStatus": structs.StoreStoring, "storeToken": token, "storingAt": time.Now()}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("error claiming blob upload: %w", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// FinishBlobUpload records whether the content of a blob was stored, provided the upload with the token is still
+// the one storing it. It reports whether the status was recorded.
+func (repo *MongoBlobRepository) FinishBlobUpload(ctx context.Context, container, blobId, token string, status structs.StoreStatus) (bool, error) {
+	filter := bson.M{"container": container, "blobId": blobId, "storeStatus": structs.StoreStoring, "storeToken": token}
+	update := bson.M{"$set": bson.M{"storeStatus": status}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("error finishing blob upload: %w", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// ReleaseBlob removes a reference from a blob and returns the reference count after the update.
+// It returns mongo.ErrNoDocuments if the blob has no record or no references left.
+func (repo *MongoBlobRepository) ReleaseBlob(ctx context.Context, container, blobId string) (int64, error) {
+	filter := bson.M{"container": container, "blobId": blobId, "refCount": bson.M{"$gt": 0}}
+	update := bson.M{"$inc": bson.M{"refCount": -1}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var blob structs.BlobEntity
+	if err := repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&blob); err != nil {
+		return 0, err
+	}
+	return blob.RefCount, nil
+}
+
+// MarkBlobDeleting marks a blob that is no longer referenced as being deleted, so that it can not be acquired
+// again while its content is deleted. It reports whether the blob was marked; it is not if the blob was acquired
+// again or is already being deleted.
+func (repo *MongoBlobRepository) MarkBlobDeleting(ctx context.Context, container, blobId string) (bool, error) {
+	filter := bson.M{
+		"container": container,
+		"blobId":    blobId,
+		"refCount":  bson.M{"$lte": 0},
+		"deleting":  bson.M{"$ne": true},
+	}
+	update := bson.M{"$set": bson.M{"deleting": true}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("error marking blob as deleting: %w", err)
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+// DeleteBlob removes the record of a blob, provided it is no longer referenced.
+// It reports whether the record was deleted.
+func (repo *MongoBlobRepository) DeleteBlob(ctx context.Context, container, blobId string) (bool, error) {
+	filter := bson.M{"container": container, "blobId": blobId, "refCount": bson.M{"$lte": 0}}
+	result, err := repo.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("error deleting blob: %w", err)
+	}
+	return result.DeletedCount > 0, nil
+}
+
+// PurgeBlob removes the record of a blob regardless of its references.
+func (repo *MongoBlobRepository) PurgeBlob(ctx context.Context, container, blobId string) error {
+	filter := bson.M{"container": container, "blobId": blobId}
+	_, err := repo.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("error purging blob: %w", err)
+	}
+	return nil
+}
+
+// GetBlob retrieves the record of a blob from the MongoDB collection.
+func (repo *MongoBlobRepository) GetBlob(ctx context.Context, container, blobId string) (*structs.BlobEntity, error) {
+	var blob structs.BlobEntity
+	filter := bson.M{"container": container, "blobId": blobId}
+	if err := repo.collection.FindOne(ctx, filter).Decode(&blob); err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// SetScanStatus records the result of the malware scan of a blob.
+func (repo *MongoBlobRepository) SetScanStatus(ctx context.Context, container, blobId string, status structs.ScanStatus, signature string) error {
+	filter := bson.M{"container": container, "blobId": blobId}
+	update := bson.M{
+		"$set": bson.M{"scanStatus": status, "signature": signature, "scannedAt": time.Now()},
+	}
+	if _, err := repo.collection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("error setting scan status: %w", err)
+	}
+	return nil
+}
+
+// SetBlobMetadata records the size, content type and checksum of a blob.
+func (repo *MongoBlobRepository) SetBlobMetadata(ctx context.Context, container, blobId string, size int64, contentType, checksum string) error {
+	filter := bson.M{"container": container, "blobId": blobId}
+	update := bson.M{
+		"$set": bson.M{"size": size, "contentType": contentType, "checksum": checksum},
+	}
+	if _, err := repo.collection.UpdateOne(ctx, filter, update); err != nil {
+		return fmt.Errorf("error setting blob metadata: %w", err)
+	}
+	return nil
+}
+
+// GetUnscannedBlobs retrieves the records of blobs created before the given time that have not been scanned yet.
+// Blobs whose content is not stored are left out.
+func (repo *MongoBlobRepository) GetUnscannedBlobs(ctx context.Context, before time.Time) ([]structs.BlobEntity, error) {
+	filter := bson.M{
+		"createdAt":   bson.M{"$lt": before},
+		"storeStatus": bson.M{"$nin": bson.A{structs.StoreStoring, structs.StoreFailed}},
+		"$or": bson.A{
+			bson.M{"scanStatus": structs.ScanPending},
+			bson.M{"scanStatus": bson.M{"$exists": false}},
+		},
+	}
+	cursor, err := repo.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var blobs []structs.BlobEntity
+	if err := cursor.All(ctx, &blobs); err != nil {
+		return nil, err
+	}
+	return blobs, nil
+}
+
+// IsPlaintext reports whether a blob was stored before encryption was enabled. Image variants and originals are
+// stored next to their blob and share its record. Blobs without a record predate the records and are plaintext.
+func (repo *MongoBlobRepository) IsPlaintext(ctx context.Context, container, blobId string) (bool, error) {
+	blobId, _, _ = strings.Cut(blobId, "_")
+	blob, err := repo.GetBlob(ctx, container, blobId)
+	if err == mongo.ErrNoDocuments {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return blob.Plaintext, nil
+}
+
+// MigratePlaintextFlags records for the blobs stored before the plaintext flag was introduced whether they were
+// stored before encryption was enabled, which is the case if they have no data key. Blobs stored since then
+// always have the flag.
+func (repo *MongoBlobRepository) MigratePlaintextFlags(ctx context.Context, hasDataKey func(ctx context.Context, container, blobId string) (bool, error)) error {
+	cursor, err := repo.collection.Find(ctx, bson.M{"plaintext": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var blobs []structs.BlobEntity
+	if err := cursor.All(ctx, &blobs); err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		encrypted, err := hasDataKey(ctx, blob.Container, blob.BlobId)
+		if err != nil {
+			return fmt.Errorf("error checking data key of blob %s: %w", blob.BlobId, err)
+		}
+		filter := bson.M{"container": blob.Container, "blobId": blob.BlobId}
+		update := bson.M{"$set": bson.M{"plaintext": !encrypted}}
+		if _, err := repo.collection.UpdateOne(ctx, filter, update); err != nil {
+			return fmt.Errorf("error setting plaintext flag: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,474 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// KeyContainer holds the wrapped data keys of encrypted blobs.
+// Every blob has a key blob named "{container}/{blobId}" in it.
+const KeyContainer = "blobkeys"
+
+const (
+	// formatSealed is the format of blobs sealed as a whole, which were stored before blobs were streamed.
+	formatSealed = ""
+	// formatStream is the format of blobs encrypted in chunks of streamChunkSize bytes.
+	formatStream = "stream"
+	// streamChunkSize is the size of the plaintext chunks of blobs in formatStream.
+	streamChunkSize = 64 << 10
+	// streamPrefixSize is the size of the random nonce prefix a blob in formatStream starts with.
+	streamPrefixSize = 7
+)
+
+var (
+	// ErrUnknownMasterKey is returned when a data key was wrapped with a master key that is not configured anymore.
+	ErrUnknownMasterKey = errors.New("unknown master key")
+	// ErrMissingDataKey is returned when a blob that was stored encrypted has no data key.
+	ErrMissingDataKey = errors.New("data key of encrypted blob missing")
+)
+
+// PlaintextBlobs tells which blobs were stored before encryption was enabled and have no data key.
+type PlaintextBlobs interface {
+	IsPlaintext(ctx context.Context, containerName, blobId string) (bool, error)
+}
+
+// EncryptedBlobStorage is a BlobStorage that envelope encrypts blobs before passing them to another BlobStorage.
+// Every blob is encrypted with AES-256-GCM under its own random data key. The data key is wrapped with a
+// master key and stored separately in the KeyContainer, so that rotating the master key only re-wraps the
+// data keys instead of re-encrypting the blobs.
+//
+// Blobs are encrypted in chunks, so that they are streamed to and from the backend without being held in memory.
+// Each chunk is sealed under a nonce made of a random prefix, the index of the chunk and a flag marking the last
+// chunk, so that chunks can not be reordered, dropped or cut off without failing decryption.
+type EncryptedBlobStorage struct {
+	backend    BlobStorage
+	plaintext  PlaintextBlobs
+	masterKeys map[string]cipher.AEAD
+	activeKid  string
+}
+
+// wrappedKey is the stored form of a data key.
+type wrappedKey struct {
+	KeyId      string `json:"kid"`
+	WrappedKey string `json:"wrappedKey"`
+	// Format is the format the blob was encrypted in.
+	Format string `json:"format,omitempty"`
+}
+
+// NewEncryptedBlobStorage creates a new EncryptedBlobStorage on top of the backend.
+// The master keys are read from the file named by MEDIA_MASTER_KEYS_FILE or, if it is not set, from the
+// MEDIA_MASTER_KEYS environment variable, as a comma or newline separated list of "keyId:base64Key" pairs
+// of 32 byte keys. The first key wraps new data keys; the others are kept to unwrap keys until they were
+// re-wrapped with RewrapKeys. Blobs without a data key are only served as they are if PlaintextBlobs reports
+// them as stored before encryption was enabled.
+func NewEncryptedBlobStorage(backend BlobStorage, plaintext PlaintextBlobs) (*EncryptedBlobStorage, error) {
+	keysString := os.Getenv("MEDIA_MASTER_KEYS")
+	if path := os.Getenv("MEDIA_MASTER_KEYS_FILE"); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading master keys file: %w", err)
+		}
+		keysString = string(content)
+	}
+	if strings.TrimSpace(keysString) == "" {
+		return nil, errors.New("MEDIA_MASTER_KEYS or MEDIA_MASTER_KEYS_FILE environment variable not set")
+	}
+
+	storage := &EncryptedBlobStorage{backend: backend, plaintext: plaintext, masterKeys: make(map[string]cipher.AEAD)}
+	entries := strings.FieldsFunc(keysString, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, encodedKey, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("invalid master key entry for key %q, expected keyId:base64Key", kid)
+		}
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be a base64 encoded 32 byte key", kid)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		storage.masterKeys[kid] = aead
+		if storage.activeKid == "" {
+			storage.activeKid = kid
+		}
+	}
+	return storage, nil
+}
+
+// UploadBlob encrypts the content under a new data key while uploading it, and uploads the wrapped data key.
+func (s *EncryptedBlobStorage) UploadBlob(ctx context.Context, containerName, blobId string, content io.Reader) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return fmt.Errorf("failed generating data key: %w", err)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	// The key is stored first, so that a stored blob can always be decrypted. If the blob replaces an existing
+	// one and its upload fails, the key of the existing blob is restored.
+	previousKey, err := s.backend.DownloadFile(ctx, KeyContainer, keyBlobId(containerName, blobId))
+	if err != nil && err != ErrBlobNotFound {
+		return err
+	}
+	if err := s.storeDataKey(ctx, containerName, blobId, dataKey, formatStream); err != nil {
+		return err
+	}
+
+	ciphertext, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(encryptStream(writer, content, aead, blobAssociatedData(containerName, blobId)))
+	}()
+	err = s.backend.UploadBlob(ctx, containerName, blobId, ciphertext)
+	// Closing the reader stops the encryption if the upload gave up before reading all of it.
+	ciphertext.Close()
+	if err != nil {
+		if previousKey != nil {
+			if restoreErr := s.backend.UploadBlob(ctx, KeyContainer, keyBlobId(containerName, blobId), bytes.NewReader(previousKey)); restoreErr != nil {
+				log.Printf("Failed restoring data key of blob %s: %v", blobId, restoreErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// DownloadFile downloads and decrypts a blob.
+func (s *EncryptedBlobStorage) DownloadFile(ctx context.Context, containerName, blobId string) ([]byte, error) {
+	reader, err := s.OpenFile(ctx, containerName, blobId)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// OpenFile opens a blob for reading and decrypts it while it is read.
+// Blobs stored before encryption was enabled have no data key and are returned as they are. Any other blob
+// without a data key returns ErrMissingDataKey, so that neither ciphertext nor planted content is served.
+func (s *EncryptedBlobStorage) OpenFile(ctx context.Context, containerName, blobId string) (io.ReadCloser, error) {
+	stored, err := s.loadWrappedKey(ctx, containerName, blobId)
+	if err == ErrBlobNotFound {
+		plaintext, err := s.plaintext.IsPlaintext(ctx, containerName, blobId)
+		if err != nil {
+			return nil, err
+		}
+		if !plaintext {
+			return nil, ErrMissingDataKey
+		}
+		return s.backend.OpenFile(ctx, containerName, blobId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := s.unwrap(stored, containerName, blobId)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if stored.Format == formatSealed {
+		ciphertext, err := s.backend.DownloadFile(ctx, containerName, blobId)
+		if err != nil {
+			return nil, err
+		}
+		data, err := open(aead, ciphertext, blobAssociatedData(containerName, blobId))
+		if err != nil {
+			return nil, fmt.Errorf("failed decrypting blob %s: %w", blobId, err)
+		}
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+	if stored.Format != formatStream {
+		return nil, fmt.Errorf("unknown format %q of blob %s", stored.Format, blobId)
+	}
+	ciphertext, err := s.backend.OpenFile(ctx, containerName, blobId)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		source:         ciphertext,
+		ciphertext:     bufio.NewReaderSize(ciphertext, streamChunkSize+aead.Overhead()),
+		aead:           aead,
+		associatedData: blobAssociatedData(containerName, blobId),
+		blobId:         blobId,
+	}, nil
+}
+
+// DeleteFile deletes a blob together with its data key.
+func (s *EncryptedBlobStorage) DeleteFile(ctx context.Context, containerName, blobId string) error {
+	if err := s.backend.DeleteFile(ctx, containerName, blobId); err != nil {
+		return err
+	}
+	return s.backend.DeleteFile(ctx, KeyContainer, keyBlobId(containerName, blobId))
+}
+
+// ListFiles lists all blobs stored in the container.
+func (s *EncryptedBlobStorage) ListFiles(ctx context.Context, containerName string) ([]StoredFile, error) {
+	return s.backend.ListFiles(ctx, containerName)
+}
+
+// HasDataKey reports whether a blob has a data key, that is whether it was stored encrypted.
+func (s *EncryptedBlobStorage) HasDataKey(ctx context.Context, containerName, blobId string) (bool, error) {
+	_, err := s.backend.DownloadFile(ctx, KeyContainer, keyBlobId(containerName, blobId))
+	if err == ErrBlobNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RewrapKeys re-wraps all data keys that are not wrapped with the active master key.
+// After it completed, master keys other than the active one can be removed from the configuration.
+// It must run before blobs are uploaded, as a key re-wrapped from a stale read would overwrite the key of a blob
+// stored in the meantime.
+func (s *EncryptedBlobStorage) RewrapKeys(ctx context.Context) error {
+	keyBlobs, err := s.backend.ListFiles(ctx, KeyContainer)
+	if err != nil {
+		return err
+	}
+	rewrapped := 0
+	for _, keyBlob := range keyBlobs {
+		containerName, blobId, ok := strings.Cut(keyBlob.BlobId, "/")
+		if !ok {
+			continue
+		}
+		stored, err := s.loadWrappedKey(ctx, containerName, blobId)
+		if err != nil {
+			log.Printf("Failed loading data key of blob %s: %v", blobId, err)
+			continue
+		}
+		if stored.KeyId == s.activeKid {
+			continue
+		}
+		dataKey, err := s.unwrap(stored, containerName, blobId)
+		if err != nil {
+			log.Printf("Failed unwrapping data key of blob %s: %v", blobId, err)
+			continue
+		}
+		if err := s.storeDataKey(ctx, containerName, blobId, dataKey, stored.Format); err != nil {
+			log.Printf("Failed re-wrapping data key of blob %s: %v", blobId, err)
+			continue
+		}
+		rewrapped++
+	}
+	if rewrapped > 0 {
+		log.Printf("Re-wrapped %d data keys with master key %s", rewrapped, s.activeKid)
+	}
+	return nil
+}
+
+// storeDataKey wraps the data key of a blob encrypted in the format with the active master key and stores it.
+func (s *EncryptedBlobStorage) storeDataKey(ctx context.Context, containerName, blobId string, dataKey []byte, format string) error {
+	wrapped := seal(s.masterKeys[s.activeKid], dataKey, blobAssociatedData(containerName, blobId))
+	content, err := json.Marshal(wrappedKey{
+		KeyId:      s.activeKid,
+		WrappedKey: base64.StdEncoding.EncodeToString(wrapped),
+		Format:     format,
+	})
+	if err != nil {
+		return err
+	}
+	return s.backend.UploadBlob(ctx, KeyContainer, keyBlobId(containerName, blobId), bytes.NewReader(content))
+}
+
+// loadWrappedKey loads the stored form of the data key of a blob.
+func (s *EncryptedBlobStorage) loadWrappedKey(ctx context.Context, containerName, blobId string) (*wrappedKey, error) {
+	content, err := s.backend.DownloadFile(ctx, KeyContainer, keyBlobId(containerName, blobId))
+	if err != nil {
+		return nil, err
+	}
+	var stored wrappedKey
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("failed parsing data key: %w", err)
+	}
+	return &stored, nil
+}
+
+// unwrap decrypts a wrapped data key with the master key it was wrapped with.
+func (s *EncryptedBlobStorage) unwrap(stored *wrappedKey, containerName, blobId string) ([]byte, error) {
+	masterKey, ok := s.masterKeys[stored.KeyId]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(stored.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding data key: %w", err)
+	}
+	dataKey, err := open(masterKey, wrapped, blobAssociatedData(containerName, blobId))
+	if err != nil {
+		return nil, fmt.Errorf("failed unwrapping data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// keyBlobId returns the name of the key blob of a blob in the KeyContainer.
+func keyBlobId(containerName, blobId string) string {
+	return containerName + "/" + blobId
+}
+
+// blobAssociatedData binds ciphertexts and wrapped keys to the blob they belong to,
+// so that they can not be swapped between blobs.
+func blobAssociatedData(containerName, blobId string) []byte {
+	return []byte(containerName + "/" + blobId)
+}
+
+// newGCM creates an AES-GCM cipher for the key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext under a random nonce, which is prepended to the ciphertext.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Sprintf("failed generating nonce: %v", err))
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData)
+}
+
+// open decrypts a ciphertext created by seal.
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+// encryptStream encrypts the content in formatStream and writes it to the writer.
+// A chunk is only sealed once the next one was read, so that the last chunk can be flagged as such. Empty content
+// is a single empty chunk.
+func encryptStream(writer io.Writer, content io.Reader, aead cipher.AEAD, additionalData []byte) error {
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return fmt.Errorf("failed generating nonce prefix: %w", err)
+	}
+	if _, err := writer.Write(prefix); err != nil {
+		return err
+	}
+
+	chunk, next := make([]byte, streamChunkSize), make([]byte, streamChunkSize)
+	length, err := io.ReadFull(content, chunk)
+	for index := uint32(0); ; index++ {
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fmt.Errorf("failed reading content: %w", err)
+		}
+		nextLength := 0
+		if !last {
+			nextLength, err = io.ReadFull(content, next)
+			last = err == io.EOF
+		}
+		if index == ^uint32(0) && !last {
+			return errors.New("content too long to encrypt")
+		}
+		sealed := aead.Seal(nil, streamNonce(prefix, index, last), chunk[:length], additionalData)
+		if _, err := writer.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		chunk, next, length = next, chunk, nextLength
+	}
+}
+
+// decryptingReader decrypts a blob in formatStream while it is read.
+type decryptingReader struct {
+	source         io.Closer
+	ciphertext     *bufio.Reader
+	aead           cipher.AEAD
+	associatedData []byte
+	blobId         string
+
+	prefix    []byte
+	index     uint32
+	plaintext []byte
+	done      bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptingReader) Close() error {
+	return r.source.Close()
+}
+
+// readChunk reads and decrypts the next chunk. A chunk is the last one if nothing follows it.
+func (r *decryptingReader) readChunk() error {
+	if r.prefix == nil {
+		r.prefix = make([]byte, streamPrefixSize)
+		if _, err := io.ReadFull(r.ciphertext, r.prefix); err != nil {
+			return fmt.Errorf("failed reading blob %s: %w", r.blobId, err)
+		}
+	}
+	sealed := make([]byte, streamChunkSize+r.aead.Overhead())
+	length, err := io.ReadFull(r.ciphertext, sealed)
+	last := err == io.EOF || err == io.ErrUnexpectedEOF
+	if err != nil && !last {
+		return fmt.Errorf("failed reading blob %s: %w", r.blobId, err)
+	}
+	if !last {
+		if _, err := r.ciphertext.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return fmt.Errorf("failed reading blob %s: %w", r.blobId, err)
+		}
+	}
+	plaintext, err := r.aead.Open(sealed[:0], streamNonce(r.prefix, r.index, last), sealed[:length], r.associatedData)
+	if err != nil {
+		return fmt.Errorf("failed decrypting blob %s: %w", r.blobId, err)
+	}
+	r.plaintext = plaintext
+	r.index++
+	r.done = last
+	return nil
+}
+
+// streamNonce returns the nonce of a chunk of a blob in formatStream.
+func streamNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, streamPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
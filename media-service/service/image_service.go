@@ -0,0 +1,358 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"strconv"
+
+	_ "image/gif"
+)
+
+var (
+	// ErrUnknownVariant is returned when the requested image variant does not exist.
+	ErrUnknownVariant = errors.New("unknown variant")
+	// ErrUnsupportedImage is returned when an uploaded image is not in one of the supported formats.
+	ErrUnsupportedImage = errors.New("unsupported image format")
+	// ErrImageTooLarge is returned when an uploaded image exceeds the configured pixel count.
+	ErrImageTooLarge = errors.New("image dimensions exceed the allowed pixel count")
+	// ErrImageFileTooLarge is returned when an uploaded image is longer than maxImageLength.
+	ErrImageFileTooLarge = errors.New("image file exceeds the allowed length")
+)
+
+const (
+	// defaultMaxImagePixels is the pixel count cap applied when IMAGE_MAX_PIXELS is not set.
+	defaultMaxImagePixels = 40_000_000
+	// maxImageLength is the maximum length of an uploaded image in bytes. Images are normalized in memory, so
+	// unlike other media they can not be as long as an upload.
+	maxImageLength = 100 << 20
+)
+
+const (
+	// ImageContainer is the container that holds uploaded images.
+	ImageContainer = "image"
+	// AvatarContainer is the container that holds the avatar images of users.
+	// Avatars are processed like images, but kept apart from the media shared in rooms.
+	AvatarContainer = "avatar"
+	// VariantThumb is a small square-ish thumbnail used in message lists.
+	VariantThumb = "thumb"
+	// VariantPreview is a medium sized preview shown inline in chat.
+	VariantPreview = "preview"
+)
+
+// imageVariants maps a variant name to the maximum length of its longer side in pixels.
+var imageVariants = map[string]int{
+	VariantThumb:   160,
+	VariantPreview: 720,
+}
+
+// ImageService normalizes uploaded images and generates their resized variants.
+type ImageService struct {
+	storage      BlobStorage
+	maxPixels    int
+	keepOriginal bool
+}
+
+// NewImageService creates a new ImageService storing variants in the given BlobStorage.
+// The maximum pixel count of accepted images is read from the IMAGE_MAX_PIXELS environment variable.
+// Unmodified originals are kept next to the normalized image only if KEEP_ORIGINAL_IMAGES is set to true.
+func NewImageService(storage BlobStorage) (*ImageService, error) {
+	maxPixels := defaultMaxImagePixels
+	if maxPixelsString := os.Getenv("IMAGE_MAX_PIXELS"); maxPixelsString != "" {
+		parsed, err := strconv.Atoi(maxPixelsString)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid IMAGE_MAX_PIXELS: %q", maxPixelsString)
+		}
+		maxPixels = parsed
+	}
+
+	keepOriginal := false
+	if keepOriginalString := os.Getenv("KEEP_ORIGINAL_IMAGES"); keepOriginalString != "" {
+		parsed, err := strconv.ParseBool(keepOriginalString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KEEP_ORIGINAL_IMAGES: %w", err)
+		}
+		keepOriginal = parsed
+	}
+
+	return &ImageService{
+		storage:      storage,
+		maxPixels:    maxPixels,
+		keepOriginal: keepOriginal,
+	}, nil
+}
+
+// IsValidVariant reports whether the given name is a known image variant.
+func IsValidVariant(variant string) bool {
+	_, ok := imageVariants[variant]
+	return ok
+}
+
+// VariantBlobId returns the ID under which the given variant of a blob is stored.
+func VariantBlobId(blobId, variant string) string {
+	return fmt.Sprintf("%s_%s", blobId, variant)
+}
+
+// OriginalBlobId returns the ID under which the unmodified original of a normalized image is stored.
+// Originals are not a downloadable variant.
+func OriginalBlobId(blobId string) string {
+	return fmt.Sprintf("%s_original", blobId)
+}
+
+// ReadImage reads an uploaded image into memory. Images longer than maxImageLength return ErrImageFileTooLarge.
+func (s *ImageService) ReadImage(content io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(content, maxImageLength+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading image: %w", err)
+	}
+	if len(data) > maxImageLength {
+		return nil, ErrImageFileTooLarge
+	}
+	return data, nil
+}
+
+// NormalizeImage prepares an uploaded image for storage.
+// It rejects images whose pixel count exceeds the configured limit before decoding them, so that
+// decompression bombs never get allocated. The EXIF orientation is applied to the pixels and the image is
+// re-encoded, which drops all metadata such as GPS location or device serials.
+// Animated GIFs are reduced to their first frame.
+func (s *ImageService) NormalizeImage(data []byte) ([]byte, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > s.maxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrUnsupportedImage
+	}
+
+	if format == "jpeg" {
+		img = applyOrientation(img, readExifOrientation(data))
+	}
+
+	normalized, err := encodeImage(img, format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to re-encode image: %w", err)
+	}
+	return normalized, nil
+}
+
+// IsImageContainer reports whether the container holds images, which are normalized and resized into variants.
+func IsImageContainer(containerName string) bool {
+	return containerName == ImageContainer || containerName == AvatarContainer
+}
+
+// GenerateVariantsAsync generates all image variants for a blob in a separate goroutine.
+// Failures are logged, as the original upload has already succeeded at this point.
+func (s *ImageService) GenerateVariantsAsync(containerName, blobId string, data []byte) {
+	if !IsImageContainer(containerName) {
+		return
+	}
+	go func() {
+		if err := s.GenerateVariants(context.Background(), containerName, blobId, data); err != nil {
+			log.Printf("Failed generating variants for blob %s: %v", blobId, err)
+		}
+	}()
+}
+
+// GenerateVariants decodes the image and stores a resized copy for every known variant next to the original.
+func (s *ImageService) GenerateVariants(ctx context.Context, containerName, blobId string, data []byte) error {
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	for variant, maxSide := range imageVariants {
+		resized := resizeImage(src, maxSide)
+		encoded, err := encodeImage(resized, format)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s variant: %w", variant, err)
+		}
+		if err := s.storage.UploadBlob(ctx, containerName, VariantBlobId(blobId, variant), bytes.NewReader(encoded)); err != nil {
+			return fmt.Errorf("failed to store %s variant: %w", variant, err)
+		}
+	}
+	log.Printf("Generated variants for blob %s", blobId)
+	return nil
+}
+
+// resizeImage scales the image down so that its longer side is at most maxSide pixels.
+// Each destination pixel is the average of the source pixels it covers, which keeps thumbnails free of aliasing.
+// Images that already fit are returned unchanged.
+func resizeImage(src image.Image, maxSide int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	if srcW <= maxSide && srcH <= maxSide {
+		return src
+	}
+
+	dstW, dstH := maxSide, maxSide
+	if srcW > srcH {
+		dstH = max(1, srcH*maxSide/srcW)
+	} else {
+		dstW = max(1, srcW*maxSide/srcH)
+	}
+
+	rgba := image.NewRGBA(image.Rect(0, 0, srcW, srcH))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, max((y+1)*srcH/dstH, y*srcH/dstH+1)
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, max((x+1)*srcW/dstW, x*srcW/dstW+1)
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				offset := rgba.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(rgba.Pix[offset])
+					g += int(rgba.Pix[offset+1])
+					b += int(rgba.Pix[offset+2])
+					a += int(rgba.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// encodeImage encodes the image as JPEG for photos and as PNG for formats that may carry transparency.
+func encodeImage(img image.Image, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readExifOrientation returns the orientation tag stored in the EXIF segment of a JPEG file.
+// It returns 1, the default orientation, if the file carries no EXIF data or the data is malformed.
+func readExifOrientation(data []byte) int {
+	const orientationTag = 0x0112
+
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 1
+		}
+		marker := data[offset+1]
+		// Start of scan, no more metadata segments follow.
+		if marker == 0xDA {
+			return 1
+		}
+		segmentLength := int(binary.BigEndian.Uint16(data[offset+2:]))
+		segmentEnd := offset + 2 + segmentLength
+		if segmentLength < 2 || segmentEnd > len(data) {
+			return 1
+		}
+		segment := data[offset+4 : segmentEnd]
+		offset = segmentEnd
+
+		if marker != 0xE1 || len(segment) < 14 || string(segment[:6]) != "Exif\x00\x00" {
+			continue
+		}
+
+		tiff := segment[6:]
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return 1
+		}
+
+		ifdOffset := int(order.Uint32(tiff[4:]))
+		if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
+			return 1
+		}
+		entries := int(order.Uint16(tiff[ifdOffset:]))
+		for i := 0; i < entries; i++ {
+			entry := ifdOffset + 2 + i*12
+			if entry+12 > len(tiff) {
+				return 1
+			}
+			if order.Uint16(tiff[entry:]) == orientationTag {
+				orientation := int(order.Uint16(tiff[entry+8:]))
+				if orientation < 1 || orientation > 8 {
+					return 1
+				}
+				return orientation
+			}
+		}
+		return 1
+	}
+	return 1
+}
+
+// applyOrientation transforms the image so that it displays upright without its EXIF orientation tag.
+func applyOrientation(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], rgba.Pix[rgba.PixOffset(x, y):rgba.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
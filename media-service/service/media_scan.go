@@ -0,0 +1,164 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"media_service/structs"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// QuarantineContainer holds the content of blobs in which malware was found, so that it can be inspected.
+const QuarantineContainer = "quarantine"
+
+var (
+	// ErrScanPending is returned when media is downloaded before its malware scan has finished.
+	ErrScanPending = errors.New("media has not been scanned yet")
+	// ErrMediaInfected is returned when media is downloaded or uploaded that was found to contain malware.
+	ErrMediaInfected = errors.New("media contains malware")
+)
+
+// scanBlobAsync scans a newly stored blob in the background.
+func (s *MediaService) scanBlobAsync(mediaType, blobId string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		s.scanBlob(ctx, mediaType, blobId)
+	}()
+}
+
+// scanBlob scans the stored content of a blob and records the result.
+// The content is streamed from storage to the scanner, so that large blobs do not have to fit in memory.
+// Infected content is moved to the quarantine container; the variants of clean images are generated.
+// If the scan fails, the blob stays pending and is scanned again by the rescan loop.
+func (s *MediaService) scanBlob(ctx context.Context, mediaType, blobId string) {
+	result, err := s.scanStoredBlob(ctx, mediaType, blobId)
+	if err != nil {
+		log.Printf("Failed scanning blob %s in container %s: %v", blobId, mediaType, err)
+		return
+	}
+
+	if !result.Infected {
+		if err := s.repo.SetScanStatus(ctx, mediaType, blobId, structs.ScanClean, ""); err != nil {
+			log.Printf("Failed marking blob %s as clean: %v", blobId, err)
+			return
+		}
+		if IsImageContainer(mediaType) {
+			content, err := s.storage.DownloadFile(ctx, mediaType, blobId)
+			if err != nil {
+				log.Printf("Failed downloading blob %s for its variants: %v", blobId, err)
+				return
+			}
+			s.images.GenerateVariantsAsync(mediaType, blobId, content)
+		}
+		return
+	}
+
+	log.Printf("Found %s in blob %s in container %s, moving it to quarantine", result.Signature, blobId, mediaType)
+	if err := s.quarantineBlob(ctx, mediaType, blobId); err != nil {
+		log.Printf("Failed quarantining blob %s: %v", blobId, err)
+		return
+	}
+	if err := s.repo.SetScanStatus(ctx, mediaType, blobId, structs.ScanInfected, result.Signature); err != nil {
+		log.Printf("Failed marking blob %s as infected: %v", blobId, err)
+		return
+	}
+	if err := s.deleteBlobContent(ctx, mediaType, blobId); err != nil {
+		log.Printf("Failed deleting infected blob %s: %v", blobId, err)
+	}
+}
+
+// scanStoredBlob streams the stored content of a blob to the scanner.
+func (s *MediaService) scanStoredBlob(ctx context.Context, mediaType, blobId string) (ScanResult, error) {
+	content, err := s.storage.OpenFile(ctx, mediaType, blobId)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer content.Close()
+	return s.scanner.Scan(ctx, content)
+}
+
+// quarantineBlob copies the stored content of a blob to the quarantine container.
+func (s *MediaService) quarantineBlob(ctx context.Context, mediaType, blobId string) error {
+	content, err := s.storage.OpenFile(ctx, mediaType, blobId)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	return s.storage.UploadBlob(ctx, QuarantineContainer, mediaType+"-"+blobId, content)
+}
+
+// checkScanStatus returns an error unless the blob was scanned and found clean.
+// Blobs stored before reference counting was introduced have no record; they are registered and scanned
+// on their first download.
+func (s *MediaService) checkScanStatus(ctx context.Context, mediaType, blobId string) error {
+	blob, err := s.repo.GetBlob(ctx, mediaType, blobId)
+	if err == mongo.ErrNoDocuments {
+		blob, err = s.registerLegacyBlob(ctx, mediaType, blobId)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch blob.ScanStatus {
+	case structs.ScanClean:
+		return nil
+	case structs.ScanInfected:
+		return ErrMediaInfected
+	default:
+		return ErrScanPending
+	}
+}
+
+// registerLegacyBlob creates the record of a blob stored without one and scans it.
+// Such blobs were stored before encryption was enabled.
+func (s *MediaService) registerLegacyBlob(ctx context.Context, mediaType, blobId string) (*structs.BlobEntity, error) {
+	content, err := s.storage.OpenFile(ctx, mediaType, blobId)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := describeContent(mediaType, content)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+	blob.BlobId = blobId
+	blob.Plaintext = true
+	blob.StoreStatus = structs.StoreStored
+	if _, err := s.acquireBlob(ctx, blob); err != nil {
+		return nil, err
+	}
+	s.scanBlob(ctx, mediaType, blobId)
+	return s.repo.GetBlob(ctx, mediaType, blobId)
+}
+
+// StartRescan scans the blobs that are still pending every interval until the context is cancelled.
+// Blobs end up pending if the scanner was unavailable when they were uploaded.
+func (s *MediaService) StartRescan(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.rescanPendingBlobs(ctx, time.Now().Add(-interval))
+			}
+		}
+	}()
+}
+
+// rescanPendingBlobs scans the blobs created before the given time that are still pending.
+func (s *MediaService) rescanPendingBlobs(ctx context.Context, before time.Time) {
+	blobs, err := s.repo.GetUnscannedBlobs(ctx, before)
+	if err != nil {
+		log.Printf("Failed listing unscanned blobs: %v", err)
+		return
+	}
+	for _, blob := range blobs {
+		s.scanBlob(ctx, blob.Container, blob.BlobId)
+	}
+}
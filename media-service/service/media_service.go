@@ -0,0 +1,387 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"media_service/structs"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// acquireAttempts is the number of times a blob that is being deleted is tried to be acquired.
+	acquireAttempts = 5
+	// acquireRetryDelay is the time waited for the deletion of a blob before acquiring it again.
+	acquireRetryDelay = 200 * time.Millisecond
+	// storeWaitTimeout is how long an upload waits for another upload of the same content to store it.
+	storeWaitTimeout = 2 * time.Minute
+	// storeRetryDelay is the time waited before checking again whether another upload stored the content.
+	storeRetryDelay = 500 * time.Millisecond
+	// storeStaleAfter is the time after which an upload that has not stored its content yet is presumed
+	// abandoned, for example because the instance running it crashed, and is taken over by other uploads.
+	storeStaleAfter = time.Hour
+)
+
+// ErrContentPending is returned when another upload of the same content did not finish storing it in time.
+var ErrContentPending = errors.New("content is still being stored by another upload")
+
+// BlobRepository keeps track of stored blobs and how many media files reference them.
+type BlobRepository interface {
+	AcquireBlob(ctx context.Context, blob *structs.BlobEntity) (*structs.BlobEntity, error)
+	ClaimBlobUpload(ctx context.Context, container, blobId, token string, staleBefore time.Time) (bool, error)
+	FinishBlobUpload(ctx context.Context, container, blobId, token string, status structs.StoreStatus) (bool, error)
+	ReleaseBlob(ctx context.Context, container, blobId string) (int64, error)
+	MarkBlobDeleting(ctx context.Context, container, blobId string) (bool, error)
+	DeleteBlob(ctx context.Context, container, blobId string) (bool, error)
+	PurgeBlob(ctx context.Context, container, blobId string) error
+	GetBlob(ctx context.Context, container, blobId string) (*structs.BlobEntity, error)
+	SetScanStatus(ctx context.Context, container, blobId string, status structs.ScanStatus, signature string) error
+	GetUnscannedBlobs(ctx context.Context, before time.Time) ([]structs.BlobEntity, error)
+	SetBlobMetadata(ctx context.Context, container, blobId string, size int64, contentType, checksum string) error
+}
+
+// MediaService coordinates the processing pipeline of uploaded media and their retrieval from storage.
+type MediaService struct {
+	storage BlobStorage
+	repo    BlobRepository
+	images  *ImageService
+	scanner Scanner
+}
+
+// NewMediaService creates a new MediaService with the provided BlobStorage, BlobRepository, ImageService
+// and Scanner.
+func NewMediaService(storage BlobStorage, repo BlobRepository, images *ImageService, scanner Scanner) *MediaService {
+	return &MediaService{
+		storage: storage,
+		repo:    repo,
+		images:  images,
+		scanner: scanner,
+	}
+}
+
+// UploadMedia stores the media in the container for its type and returns the record of its blob.
+// Blobs are content addressed: the blob ID is the SHA-256 of the stored content, so uploading the same
+// content again only adds a reference to the existing blob instead of storing another copy. Such uploads wait
+// until the upload that created the blob stored its content, and store the content themselves if it failed.
+// The content is read twice, once to hash it and once to store it, and is streamed both times, so that large
+// videos do not have to fit in memory. Images are read into memory, as they are normalized before they are stored.
+// New blobs are scanned for malware in the background and can only be downloaded once they were found clean;
+// the resized variants of images are generated after the scan. Uploading content that was already found
+// infected returns ErrMediaInfected.
+func (s *MediaService) UploadMedia(ctx context.Context, mediaType string, content io.ReadSeeker) (*structs.BlobEntity, error) {
+	var original []byte
+	if IsImageContainer(mediaType) {
+		data, err := s.images.ReadImage(content)
+		if err != nil {
+			return nil, err
+		}
+		normalized, err := s.images.NormalizeImage(data)
+		if err != nil {
+			return nil, err
+		}
+		original = data
+		content = bytes.NewReader(normalized)
+	}
+
+	blob, err := describeContent(mediaType, content)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed rewinding content: %w", err)
+	}
+	blobId := blob.BlobId
+	token := uuid.NewString()
+	blob.StoreStatus = structs.StoreStoring
+	blob.StoreToken = token
+
+	acquired, err := s.acquireBlob(ctx, blob)
+	if err != nil {
+		return nil, err
+	}
+	existing, storing, err := s.awaitBlobContent(ctx, acquired, token)
+	if err != nil {
+		if _, releaseErr := s.repo.ReleaseBlob(ctx, mediaType, blobId); releaseErr != nil {
+			log.Printf("Failed releasing blob %s: %v", blobId, releaseErr)
+		}
+		return nil, err
+	}
+	if !storing {
+		log.Printf("Blob %s already stored in container %s, now referenced %d times", blobId, mediaType, acquired.RefCount)
+		if existing.ScanStatus == structs.ScanInfected {
+			if _, err := s.repo.ReleaseBlob(ctx, mediaType, blobId); err != nil {
+				log.Printf("Failed releasing infected blob %s: %v", blobId, err)
+			}
+			return nil, ErrMediaInfected
+		}
+		return existing, nil
+	}
+
+	if err := s.storage.UploadBlob(ctx, mediaType, blobId, content); err != nil {
+		s.abandonUpload(mediaType, blobId, token)
+		return nil, err
+	}
+	if _, err := s.repo.FinishBlobUpload(ctx, mediaType, blobId, token, structs.StoreStored); err != nil {
+		log.Printf("Failed marking blob %s as stored: %v", blobId, err)
+	}
+
+	if original != nil && s.images.keepOriginal {
+		if err := s.storage.UploadBlob(ctx, mediaType, OriginalBlobId(blobId), bytes.NewReader(original)); err != nil {
+			log.Printf("Failed storing original of blob %s: %v", blobId, err)
+		}
+	}
+	s.scanBlobAsync(mediaType, blobId)
+
+	blob.RefCount = acquired.RefCount
+	blob.CreatedAt = time.Now()
+	blob.ScanStatus = structs.ScanPending
+	return blob, nil
+}
+
+// GetMediaMetadata retrieves the record of a blob with the metadata of its content.
+// Records created before the metadata was tracked are completed from the stored content.
+func (s *MediaService) GetMediaMetadata(ctx context.Context, mediaType, blobId string) (*structs.BlobEntity, error) {
+	blob, err := s.repo.GetBlob(ctx, mediaType, blobId)
+	if err == mongo.ErrNoDocuments {
+		blob, err = s.registerLegacyBlob(ctx, mediaType, blobId)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if blob.Checksum != "" || blob.ScanStatus == structs.ScanInfected {
+		return blob, nil
+	}
+
+	content, err := s.storage.OpenFile(ctx, mediaType, blobId)
+	if err != nil {
+		return nil, err
+	}
+	described, err := describeContent(mediaType, content)
+	content.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetBlobMetadata(ctx, mediaType, blobId, described.Size, described.ContentType, described.Checksum); err != nil {
+		return nil, err
+	}
+	blob.Size, blob.ContentType, blob.Checksum = described.Size, described.ContentType, described.Checksum
+	return blob, nil
+}
+
+// describeContent reads the content and creates the record of a blob for it, without references.
+// The content type is detected from the first 512 bytes, the most http.DetectContentType considers.
+func describeContent(mediaType string, content io.Reader) (*structs.BlobEntity, error) {
+	hash := sha256.New()
+	head := make([]byte, 512)
+	headLength, err := io.ReadFull(content, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed reading content: %w", err)
+	}
+	hash.Write(head[:headLength])
+	restLength, err := io.Copy(hash, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading content: %w", err)
+	}
+
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	return &structs.BlobEntity{
+		Container:   mediaType,
+		BlobId:      checksum,
+		Size:        int64(headLength) + restLength,
+		ContentType: http.DetectContentType(head[:headLength]),
+		Checksum:    checksum,
+	}, nil
+}
+
+// DownloadMedia retrieves the media from storage.
+// If variant is not empty, the resized image variant with that name is returned instead of the original.
+// Media that has not been scanned yet returns ErrScanPending and media found infected ErrMediaInfected.
+func (s *MediaService) DownloadMedia(ctx context.Context, mediaType, blobId, variant string) ([]byte, error) {
+	if variant != "" && !IsValidVariant(variant) {
+		return nil, ErrUnknownVariant
+	}
+	if err := s.checkScanStatus(ctx, mediaType, blobId); err != nil {
+		return nil, err
+	}
+	if variant != "" {
+		blobId = VariantBlobId(blobId, variant)
+	}
+	return s.storage.DownloadFile(ctx, mediaType, blobId)
+}
+
+// ReleaseMedia removes one reference from a blob.
+// The blob, together with its image variants, is only deleted from storage once its last reference is gone.
+// The record is marked as being deleted before the content is, so that a concurrent upload of the same content
+// does not acquire it and have its content deleted. Content left behind by a failed deletion has no record
+// anymore and is removed by the sweeper of chat service.
+// Blobs stored before reference counting was introduced have no record and are deleted right away.
+func (s *MediaService) ReleaseMedia(ctx context.Context, mediaType, blobId string) error {
+	refCount, err := s.repo.ReleaseBlob(ctx, mediaType, blobId)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		if _, err := s.repo.GetBlob(ctx, mediaType, blobId); err == mongo.ErrNoDocuments {
+			if err := s.deleteBlobContent(ctx, mediaType, blobId); err != nil {
+				return err
+			}
+			log.Printf("Deleted blob %s without record from container %s", blobId, mediaType)
+			return nil
+		} else if err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("failed releasing blob %s: %w", blobId, err)
+	case refCount > 0:
+		log.Printf("Blob %s in container %s still referenced %d times", blobId, mediaType, refCount)
+		return nil
+	}
+
+	marked, err := s.repo.MarkBlobDeleting(ctx, mediaType, blobId)
+	if err != nil {
+		return err
+	}
+	if !marked {
+		log.Printf("Blob %s in container %s was acquired again or is already being deleted", blobId, mediaType)
+		return nil
+	}
+	contentErr := s.deleteBlobContent(ctx, mediaType, blobId)
+	if contentErr != nil {
+		log.Printf("Failed deleting content of blob %s, leaving it to the sweeper: %v", blobId, contentErr)
+	}
+	if _, err := s.repo.DeleteBlob(ctx, mediaType, blobId); err != nil {
+		return err
+	}
+	if contentErr != nil {
+		return contentErr
+	}
+	log.Printf("Deleted blob %s from container %s", blobId, mediaType)
+	return nil
+}
+
+// acquireBlob adds a reference to a blob like BlobRepository.AcquireBlob. While the record of the blob is being
+// deleted it can not be acquired, so acquiring is retried a few times until the deletion is finished.
+func (s *MediaService) acquireBlob(ctx context.Context, blob *structs.BlobEntity) (*structs.BlobEntity, error) {
+	var err error
+	for attempt := 0; attempt < acquireAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(acquireRetryDelay):
+			}
+		}
+		var acquired *structs.BlobEntity
+		acquired, err = s.repo.AcquireBlob(ctx, blob)
+		if !mongo.IsDuplicateKeyError(err) {
+			return acquired, err
+		}
+	}
+	return nil, fmt.Errorf("blob %s is still being deleted: %w", blob.BlobId, err)
+}
+
+// awaitBlobContent waits until the content of an acquired blob is stored and returns its record. It reports
+// whether the upload with the token has to store the content instead, which is the case if it created the record,
+// or if the upload that did failed or was abandoned and the upload with the token claimed the blob.
+// Records created before the store status was tracked have their content stored.
+func (s *MediaService) awaitBlobContent(ctx context.Context, blob *structs.BlobEntity, token string) (*structs.BlobEntity, bool, error) {
+	deadline := time.Now().Add(storeWaitTimeout)
+	for {
+		if blob.StoreStatus == "" || blob.StoreStatus == structs.StoreStored {
+			return blob, false, nil
+		}
+		if blob.StoreToken == token {
+			return blob, true, nil
+		}
+
+		claimed, err := s.repo.ClaimBlobUpload(ctx, blob.Container, blob.BlobId, token, time.Now().Add(-storeStaleAfter))
+		if err != nil {
+			return nil, false, err
+		}
+		if claimed {
+			log.Printf("Taking over storing blob %s in container %s", blob.BlobId, blob.Container)
+			return blob, true, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, false, ErrContentPending
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(storeRetryDelay):
+		}
+		if blob, err = s.repo.GetBlob(ctx, blob.Container, blob.BlobId); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// abandonUpload marks the blob of a failed upload as failed, so that the next upload of the same content stores
+// it, and releases the reference of the upload, which deletes the blob if no other upload is waiting for it.
+// It is not bound to the request, as uploads mostly fail because the request was cancelled.
+func (s *MediaService) abandonUpload(mediaType, blobId, token string) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := s.repo.FinishBlobUpload(ctx, mediaType, blobId, token, structs.StoreFailed); err != nil {
+		log.Printf("Failed marking upload of blob %s as failed: %v", blobId, err)
+	}
+	if err := s.ReleaseMedia(ctx, mediaType, blobId); err != nil {
+		log.Printf("Failed releasing blob %s after failed upload: %v", blobId, err)
+	}
+}
+
+// PurgeMedia deletes a blob from storage regardless of how many references it has left.
+// It is meant for blobs that no media file references anymore.
+func (s *MediaService) PurgeMedia(ctx context.Context, mediaType, blobId string) error {
+	if err := s.deleteBlobContent(ctx, mediaType, blobId); err != nil {
+		return err
+	}
+	if err := s.repo.PurgeBlob(ctx, mediaType, blobId); err != nil {
+		return err
+	}
+	log.Printf("Purged blob %s from container %s", blobId, mediaType)
+	return nil
+}
+
+// ListMedia lists the blobs stored in the container for the media type.
+// Image variants and originals are stored next to their blob and are not listed.
+func (s *MediaService) ListMedia(ctx context.Context, mediaType string) ([]StoredFile, error) {
+	files, err := s.storage.ListFiles(ctx, mediaType)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]StoredFile, 0, len(files))
+	for _, file := range files {
+		if strings.Contains(file.BlobId, "_") {
+			continue
+		}
+		blobs = append(blobs, file)
+	}
+	return blobs, nil
+}
+
+// deleteBlobContent deletes a blob and everything stored next to it from storage.
+func (s *MediaService) deleteBlobContent(ctx context.Context, mediaType, blobId string) error {
+	blobIds := []string{blobId}
+	if IsImageContainer(mediaType) {
+		for variant := range imageVariants {
+			blobIds = append(blobIds, VariantBlobId(blobId, variant))
+		}
+		blobIds = append(blobIds, OriginalBlobId(blobId))
+	}
+	for _, id := range blobIds {
+		if err := s.storage.DeleteFile(ctx, mediaType, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// clamdChunkSize is the size of the chunks a stream is sent to clamd in.
+	clamdChunkSize = 64 << 10
+	// clamdTimeout bounds a single scan, including the connection to clamd.
+	clamdTimeout = 2 * time.Minute
+	// eicarSignature is the standard antivirus test string detected by the FakeScanner.
+	eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+)
+
+// ScanResult is the outcome of a malware scan.
+type ScanResult struct {
+	Infected bool
+	// Signature names the detected malware if the content is infected.
+	Signature string
+}
+
+// Scanner scans content for malware. The content is read as a stream, so that it does not have to fit in memory.
+type Scanner interface {
+	Scan(ctx context.Context, content io.Reader) (ScanResult, error)
+}
+
+// NewScanner creates the Scanner selected by the MALWARE_SCANNER environment variable.
+// "clamd", the default, scans with the clamd daemon at CLAMD_ADDRESS; "fake" only detects the EICAR test
+// file and is meant for development environments without clamd.
+func NewScanner() (Scanner, error) {
+	switch scanner := os.Getenv("MALWARE_SCANNER"); scanner {
+	case "", "clamd":
+		address := os.Getenv("CLAMD_ADDRESS")
+		if address == "" {
+			return nil, fmt.Errorf("CLAMD_ADDRESS environment variable not set")
+		}
+		return NewClamdScanner(address), nil
+	case "fake":
+		log.Println("Using fake malware scanner, uploads are only checked for the EICAR test file")
+		return &FakeScanner{}, nil
+	default:
+		return nil, fmt.Errorf("unknown MALWARE_SCANNER: %q", scanner)
+	}
+}
+
+// ClamdScanner scans content with a clamd daemon using the INSTREAM command of the clamd protocol.
+type ClamdScanner struct {
+	network string
+	address string
+}
+
+// NewClamdScanner creates a new ClamdScanner for the clamd daemon at the address.
+// Addresses starting with "unix:" refer to a unix socket, all others to a TCP host and port.
+func NewClamdScanner(address string) *ClamdScanner {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return &ClamdScanner{network: "unix", address: path}
+	}
+	return &ClamdScanner{network: "tcp", address: address}
+}
+
+// Scan streams the content to clamd and parses its verdict.
+func (s *ClamdScanner) Scan(ctx context.Context, content io.Reader) (ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, clamdTimeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, s.network, s.address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed connecting to clamd: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("failed sending command to clamd: %w", err)
+	}
+	size := make([]byte, 4)
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		length, err := io.ReadFull(content, chunk)
+		if length > 0 {
+			binary.BigEndian.PutUint32(size, uint32(length))
+			if _, err := conn.Write(size); err != nil {
+				return ScanResult{}, fmt.Errorf("failed streaming to clamd: %w", err)
+			}
+			if _, err := conn.Write(chunk[:length]); err != nil {
+				return ScanResult{}, fmt.Errorf("failed streaming to clamd: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("failed reading content to scan: %w", err)
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return ScanResult{}, fmt.Errorf("failed streaming to clamd: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed reading reply from clamd: %w", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00"))
+}
+
+// parseClamdReply parses a reply of the form "stream: OK" or "stream: <signature> FOUND".
+func parseClamdReply(reply string) (ScanResult, error) {
+	_, verdict, _ := strings.Cut(reply, ": ")
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd failed scanning: %s", reply)
+	}
+}
+
+// FakeScanner is a Scanner that only detects the EICAR test file.
+type FakeScanner struct{}
+
+// Scan reports the content as infected if it contains the EICAR test string.
+// The content is searched chunk by chunk, keeping the end of the previous chunk to find the string across chunks.
+func (s *FakeScanner) Scan(ctx context.Context, content io.Reader) (ScanResult, error) {
+	signature := []byte(eicarSignature)
+	window := make([]byte, 0, clamdChunkSize+len(signature))
+	chunk := make([]byte, clamdChunkSize)
+	for {
+		length, err := content.Read(chunk)
+		window = append(window, chunk[:length]...)
+		if bytes.Contains(window, signature) {
+			return ScanResult{Infected: true, Signature: "Eicar-Test-Signature"}, nil
+		}
+		if err == io.EOF {
+			return ScanResult{}, nil
+		}
+		if err != nil {
+			return ScanResult{}, fmt.Errorf("failed reading content to scan: %w", err)
+		}
+		if keep := len(signature) - 1; len(window) > keep {
+			window = append(window[:0], window[len(window)-keep:]...)
+		}
+	}
+}
@@ -3,16 +3,46 @@ package service
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
-	"github.com/google/uuid"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
 )
 
+// ErrBlobNotFound is returned when the requested blob does not exist in the container.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStorage is a storage backend for media blobs.
+type BlobStorage interface {
+	// UploadBlob uploads the content read from the reader under the given blob ID, overwriting any existing blob.
+	UploadBlob(ctx context.Context, containerName, blobId string, content io.Reader) error
+	// DownloadFile downloads the blob with the given ID.
+	DownloadFile(ctx context.Context, containerName, blobId string) ([]byte, error)
+	// OpenFile opens the blob with the given ID for reading, so that large blobs do not have to fit in memory.
+	OpenFile(ctx context.Context, containerName, blobId string) (io.ReadCloser, error)
+	// DeleteFile deletes the blob with the given ID. Deleting a blob that does not exist is not an error.
+	DeleteFile(ctx context.Context, containerName, blobId string) error
+	// ListFiles lists all blobs stored in the container.
+	ListFiles(ctx context.Context, containerName string) ([]StoredFile, error)
+}
+
+// StoredFile describes a blob present in a storage container.
+type StoredFile struct {
+	BlobId    string    `json:"blobId"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AzureBlobStorageService is a BlobStorage backed by Azure Blob Storage.
 type AzureBlobStorageService struct {
 	serviceClient *azblob.Client
+	// containers remembers the containers that are known to exist.
+	containers sync.Map
 }
 
 // NewAzureBlobStorageService creates a new AzureBlobStorageService.
@@ -38,37 +68,102 @@ func NewAzureBlobStorageService() (*AzureBlobStorageService, error) {
 
 // DownloadFile downloads a file from the specified container.
 func (s *AzureBlobStorageService) DownloadFile(ctx context.Context, containerName, mediaId string) ([]byte, error) {
+	reader, err := s.OpenFile(ctx, containerName, mediaId)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	downloadedData := bytes.Buffer{}
+	if _, err := downloadedData.ReadFrom(reader); err != nil {
+		return nil, fmt.Errorf("failed to read from retry reader: %w", err)
+	}
+	return downloadedData.Bytes(), nil
+}
+
+// OpenFile opens a file in the specified container for reading.
+// Interrupted reads are retried from where they stopped.
+func (s *AzureBlobStorageService) OpenFile(ctx context.Context, containerName, mediaId string) (io.ReadCloser, error) {
 	log.Printf("Downloading file %s from container %s", mediaId, containerName)
 	get, err := s.serviceClient.DownloadStream(ctx, containerName, mediaId, nil)
 	if err != nil {
+		if bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+			return nil, ErrBlobNotFound
+		}
 		log.Printf("failed to download blob: %v", err)
 		return nil, fmt.Errorf("failed to download blob: %w", err)
 	}
+	return get.NewRetryReader(ctx, &azblob.RetryReaderOptions{}), nil
+}
+
+// UploadBlob uploads a file to the specified container under the given blob ID.
+// The content is streamed in blocks, so it is never held in memory as a whole.
+// The container is created if it does not exist yet.
+func (s *AzureBlobStorageService) UploadBlob(ctx context.Context, containerName, blobId string, content io.Reader) error {
+	log.Printf("Uploading file %s to container %s", blobId, containerName)
+	if err := s.ensureContainer(ctx, containerName); err != nil {
+		return err
+	}
+	if _, err := s.serviceClient.UploadStream(ctx, containerName, blobId, content, nil); err != nil {
+		if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+			s.containers.Delete(containerName)
+		}
+		log.Printf("failed to upload blob: %v", err)
+		return fmt.Errorf("failed to upload blob: %w", err)
+	}
 
-	downloadedData := bytes.Buffer{}
-	retryReader := get.NewRetryReader(ctx, &azblob.RetryReaderOptions{})
-	_, err = downloadedData.ReadFrom(retryReader)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read from retry reader: %w", err)
+	return nil
+}
+
+// ensureContainer creates the container unless it is known to exist.
+// The content of an upload can only be read once, so the container has to exist before the upload starts.
+func (s *AzureBlobStorageService) ensureContainer(ctx context.Context, containerName string) error {
+	if _, ok := s.containers.Load(containerName); ok {
+		return nil
+	}
+	_, err := s.serviceClient.CreateContainer(ctx, containerName, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		return fmt.Errorf("failed to create container: %w", err)
 	}
+	s.containers.Store(containerName, true)
+	return nil
+}
 
-	err = retryReader.Close()
-	if err != nil {
-		return nil, fmt.Errorf("failed to close retry reader: %w", err)
+// DeleteFile deletes a file from the specified container.
+func (s *AzureBlobStorageService) DeleteFile(ctx context.Context, containerName, blobId string) error {
+	log.Printf("Deleting file %s from container %s", blobId, containerName)
+	_, err := s.serviceClient.DeleteBlob(ctx, containerName, blobId, nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.BlobNotFound, bloberror.ContainerNotFound) {
+		log.Printf("failed to delete blob: %v", err)
+		return fmt.Errorf("failed to delete blob: %w", err)
 	}
 
-	return downloadedData.Bytes(), nil
+	return nil
 }
 
-// UploadFile uploads a file to the specified container.
-func (s *AzureBlobStorageService) UploadFile(ctx context.Context, containerName string, data []byte) (string, error) {
-	log.Printf("Uploading file to container %s", containerName)
-	blobId := uuid.NewString()
-	_, err := s.serviceClient.UploadStream(ctx, containerName, blobId, bytes.NewReader(data), nil)
-	if err != nil {
-		log.Printf("failed to upload blob: %v", err)
-		return "", fmt.Errorf("failed to upload blob: %w", err)
+// ListFiles lists all files in the specified container.
+func (s *AzureBlobStorageService) ListFiles(ctx context.Context, containerName string) ([]StoredFile, error) {
+	var files []StoredFile
+	pager := s.serviceClient.NewListBlobsFlatPager(containerName, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			if bloberror.HasCode(err, bloberror.ContainerNotFound) {
+				return files, nil
+			}
+			return nil, fmt.Errorf("failed to list blobs: %w", err)
+		}
+		for _, item := range page.Segment.BlobItems {
+			if item.Name == nil {
+				continue
+			}
+			file := StoredFile{BlobId: *item.Name}
+			if item.Properties != nil && item.Properties.CreationTime != nil {
+				file.CreatedAt = *item.Properties.CreationTime
+			}
+			files = append(files, file)
+		}
 	}
 
-	return blobId, nil
+	return files, nil
 }
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"media_service/structs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrUploadNotFound is returned when an upload session does not exist or has already expired.
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadOffsetMismatch is returned when a chunk does not start at the current offset of the upload.
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrUploadTooLarge is returned when an upload or one of its chunks exceeds the allowed length.
+	ErrUploadTooLarge = errors.New("upload exceeds allowed length")
+	// ErrUploadIncomplete is returned when an upload is finalized before all of its bytes were received.
+	ErrUploadIncomplete = errors.New("upload incomplete")
+)
+
+const (
+	// defaultUploadTTL is how long an unfinished upload is kept when UPLOAD_SESSION_TTL_MINUTES is not set.
+	defaultUploadTTL = 24 * time.Hour
+	// defaultMaxUploadLength is the maximum upload length used when UPLOAD_MAX_LENGTH is not set.
+	defaultMaxUploadLength = 2 << 30
+)
+
+// UploadSession describes the state of a resumable upload.
+type UploadSession struct {
+	Id        string    `json:"uploadId"`
+	MediaType string    `json:"mediaType"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// UploadService manages resumable uploads.
+// Received chunks are spooled to the local disk and handed over to the MediaService once the upload is finalized.
+type UploadService struct {
+	media     *MediaService
+	spoolDir  string
+	ttl       time.Duration
+	maxLength int64
+	// locks serializes operations on the same upload, guarded by locksMutex.
+	locks      map[string]*sync.Mutex
+	locksMutex sync.Mutex
+}
+
+// NewUploadService creates a new UploadService.
+// The spool directory is read from the UPLOAD_SPOOL_DIR environment variable and defaults to a directory
+// in the system temp dir. The lifetime of unfinished uploads is read from UPLOAD_SESSION_TTL_MINUTES and the
+// maximum upload length in bytes from UPLOAD_MAX_LENGTH.
+func NewUploadService(media *MediaService) (*UploadService, error) {
+	spoolDir := os.Getenv("UPLOAD_SPOOL_DIR")
+	if spoolDir == "" {
+		spoolDir = filepath.Join(os.TempDir(), "media-uploads")
+	}
+	if err := os.MkdirAll(spoolDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create upload spool directory: %w", err)
+	}
+
+	ttl := defaultUploadTTL
+	if ttlString := os.Getenv("UPLOAD_SESSION_TTL_MINUTES"); ttlString != "" {
+		minutes, err := strconv.Atoi(ttlString)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("invalid UPLOAD_SESSION_TTL_MINUTES: %q", ttlString)
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+
+	maxLength := int64(defaultMaxUploadLength)
+	if maxLengthString := os.Getenv("UPLOAD_MAX_LENGTH"); maxLengthString != "" {
+		parsed, err := strconv.ParseInt(maxLengthString, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid UPLOAD_MAX_LENGTH: %q", maxLengthString)
+		}
+		maxLength = parsed
+	}
+
+	return &UploadService{
+		media:     media,
+		spoolDir:  spoolDir,
+		ttl:       ttl,
+		maxLength: maxLength,
+		locks:     make(map[string]*sync.Mutex),
+	}, nil
+}
+
+// CreateUpload starts a new resumable upload of the given total length.
+func (s *UploadService) CreateUpload(mediaType string, length int64) (*UploadSession, error) {
+	if length <= 0 || length > s.maxLength {
+		return nil, ErrUploadTooLarge
+	}
+
+	now := time.Now()
+	session := &UploadSession{
+		Id:        uuid.NewString(),
+		MediaType: mediaType,
+		Length:    length,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+
+	if err := os.WriteFile(s.dataPath(session.Id), nil, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to create upload file: %w", err)
+	}
+	if err := s.saveSession(session); err != nil {
+		return nil, err
+	}
+	log.Printf("Created upload %s of %d bytes to container %s", session.Id, length, mediaType)
+	return session, nil
+}
+
+// GetUpload returns the current state of an upload.
+func (s *UploadService) GetUpload(uploadId string) (*UploadSession, error) {
+	if uuid.Validate(uploadId) != nil {
+		return nil, ErrUploadNotFound
+	}
+	unlock := s.lockUpload(uploadId)
+	defer unlock()
+	return s.loadSession(uploadId)
+}
+
+// AppendChunk appends a chunk to the upload. The chunk must start at the current offset of the upload.
+// It returns the offset after the chunk was written.
+func (s *UploadService) AppendChunk(uploadId string, offset int64, chunk io.Reader) (int64, error) {
+	if uuid.Validate(uploadId) != nil {
+		return 0, ErrUploadNotFound
+	}
+	unlock := s.lockUpload(uploadId)
+	defer unlock()
+
+	session, err := s.loadSession(uploadId)
+	if err != nil {
+		return 0, err
+	}
+	if offset != session.Offset {
+		return session.Offset, ErrUploadOffsetMismatch
+	}
+
+	file, err := os.OpenFile(s.dataPath(uploadId), os.O_WRONLY, 0o600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	defer file.Close()
+
+	// Writing at the recorded offset discards whatever a previously interrupted chunk left behind.
+	if _, err := file.Seek(session.Offset, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek upload file: %w", err)
+	}
+	remaining := session.Length - session.Offset
+	written, err := io.Copy(file, io.LimitReader(chunk, remaining+1))
+	if written > remaining {
+		return session.Offset, ErrUploadTooLarge
+	}
+	// Keep whatever arrived before a broken connection so the client can resume from there.
+	session.Offset += written
+	if saveErr := s.saveSession(session); saveErr != nil {
+		return 0, saveErr
+	}
+	if err != nil {
+		return session.Offset, fmt.Errorf("failed to write chunk: %w", err)
+	}
+	return session.Offset, nil
+}
+
+// FinalizeUpload stores a completely received upload through the MediaService and returns the record of the new blob.
+// The upload is streamed from the spool file, so that it never has to fit in memory.
+func (s *UploadService) FinalizeUpload(ctx context.Context, uploadId string) (*structs.BlobEntity, error) {
+	if uuid.Validate(uploadId) != nil {
+		return nil, ErrUploadNotFound
+	}
+	unlock := s.lockUpload(uploadId)
+	defer unlock()
+
+	session, err := s.loadSession(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if session.Offset != session.Length {
+		return nil, ErrUploadIncomplete
+	}
+	file, err := os.Open(s.dataPath(uploadId))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open upload file: %w", err)
+	}
+	blob, err := s.media.UploadMedia(ctx, session.MediaType, io.NewSectionReader(file, 0, session.Length))
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	s.removeUpload(uploadId)
+	log.Printf("Finalized upload %s as blob %s", uploadId, blob.BlobId)
+	return blob, nil
+}
+
+// StartCleanup removes expired uploads every interval until the context is cancelled.
+func (s *UploadService) StartCleanup(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.removeExpiredUploads()
+			}
+		}
+	}()
+}
+
+// removeExpiredUploads deletes the files of all uploads whose lifetime has passed.
+func (s *UploadService) removeExpiredUploads() {
+	entries, err := os.ReadDir(s.spoolDir)
+	if err != nil {
+		log.Printf("Failed listing upload spool directory: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		uploadId, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		unlock := s.lockUpload(uploadId)
+		session, err := s.readSession(uploadId)
+		if err != nil || now.After(session.ExpiresAt) {
+			log.Printf("Removing expired upload %s", uploadId)
+			s.removeUpload(uploadId)
+		}
+		unlock()
+	}
+}
+
+// lockUpload acquires the lock of an upload and returns the function releasing it.
+func (s *UploadService) lockUpload(uploadId string) func() {
+	s.locksMutex.Lock()
+	lock, ok := s.locks[uploadId]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.locks[uploadId] = lock
+	}
+	s.locksMutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// loadSession reads the session of an upload and checks that it has not expired.
+// The caller must hold the lock of the upload.
+func (s *UploadService) loadSession(uploadId string) (*UploadSession, error) {
+	session, err := s.readSession(uploadId)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			s.removeUpload(uploadId)
+			return nil, ErrUploadNotFound
+		}
+		return nil, err
+	}
+	if time.Now().After(session.ExpiresAt) {
+		s.removeUpload(uploadId)
+		return nil, ErrUploadNotFound
+	}
+	return session, nil
+}
+
+// readSession reads the session file of an upload.
+func (s *UploadService) readSession(uploadId string) (*UploadSession, error) {
+	sessionBytes, err := os.ReadFile(s.sessionPath(uploadId))
+	if err != nil {
+		return nil, err
+	}
+	var session UploadSession
+	if err := json.Unmarshal(sessionBytes, &session); err != nil {
+		return nil, fmt.Errorf("failed to parse upload session: %w", err)
+	}
+	return &session, nil
+}
+
+// saveSession writes the session file of an upload.
+func (s *UploadService) saveSession(session *UploadSession) error {
+	sessionBytes, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload session: %w", err)
+	}
+	if err := os.WriteFile(s.sessionPath(session.Id), sessionBytes, 0o600); err != nil {
+		return fmt.Errorf("failed to write upload session: %w", err)
+	}
+	return nil
+}
+
+// removeUpload deletes the session and data files of an upload. The caller must hold the lock of the upload.
+func (s *UploadService) removeUpload(uploadId string) {
+	os.Remove(s.dataPath(uploadId))
+	os.Remove(s.sessionPath(uploadId))
+
+	s.locksMutex.Lock()
+	delete(s.locks, uploadId)
+	s.locksMutex.Unlock()
+}
+
+func (s *UploadService) dataPath(uploadId string) string {
+	return filepath.Join(s.spoolDir, uploadId+".part")
+}
+
+func (s *UploadService) sessionPath(uploadId string) string {
+	return filepath.Join(s.spoolDir, uploadId+".json")
+}
@@ -0,0 +1,56 @@
+package structs
+
+import "time"
+
+// ScanStatus is the state of the malware scan of a blob.
+type ScanStatus string
+
+const (
+	// ScanPending means the blob has not been scanned yet and must not be downloaded.
+	ScanPending ScanStatus = "pending"
+	// ScanClean means no malware was found in the blob.
+	ScanClean ScanStatus = "clean"
+	// ScanInfected means malware was found and the blob was moved to quarantine.
+	ScanInfected ScanStatus = "infected"
+)
+
+// StoreStatus is the state of the content of a blob in storage.
+type StoreStatus string
+
+const (
+	// StoreStoring means the content is being uploaded by the upload holding the store token of the blob.
+	StoreStoring StoreStatus = "storing"
+	// StoreStored means the content was stored.
+	StoreStored StoreStatus = "stored"
+	// StoreFailed means the upload of the content failed, so that the next upload of the content stores it.
+	StoreFailed StoreStatus = "failed"
+)
+
+// BlobEntity tracks a stored blob, its metadata and how many media files reference it.
+// Blobs are content addressed, so identical uploads share one blob whose ID is the SHA-256 of its content.
+type BlobEntity struct {
+	Container string    `bson:"container" json:"container"`
+	BlobId    string    `bson:"blobId" json:"blobId"`
+	RefCount  int64     `bson:"refCount" json:"refCount"`
+	CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
+	// Size, ContentType and Checksum describe the stored content; the checksum is its hex encoded SHA-256.
+	Size        int64  `bson:"size" json:"size"`
+	ContentType string `bson:"contentType" json:"contentType"`
+	Checksum    string `bson:"checksum" json:"checksum"`
+	// ScanStatus is missing on blobs stored before uploads were scanned, which are treated as pending.
+	ScanStatus ScanStatus `bson:"scanStatus,omitempty" json:"scanStatus"`
+	Signature  string     `bson:"signature,omitempty" json:"signature,omitempty"`
+	ScannedAt  *time.Time `bson:"scannedAt,omitempty" json:"scannedAt,omitempty"`
+	// Plaintext is set on blobs stored before encryption was enabled, which have no data key. The content of
+	// any other blob without a data key is not served, as its key was lost or the content was planted.
+	Plaintext bool `bson:"plaintext" json:"-"`
+	// StoreStatus is missing on blobs recorded before it was tracked, whose content is stored.
+	StoreStatus StoreStatus `bson:"storeStatus,omitempty" json:"-"`
+	// StoreToken identifies the upload storing the content, so that only it records the outcome.
+	StoreToken string `bson:"storeToken,omitempty" json:"-"`
+	// StoringAt is the time the upload storing the content started. Uploads that take too long are taken over.
+	StoringAt *time.Time `bson:"storingAt,omitempty" json:"-"`
+	// Deleting is set once the last reference is gone and the content is being deleted. The record can not be
+	// acquired again until it is removed.
+	Deleting bool `bson:"deleting,omitempty" json:"-"`
+}
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	"example.com/chat_app/identity"
+)
+
+// AvatarContainer is the media service container avatars are stored in.
+// Its images are normalized and resized into variants like those shared in rooms.
+const AvatarContainer = "avatar"
+
+var (
+	// ErrUnsupportedMedia is returned when the media service rejects an upload because of its format.
+	ErrUnsupportedMedia = errors.New("unsupported media format")
+	// ErrMediaTooLarge is returned when the media service rejects an upload because of its size or dimensions.
+	ErrMediaTooLarge = errors.New("media too large")
+	// ErrMediaInfected is returned when the media service found malware in the media.
+	ErrMediaInfected = errors.New("media contains malware")
+)
+
+// BlobMetadata describes the content of a blob as recorded by the media service.
+type BlobMetadata struct {
+	BlobId      string `json:"blobId"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"contentType"`
+}
+
+// MediaServiceClient is an http client wrapper for communication with media service.
+type MediaServiceClient struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewMediaClient creates a new MediaServiceClient.
+// It reads the base URL for the media service from the MEDIA_SERVICE_URL environment variable.
+// Requests are signed with the identity signer, as media service only accepts requests with an identity assertion.
+func NewMediaClient(signer *identity.Signer) (*MediaServiceClient, error) {
+	baseURL := os.Getenv("MEDIA_SERVICE_URL")
+	if baseURL == "" {
+		return nil, fmt.Errorf("MEDIA_SERVICE_URL environment variable not set")
+	}
+
+	return &MediaServiceClient{
+		BaseURL:    baseURL,
+		HTTPClient: &http.Client{Transport: signer.Transport(nil)},
+	}, nil
+}
+
+// UploadAvatar uploads an avatar image to the avatar container of the media service.
+// It returns the metadata of the stored blob.
+func (c *MediaServiceClient) UploadAvatar(ctx context.Context, image []byte) (*BlobMetadata, error) {
+	uploadURL := fmt.Sprintf("%s/%s", c.BaseURL, AvatarContainer)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(image))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload avatar request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if errors.Is(err, identity.ErrBodyTooLarge) {
+		return nil, ErrMediaTooLarge
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to send upload avatar request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusUnsupportedMediaType:
+		return nil, ErrUnsupportedMedia
+	case http.StatusRequestEntityTooLarge:
+		return nil, ErrMediaTooLarge
+	case http.StatusUnprocessableEntity:
+		return nil, ErrMediaInfected
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("unexpected status code from upload avatar: %d", resp.StatusCode)
+	}
+
+	var metadata BlobMetadata
+	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload avatar response: %w", err)
+	}
+	return &metadata, nil
+}
+
+// DeleteAvatar releases the reference to an avatar blob in the media service.
+// Blobs that are already gone are not treated as an error.
+func (c *MediaServiceClient) DeleteAvatar(ctx context.Context, blobId string) error {
+	deleteURL := fmt.Sprintf("%s/%s/%s", c.BaseURL, AvatarContainer, blobId)
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, deleteURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create delete avatar request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send delete avatar request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("unexpected status code from delete avatar: %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+// Command mock-oidc serves the mock OpenID Connect provider of package oidctest, for developing logins through a
+// provider without an account at a real one.
+//
+// It is configured with MOCK_OIDC_PORT (default 9000), MOCK_OIDC_ISSUER (default http://localhost:9000),
+// MOCK_OIDC_CLIENT_ID (default chat-app) and MOCK_OIDC_CLIENT_SECRET, which is optional. User service is pointed
+// at it with OIDC_ISSUER_URL and OIDC_CLIENT_ID set to the same values. It is not meant to run in production.
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"example.com/chat_app/user_service/internal/oidctest"
+)
+
+func main() {
+	port := getEnv("MOCK_OIDC_PORT", "9000")
+	provider, err := oidctest.NewProvider(
+		getEnv("MOCK_OIDC_ISSUER", "http://localhost:"+port),
+		getEnv("MOCK_OIDC_CLIENT_ID", "chat-app"),
+		os.Getenv("MOCK_OIDC_CLIENT_SECRET"),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Mock OIDC provider %s listening on port %s...", provider.Issuer(), port)
+	log.Fatal(http.ListenAndServe(":"+port, provider.Handler()))
+}
+
+// getEnv returns the value of the environment variable, or the default if it is not set.
+func getEnv(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
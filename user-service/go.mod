@@ -3,6 +3,7 @@ module example.com/chat_app/user_service
 go 1.22.2
 
 require (
+	example.com/chat_app/identity v0.0.0-00010101000000-000000000000
 	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
 	github.com/google/uuid v1.6.0 // indirect
@@ -18,3 +19,5 @@ require (
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 )
+
+replace example.com/chat_app/identity => ../identity
@@ -0,0 +1,29 @@
+package handler
+
+import (
+	"log"
+	"net/http"
+
+	"example.com/chat_app/user_service/service"
+)
+
+// JwksHandler publishes the public keys tokens are signed with.
+type JwksHandler struct {
+	keys *service.KeyRing
+}
+
+func NewJwksHandler(keys *service.KeyRing) *JwksHandler {
+	return &JwksHandler{
+		keys: keys,
+	}
+}
+
+// HandleJwks returns the JSON Web Key Set of the keys tokens are signed with.
+// Verifiers may cache it for a few minutes, but have to fetch it again when they see an unknown kid.
+func (h *JwksHandler) HandleJwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if err := writeJsonResponse(w, h.keys.Jwks()); err != nil {
+		log.Printf("Failed writing jwks response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
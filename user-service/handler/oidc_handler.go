@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+
+	"example.com/chat_app/user_service/service"
+)
+
+// oidcStateCookie is the cookie that binds a login through the provider to the browser it was started in.
+const oidcStateCookie = "oidc_state"
+
+// OidcHandler lets users log in through an external OpenID Connect provider.
+type OidcHandler struct {
+	oidc  *service.OidcService
+	users *service.UserService
+}
+
+// OidcTokenRequest carries the login token a finished login through the provider was handed back with.
+type OidcTokenRequest struct {
+	Token string `json:"token"`
+}
+
+func NewOidcHandler(oidc *service.OidcService, users *service.UserService) *OidcHandler {
+	return &OidcHandler{
+		oidc:  oidc,
+		users: users,
+	}
+}
+
+// HandleLogin starts a login through the provider by redirecting the browser to it.
+// The state of the login is kept in a cookie, so that the callback only accepts logins started in the same browser.
+func (h *OidcHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	authorizationUrl, state, err := h.oidc.StartLogin(ctx)
+	if err != nil {
+		log.Printf("Failed starting oidc login: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/auth/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authorizationUrl, http.StatusFound)
+}
+
+// HandleCallback finishes a login through the provider, which redirects the browser here with an authorization
+// code. The browser is sent on to the frontend page logins are handed back to, with a login token to redeem at
+// /auth/oidc/token, or with an error code if the login failed.
+func (h *OidcHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	query := r.URL.Query()
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     "/auth/oidc",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+
+	if providerError := query.Get("error"); providerError != "" {
+		log.Printf("Oidc provider rejected login: %s %s", providerError, query.Get("error_description"))
+		http.Redirect(w, r, h.oidc.CompleteUrl("", providerError), http.StatusFound)
+		return
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Redirect(w, r, h.oidc.CompleteUrl("", "invalid_state"), http.StatusFound)
+		return
+	}
+
+	token, err := h.oidc.FinishLogin(ctx, state, query.Get("code"))
+	if err != nil {
+		var errorCode string
+		switch {
+		case err == service.ErrInvalidOidcState:
+			errorCode = "invalid_state"
+		case errors.Is(err, service.ErrOidcLoginFailed):
+			log.Printf("Failed finishing oidc login: %v", err)
+			errorCode = "login_failed"
+		case err == service.ErrOidcEmailNotVerified:
+			errorCode = "email_not_verified"
+		case err == service.ErrOidcAccountConflict:
+			errorCode = "account_conflict"
+		case err == service.ErrOidcNoAccount:
+			errorCode = "no_account"
+		case err == service.ErrOidcEmailUnconfirmed:
+			errorCode = "email_unconfirmed"
+		default:
+			log.Printf("Failed finishing oidc login: %v", err)
+			errorCode = "server_error"
+		}
+		http.Redirect(w, r, h.oidc.CompleteUrl("", errorCode), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, h.oidc.CompleteUrl(token, ""), http.StatusFound)
+}
+
+// HandleToken redeems the login token of a finished login through the provider and returns the user DTO and the
+// tokens of a new session. Unknown, expired and used login tokens are rejected with a 401 Unauthorized error.
+// For users with an enabled second factor, it only returns the challenge to post with a code to /auth/mfa/verify.
+func (h *OidcHandler) HandleToken(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req OidcTokenRequest
+	if err := parseRequest(r, &req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.oidc.RedeemLoginToken(ctx, req.Token)
+	if err != nil {
+		if err == service.ErrInvalidOidcLoginToken {
+			http.Error(w, "Invalid or expired login token", http.StatusUnauthorized)
+			return
+		}
+		log.Printf("Failed redeeming oidc login token: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	dto, tokens, err := h.users.LoginExternal(ctx, user)
+	var mfaRequired *service.MfaRequiredError
+	if errors.As(err, &mfaRequired) {
+		if err := writeJsonResponse(w, &LoginResponse{Mfa: mfaRequired.Challenge}); err != nil {
+			log.Printf("Failed writing login response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err != nil {
+		writeLoginError(w, err, user.Username)
+		return
+	}
+
+	resp := &LoginResponse{
+		User:      dto,
+		TokenPair: tokens,
+	}
+	if err := writeJsonResponse(w, resp); err != nil {
+		log.Printf("Failed writing login response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -2,27 +2,100 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"example.com/chat_app/user_service/service"
 	"example.com/chat_app/user_service/structs"
 )
 
+const (
+	// defaultUserPageSize is the number of users returned per page of a search if no limit is given.
+	defaultUserPageSize = 20
+	// maxUserPageSize is the largest number of users returned per page of a search.
+	maxUserPageSize = 50
+)
+
 type UserHandler struct {
-	s *service.UserService
+	s            *service.UserService
+	sessions     *service.SessionService
+	verification *service.VerificationService
+	passwords    *service.PasswordService
+	mfa          *service.MfaService
 }
 
+// LoginResponse carries the user and the tokens of the new session. The tokens are left out when a user registers
+// who may not log in before verifying their email address. When the login has to be finished with a second
+// factor, it only carries the challenge to finish it with.
 type LoginResponse struct {
-	User        structs.UserDto `json:"user"`
-	AccessToken string          `json:"accessToken"`
+	User *structs.UserDto `json:"user,omitempty"`
+	*structs.TokenPair
+	Mfa *structs.MfaChallenge `json:"mfa,omitempty"`
+}
+
+// RefreshTokenRequest carries the refresh token of a session.
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// VerifyEmailRequest carries the token of a verification link.
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+// ForgotPasswordRequest carries the email address of the account whose password was forgotten.
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest carries the token of a reset link and the new password.
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// MfaVerifyRequest carries the token of a login waiting for the second factor and the TOTP or recovery code.
+type MfaVerifyRequest struct {
+	Token string `json:"token"`
+	Code  string `json:"code"`
+}
+
+// MfaCodeRequest carries a TOTP or recovery code of the authenticated user.
+type MfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// RecoveryCodesResponse carries the recovery codes generated when a second factor is enabled.
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// BatchUsersRequest carries the IDs of the users to look up.
+type BatchUsersRequest struct {
+	Ids []string `json:"ids"`
 }
 
-func NewUserHandler(s *service.UserService) *UserHandler {
+// ChangePasswordRequest carries the current and the new password of the authenticated user.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+func NewUserHandler(s *service.UserService, sessions *service.SessionService, verification *service.VerificationService, passwords *service.PasswordService, mfa *service.MfaService) *UserHandler {
 	return &UserHandler{
-		s: s,
+		s:            s,
+		sessions:     sessions,
+		verification: verification,
+		passwords:    passwords,
+		mfa:          mfa,
 	}
 }
 
@@ -46,7 +119,7 @@ func (h *UserHandler) HandleMe(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// HandleRegister registers a new user and returns the user DTO and JWT token.
+// HandleRegister registers a new user and returns the user DTO and the tokens of a new session.
 func (h *UserHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
@@ -58,7 +131,7 @@ func (h *UserHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userDto, token, err := h.s.RegisterUser(ctx, regReq)
+	userDto, tokens, err := h.s.RegisterUser(ctx, regReq)
 	if err != nil {
 		if err == service.ErrUserExists {
 			http.Error(w, "User already exists", http.StatusConflict)
@@ -69,8 +142,8 @@ func (h *UserHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	resp := &LoginResponse{
-		AccessToken: token,
-		User:        *userDto,
+		User:      userDto,
+		TokenPair: tokens,
 	}
 	err = writeJsonResponse(w, resp)
 	if err != nil {
@@ -80,7 +153,10 @@ func (h *UserHandler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// HandleLogin logs in a user and returns the user DTO and JWT token.
+// HandleLogin logs in a user and returns the user DTO and the tokens of a new session.
+// Unknown usernames and incorrect passwords are both rejected with a 401 Unauthorized error. After too many
+// failed logins, the account or client is locked out with a 429 Too Many Requests error and a Retry-After header.
+// For users with an enabled second factor, it only returns the challenge to post with a code to /auth/mfa/verify.
 func (h *UserHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	var logReq service.LoginRequest
@@ -91,29 +167,420 @@ func (h *UserHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dto, token, err := h.s.LoginUser(ctx, logReq)
+	dto, tokens, err := h.s.LoginUser(ctx, logReq, clientIp(r))
+	var mfaRequired *service.MfaRequiredError
+	if errors.As(err, &mfaRequired) {
+		if err := writeJsonResponse(w, &LoginResponse{Mfa: mfaRequired.Challenge}); err != nil {
+			log.Printf("Failed writing login response: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err != nil {
+		writeLoginError(w, err, logReq.Username)
+		return
+	}
+
+	resp := &LoginResponse{
+		User:      dto,
+		TokenPair: tokens,
+	}
+	err = writeJsonResponse(w, resp)
+	if err != nil {
+		log.Printf("Failed writing login response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// HandleMfaVerify finishes a login waiting for the second factor with a TOTP or recovery code and returns the
+// user DTO and the tokens of a new session. Unknown and expired tokens as well as incorrect codes are rejected
+// with a 401 Unauthorized error; incorrect codes count as failed logins and lock out the account like incorrect
+// passwords do.
+func (h *UserHandler) HandleMfaVerify(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req MfaVerifyRequest
+	if err := parseRequest(r, &req); err != nil || req.Token == "" || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	dto, tokens, err := h.s.VerifyMfaLogin(ctx, req.Token, req.Code, clientIp(r))
+	if err != nil {
+		switch err {
+		case service.ErrInvalidMfaToken:
+			http.Error(w, "Invalid or expired two-factor authentication token", http.StatusUnauthorized)
+		case service.ErrInvalidMfaCode:
+			http.Error(w, "Invalid two-factor authentication code", http.StatusUnauthorized)
+		default:
+			writeLoginError(w, err, "")
+		}
+		return
+	}
+
+	resp := &LoginResponse{
+		User:      dto,
+		TokenPair: tokens,
+	}
+	if err := writeJsonResponse(w, resp); err != nil {
+		log.Printf("Failed writing login response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleMfaEnroll generates a new TOTP secret for the authenticated user and returns it together with its
+// otpauth URI. The second factor is only required at login after it is confirmed with a first code.
+// It returns a 409 Conflict error if the second factor is already enabled.
+func (h *UserHandler) HandleMfaEnroll(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	enrollment, err := h.mfa.Enroll(ctx, userId)
 	if err != nil {
 		switch err {
 		case service.ErrNoUser:
 			http.Error(w, "User not found", http.StatusNotFound)
-		case service.ErrWrongPassword:
-			http.Error(w, "Incorrect password", http.StatusUnauthorized)
+		case service.ErrMfaAlreadyEnabled:
+			http.Error(w, "Two-factor authentication already enabled", http.StatusConflict)
 		default:
+			log.Printf("Failed enrolling two-factor authentication of user %s: %v", userId, err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
 		}
 		return
 	}
+	if err := writeJsonResponse(w, enrollment); err != nil {
+		log.Printf("Failed writing enrollment response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
 
-	resp := &LoginResponse{
-		User:        *dto,
-		AccessToken: token,
+// HandleMfaConfirm enables the enrolled second factor of the authenticated user with a first TOTP code and
+// returns the recovery codes, which are not shown again. Incorrect codes are rejected with a 400 Bad Request
+// error, and a 409 Conflict error is returned if no second factor was enrolled.
+func (h *UserHandler) HandleMfaConfirm(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	var req MfaCodeRequest
+	if err := parseRequest(r, &req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
 	}
-	err = writeJsonResponse(w, resp)
+
+	recoveryCodes, err := h.mfa.ConfirmEnrollment(ctx, userId, req.Code)
 	if err != nil {
-		log.Printf("Failed writing login response: %v", err)
+		switch err {
+		case service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case service.ErrMfaNotEnrolled:
+			http.Error(w, "Two-factor authentication not enrolled", http.StatusConflict)
+		case service.ErrInvalidMfaCode:
+			http.Error(w, "Invalid two-factor authentication code", http.StatusBadRequest)
+		default:
+			log.Printf("Failed confirming two-factor authentication of user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := writeJsonResponse(w, &RecoveryCodesResponse{RecoveryCodes: recoveryCodes}); err != nil {
+		log.Printf("Failed writing recovery codes response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleMfaDisable removes the second factor of the authenticated user, who has to provide a TOTP or recovery
+// code. Incorrect codes are rejected with a 403 Forbidden error and count as failed logins; once the account is
+// locked, requests are rejected with a 429 Too Many Requests error. A 409 Conflict error is returned if no second
+// factor is enabled.
+func (h *UserHandler) HandleMfaDisable(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	var req MfaCodeRequest
+	if err := parseRequest(r, &req); err != nil || req.Code == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.mfa.Disable(ctx, userId, req.Code, clientIp(r)); err != nil {
+		var locked *service.LoginLockedError
+		switch {
+		case err == service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case err == service.ErrMfaNotEnrolled:
+			http.Error(w, "Two-factor authentication not enabled", http.StatusConflict)
+		case err == service.ErrInvalidMfaCode:
+			http.Error(w, "Invalid two-factor authentication code", http.StatusForbidden)
+		case errors.As(err, &locked):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+			http.Error(w, "Too many failed attempts, try again later", http.StatusTooManyRequests)
+		default:
+			log.Printf("Failed disabling two-factor authentication of user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMfaReset removes the second factor of the user in the path on behalf of the authenticated admin, for
+// users who lost both their authenticator and their recovery codes. Users who are not admins are rejected with a
+// 403 Forbidden error.
+func (h *UserHandler) HandleMfaReset(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	adminId := r.Header.Get("X-User-Id")
+	userId := r.PathValue("userId")
+
+	if err := h.mfa.Reset(ctx, adminId, userId); err != nil {
+		switch err {
+		case service.ErrNotAdmin:
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		case service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case service.ErrMfaNotEnrolled:
+			http.Error(w, "Two-factor authentication not enabled", http.StatusConflict)
+		default:
+			log.Printf("Failed resetting two-factor authentication of user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeLoginError writes the error response of a failed login.
+func writeLoginError(w http.ResponseWriter, err error, username string) {
+	var locked *service.LoginLockedError
+	switch {
+	case err == service.ErrInvalidCredentials:
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+	case errors.As(err, &locked):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds()))))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+	case err == service.ErrEmailNotVerified:
+		http.Error(w, "Email address not verified", http.StatusForbidden)
+	default:
+		log.Printf("Failed logging in user %q: %v", username, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleRefresh rotates the refresh token of a session and returns new tokens.
+// Unknown, expired and revoked refresh tokens are rejected with a 401 Unauthorized error. Using a refresh token
+// that was already rotated revokes all tokens of the session and is rejected the same way. Users who may not log
+// in before verifying their email address are rejected with a 403 Forbidden error.
+func (h *UserHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RefreshTokenRequest
+	if err := parseRequest(r, &req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := h.sessions.Refresh(ctx, req.RefreshToken)
+	if err != nil {
+		switch err {
+		case service.ErrInvalidRefreshToken, service.ErrRefreshTokenReused:
+			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		case service.ErrEmailNotVerified:
+			http.Error(w, "Email address not verified", http.StatusForbidden)
+		default:
+			log.Printf("Failed refreshing session: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := writeJsonResponse(w, tokens); err != nil {
+		log.Printf("Failed writing refresh response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleLogout ends the session of the refresh token by revoking all of its refresh tokens, together with the
+// access tokens issued with them, which the gateway rejects once it synced the revocation.
+func (h *UserHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req RefreshTokenRequest
+	if err := parseRequest(r, &req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.sessions.EndSession(ctx, req.RefreshToken); err != nil {
+		log.Printf("Failed ending session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleVerifyEmail consumes the token of a verification link and marks the email address as verified.
+// Unknown, expired and used tokens are rejected with a 400 Bad Request error. Sessions started before keep their
+// restricted access tokens until they are refreshed.
+func (h *UserHandler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req VerifyEmailRequest
+	if err := parseRequest(r, &req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.verification.VerifyEmail(ctx, req.Token); err != nil {
+		if err == service.ErrInvalidVerificationToken {
+			http.Error(w, "Invalid or expired verification token", http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed verifying email: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleResendVerification mails a new verification link to the authenticated user.
+// It returns a 409 Conflict error if the email address is already verified.
+func (h *UserHandler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	if err := h.verification.ResendVerification(ctx, userId); err != nil {
+		switch err {
+		case service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case service.ErrEmailAlreadyVerified:
+			http.Error(w, "Email address already verified", http.StatusConflict)
+		default:
+			log.Printf("Failed resending verification mail to user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleForgotPassword mails a password reset link to the accounts with the email address.
+// It responds with 202 Accepted whether or not there is such an account.
+func (h *UserHandler) HandleForgotPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ForgotPasswordRequest
+	if err := parseRequest(r, &req); err != nil || req.Email == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.passwords.ForgotPassword(ctx, req.Email); err != nil {
+		log.Printf("Failed sending password reset mail: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleResetPassword consumes the token of a reset link and sets the new password, ending all sessions of the
+// user. Unknown, expired and used tokens as well as passwords that do not meet the requirements are rejected
+// with a 400 Bad Request error.
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var req ResetPasswordRequest
+	if err := parseRequest(r, &req); err != nil || req.Token == "" {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.passwords.ResetPassword(ctx, req.Token, req.Password); err != nil {
+		switch {
+		case err == service.ErrInvalidResetToken:
+			http.Error(w, "Invalid or expired reset token", http.StatusBadRequest)
+		case errors.Is(err, service.ErrInvalidPassword):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Failed resetting password: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleChangePassword changes the password of the authenticated user, who has to provide the current password.
+// All sessions of the user end, including the one of the request, so the client has to log in again.
+// An incorrect current password is rejected with a 403 Forbidden error and an invalid new password with a
+// 400 Bad Request error.
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	var req ChangePasswordRequest
+	if err := parseRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.passwords.ChangePassword(ctx, userId, req.CurrentPassword, req.NewPassword); err != nil {
+		switch {
+		case err == service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case err == service.ErrWrongPassword:
+			http.Error(w, "Incorrect password", http.StatusForbidden)
+		case errors.Is(err, service.ErrInvalidPassword):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			log.Printf("Failed changing password of user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeSessions ends all sessions of the authenticated user, including the one of the request.
+// Its access tokens are rejected by the gateway within seconds.
+func (h *UserHandler) HandleRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	if err := h.sessions.RevokeUserSessions(ctx, userId); err != nil {
+		log.Printf("Failed revoking sessions of user %s: %v", userId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevocations lists the access token revocations made at or after the RFC 3339 time in the "since" query
+// parameter, or all revocations that have not expired yet if it is missing. It is polled by the gateway and is
+// not routed through it.
+func (h *UserHandler) HandleRevocations(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var since time.Time
+	if sinceString := r.URL.Query().Get("since"); sinceString != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, sinceString)
+		if err != nil {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	revocations, err := h.sessions.GetRevocations(ctx, since)
+	if err != nil {
+		log.Printf("Failed listing revocations: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	if err := writeJsonResponse(w, revocations); err != nil {
+		log.Printf("Failed writing revocations response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// clientIp returns the IP address of the client the request was made by. Requests reach user service through the
+// gateway, which appends the address it received the request from to X-Forwarded-For, so only the last entry of
+// the header is trusted; the ones before it are supplied by the client.
+func clientIp(r *http.Request) string {
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		entries := strings.Split(forwardedFor[len(forwardedFor)-1], ",")
+		return strings.TrimSpace(entries[len(entries)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
 }
 
 // parseRequest reads the request body and unmarshals it into the given struct.
@@ -144,3 +611,140 @@ func writeJsonResponse(w http.ResponseWriter, respStruct any) error {
 	}
 	return nil
 }
+
+// HandleSetAvatar uploads the image in the "file" field of the multipart form as the avatar of the
+// authenticated user and returns the updated user DTO.
+// Images in unsupported formats are rejected with a 415 Unsupported Media Type error, images that are too large
+// with a 413 Request Entity Too Large error and images containing malware with a 422 Unprocessable Entity error.
+func (h *UserHandler) HandleSetAvatar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // Limit of 10 MB
+		http.Error(w, "Unable to parse multipart form", http.StatusBadRequest)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Unable to retrieve image file", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	image, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Unable to read image file", http.StatusBadRequest)
+		return
+	}
+
+	userDto, err := h.s.SetAvatar(ctx, userId, image)
+	if err != nil {
+		switch err {
+		case service.ErrNoUser:
+			http.Error(w, "User not found", http.StatusNotFound)
+		case service.ErrUnsupportedMedia:
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case service.ErrMediaTooLarge:
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case service.ErrMediaInfected:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		default:
+			log.Printf("Failed setting avatar of user %s: %v", userId, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}
+		return
+	}
+	if err := writeJsonResponse(w, userDto); err != nil {
+		log.Printf("Failed writing user response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleRemoveAvatar removes the avatar of the authenticated user and returns the updated user DTO.
+func (h *UserHandler) HandleRemoveAvatar(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+
+	userDto, err := h.s.RemoveAvatar(ctx, userId)
+	if err != nil {
+		if err == service.ErrNoUser {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed removing avatar of user %s: %v", userId, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeJsonResponse(w, userDto); err != nil {
+		log.Printf("Failed writing user response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleSearchUsers returns a page of the users whose username or display name starts with the "q" query
+// parameter, ignoring case, ordered by username. At most "limit" users are returned per page; the "nextCursor"
+// of a page is passed as the "cursor" query parameter to fetch the next one.
+func (h *UserHandler) HandleSearchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+	query := r.URL.Query()
+
+	filter := structs.UserFilter{
+		Query: strings.TrimSpace(query.Get("q")),
+		Limit: defaultUserPageSize,
+	}
+	if filter.Query == "" {
+		http.Error(w, "Missing q query parameter", http.StatusBadRequest)
+		return
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.ParseInt(limit, 10, 64)
+		if err != nil || filter.Limit <= 0 || filter.Limit > maxUserPageSize {
+			http.Error(w, "Invalid limit query parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	page, err := h.s.SearchUsers(ctx, filter, query.Get("cursor"), userId)
+	if err != nil {
+		if err == service.ErrInvalidCursor {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed searching users: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeJsonResponse(w, page); err != nil {
+		log.Printf("Failed writing user page response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// HandleBatchUsers returns the public profiles of the users with the IDs in the JSON body. IDs without a user are
+// left out. Looking up more than 100 users at once is rejected with a 400 Bad Request error.
+func (h *UserHandler) HandleBatchUsers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	userId := r.Header.Get("X-User-Id")
+
+	var req BatchUsersRequest
+	if err := parseRequest(r, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	users, err := h.s.GetUsersByIds(ctx, req.Ids, userId)
+	if err != nil {
+		if err == service.ErrTooManyIds {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Failed looking up users: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if err := writeJsonResponse(w, users); err != nil {
+		log.Printf("Failed writing users response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,310 @@
+// Package oidctest is a minimal OpenID Connect provider for developing and testing logins through a provider
+// without an account at a real one. It supports the authorization code flow with PKCE, shows a form to pick the
+// claims of the account to log in as, and signs ID tokens with an RSA key generated when it is created.
+// It is served by the mock-oidc command and by the tests of the oidc service. It is not meant to run in production.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// keyId is the kid of the signing key in the JWKS.
+	keyId = "mock-oidc"
+	// codeTTL is the lifetime of authorization codes.
+	codeTTL = time.Minute
+	// idTokenTTL is the lifetime of ID tokens.
+	idTokenTTL = 5 * time.Minute
+)
+
+// authorization is an authorization code that was issued and not redeemed yet.
+type authorization struct {
+	clientId      string
+	redirectUri   string
+	codeChallenge string
+	nonce         string
+	claims        jwt.MapClaims
+	expiresAt     time.Time
+}
+
+// Provider is the mock OpenID Connect provider.
+type Provider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	key          *rsa.PrivateKey
+
+	lock  sync.Mutex
+	codes map[string]*authorization
+}
+
+// loginForm is the page the account to log in as is picked on. The parameters of the authorization request are
+// passed through hidden fields.
+var loginForm = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Mock OIDC login</title></head>
+<body>
+<h1>Mock OIDC login</h1>
+<form method="post" action="/authorize">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<p><label>Subject <input name="sub" value="mock-user-1" required></label></p>
+<p><label>Email <input name="email" value="mock.user@example.com"></label></p>
+<p><label><input type="checkbox" name="email_verified" value="true" checked> Email verified</label></p>
+<p><label>Preferred username <input name="preferred_username" value="mockuser"></label></p>
+<p><label>Name <input name="name" value="Mock User"></label></p>
+<p><button type="submit">Log in</button> <button type="submit" name="deny" value="true">Deny</button></p>
+</form>
+</body>
+</html>
+`))
+
+// NewProvider creates a new Provider with the issuer URL it is reachable at and the client registered with it.
+// The client secret is optional; if it is empty, public clients are accepted.
+func NewProvider(issuer, clientId, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating signing key: %w", err)
+	}
+	return &Provider{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		key:          key,
+		codes:        make(map[string]*authorization),
+	}, nil
+}
+
+// Issuer returns the issuer URL of the provider.
+func (p *Provider) Issuer() string {
+	return p.issuer
+}
+
+// Handler returns the http.Handler serving the endpoints of the provider.
+func (p *Provider) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("GET /jwks", p.handleJwks)
+	mux.HandleFunc("GET /authorize", p.handleAuthorizeForm)
+	mux.HandleFunc("POST /authorize", p.handleAuthorize)
+	mux.HandleFunc("POST /token", p.handleToken)
+	return mux
+}
+
+// handleDiscovery returns the discovery document.
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]any{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "email", "profile"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "none"},
+	})
+}
+
+// handleJwks returns the public signing key.
+func (p *Provider) handleJwks(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]any{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": keyId,
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// handleAuthorizeForm checks the authorization request and shows the login form.
+func (p *Provider) handleAuthorizeForm(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := p.checkAuthorizationRequest(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := make(map[string]string)
+	for _, name := range []string{"client_id", "redirect_uri", "state", "nonce", "code_challenge", "scope"} {
+		params[name] = query.Get(name)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := loginForm.Execute(w, map[string]any{"Params": params}); err != nil {
+		log.Printf("Failed rendering login form: %v", err)
+	}
+}
+
+// handleAuthorize issues an authorization code for the account picked on the login form and redirects back to the
+// client with it.
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+	form := r.PostForm
+	form.Set("response_type", "code")
+	form.Set("code_challenge_method", "S256")
+	if err := p.checkAuthorizationRequest(form); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redirectUri, _ := url.Parse(form.Get("redirect_uri"))
+	query := redirectUri.Query()
+	query.Set("state", form.Get("state"))
+
+	if form.Get("deny") == "true" {
+		query.Set("error", "access_denied")
+		redirectUri.RawQuery = query.Encode()
+		http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+		return
+	}
+
+	code := randomString()
+	p.lock.Lock()
+	p.codes[code] = &authorization{
+		clientId:      form.Get("client_id"),
+		redirectUri:   form.Get("redirect_uri"),
+		codeChallenge: form.Get("code_challenge"),
+		nonce:         form.Get("nonce"),
+		claims: jwt.MapClaims{
+			"sub":                form.Get("sub"),
+			"email":              form.Get("email"),
+			"email_verified":     form.Get("email_verified") == "true",
+			"preferred_username": form.Get("preferred_username"),
+			"name":               form.Get("name"),
+		},
+		expiresAt: time.Now().Add(codeTTL),
+	}
+	p.lock.Unlock()
+
+	query.Set("code", code)
+	redirectUri.RawQuery = query.Encode()
+	http.Redirect(w, r, redirectUri.String(), http.StatusFound)
+}
+
+// handleToken redeems an authorization code for an ID token, after checking the client, the redirect URI and
+// the PKCE code verifier.
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		tokenError(w, "invalid_request", "invalid form")
+		return
+	}
+	form := r.PostForm
+	if form.Get("grant_type") != "authorization_code" {
+		tokenError(w, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	clientId, clientSecret, hasBasicAuth := r.BasicAuth()
+	if hasBasicAuth {
+		clientId, _ = url.QueryUnescape(clientId)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	} else {
+		clientId = form.Get("client_id")
+	}
+	if clientId != p.clientId || (p.clientSecret != "" && subtle.ConstantTimeCompare([]byte(clientSecret), []byte(p.clientSecret)) != 1) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mock-oidc"`)
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	p.lock.Lock()
+	auth, ok := p.codes[form.Get("code")]
+	delete(p.codes, form.Get("code"))
+	p.lock.Unlock()
+	if !ok || time.Now().After(auth.expiresAt) || auth.clientId != clientId || auth.redirectUri != form.Get("redirect_uri") {
+		tokenError(w, "invalid_grant", "unknown or expired code")
+		return
+	}
+	challenge := sha256.Sum256([]byte(form.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(challenge[:]) != auth.codeChallenge {
+		tokenError(w, "invalid_grant", "code verifier does not match code challenge")
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": p.issuer,
+		"aud": clientId,
+		"iat": now.Unix(),
+		"exp": now.Add(idTokenTTL).Unix(),
+	}
+	if auth.nonce != "" {
+		claims["nonce"] = auth.nonce
+	}
+	for name, value := range auth.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = keyId
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		log.Printf("Failed signing id token: %v", err)
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]any{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"expires_in":   int(idTokenTTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+// checkAuthorizationRequest checks the parameters of an authorization request.
+func (p *Provider) checkAuthorizationRequest(params url.Values) error {
+	if params.Get("response_type") != "code" {
+		return fmt.Errorf("unsupported response_type %q", params.Get("response_type"))
+	}
+	if params.Get("client_id") != p.clientId {
+		return fmt.Errorf("unknown client_id %q", params.Get("client_id"))
+	}
+	if redirectUri, err := url.Parse(params.Get("redirect_uri")); err != nil || !redirectUri.IsAbs() {
+		return fmt.Errorf("invalid redirect_uri %q", params.Get("redirect_uri"))
+	}
+	if params.Get("code_challenge") == "" || params.Get("code_challenge_method") != "S256" {
+		return fmt.Errorf("PKCE with code_challenge_method S256 is required")
+	}
+	return nil
+}
+
+// tokenError writes an error response of the token endpoint.
+func tokenError(w http.ResponseWriter, code, description string) {
+	writeJson(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": description})
+}
+
+// writeJson writes the value as JSON response with the status code.
+func writeJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Failed writing response: %v", err)
+	}
+}
+
+// randomString returns a random URL safe string.
+func randomString() string {
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		log.Fatalf("Failed generating random string: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(random)
+}
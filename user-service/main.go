@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"os"
 
+	"example.com/chat_app/identity"
+	"example.com/chat_app/user_service/client"
 	"example.com/chat_app/user_service/handler"
 	"example.com/chat_app/user_service/repository"
 	"example.com/chat_app/user_service/service"
@@ -25,42 +27,159 @@ func main() {
 
 	mongoClientOption := options.Client().ApplyURI(mongoUri)
 
-	client, err := mongo.Connect(context.TODO(), mongoClientOption)
+	mongoClient, err := mongo.Connect(context.TODO(), mongoClientOption)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer client.Disconnect(context.TODO())
+	defer mongoClient.Disconnect(context.TODO())
 
-	err = client.Ping(context.TODO(), nil)
+	err = mongoClient.Ping(context.TODO(), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	userRepo := repository.NewMongoUserRepository(client, "chatdb", "users")
+	userRepo := repository.NewMongoUserRepository(mongoClient, "chatdb", "users")
+	if err := userRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	if err := userRepo.MigrateEmailVerified(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	refreshTokenRepo := repository.NewMongoRefreshTokenRepository(mongoClient, "chatdb", "refreshtokens")
+	if err := refreshTokenRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	revocationRepo := repository.NewMongoRevocationRepository(mongoClient, "chatdb", "revocations")
+	if err := revocationRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	loginAttemptRepo := repository.NewMongoLoginAttemptRepository(mongoClient, "chatdb", "loginattempts")
+	if err := loginAttemptRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	auditRepo := repository.NewMongoAuditRepository(mongoClient, "chatdb", "auditevents")
+	if err := auditRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	oneTimeTokenRepo := repository.NewMongoOneTimeTokenRepository(mongoClient, "chatdb", "onetimetokens")
+	if err := oneTimeTokenRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	oidcStateRepo := repository.NewMongoOidcStateRepository(mongoClient, "chatdb", "oidcstates")
+	if err := oidcStateRepo.EnsureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
 
-	authService, err := service.NewJwtService()
+	keyRing, err := service.NewKeyRing()
+	if err != nil {
+		log.Fatalf("Failed loading signing keys: %v", err)
+	}
+
+	authService, err := service.NewJwtService(keyRing)
 	if err != nil {
 		log.Fatalf("Failed launching jwt sevice: %v", err)
 	}
-	userService := service.NewUserService(userRepo, authService)
 
-	userHandler := handler.NewUserHandler(userService)
+	identitySigner, err := identity.NewSigner("user-service")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mediaClient, err := client.NewMediaClient(identitySigner)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	urlSigner, err := identity.NewUrlSigner()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sessionService, err := service.NewSessionService(refreshTokenRepo, revocationRepo, userRepo, authService)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mailer, err := service.NewMailer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verificationService, err := service.NewVerificationService(oneTimeTokenRepo, userRepo, mailer)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	router := initializeRoutes(userHandler) // configure routes
+	passwordService, err := service.NewPasswordService(userRepo, oneTimeTokenRepo, sessionService, mailer)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	loginGuard, err := service.NewLoginGuard(loginAttemptRepo, auditRepo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mfaService, err := service.NewMfaService(userRepo, oneTimeTokenRepo, auditRepo, loginGuard)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	userService := service.NewUserService(userRepo, sessionService, verificationService, loginGuard, mfaService, mediaClient, urlSigner)
+
+	oidcService, err := service.NewOidcService(oidcStateRepo, oneTimeTokenRepo, userRepo)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	userHandler := handler.NewUserHandler(userService, sessionService, verificationService, passwordService, mfaService)
+	jwksHandler := handler.NewJwksHandler(keyRing)
+	var oidcHandler *handler.OidcHandler
+	if oidcService != nil {
+		oidcHandler = handler.NewOidcHandler(oidcService, userService)
+	} else {
+		log.Println("OIDC_ISSUER_URL not set, logins through an OpenID Connect provider are disabled")
+	}
+
+	router := initializeRoutes(userHandler, jwksHandler, oidcHandler) // configure routes
 
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%s", port),
-		Handler: router,
+		Handler: identity.Middleware(identitySigner, router),
 	}
 
 	log.Printf("User Service listening on port %s...", port)
 	log.Fatal(server.ListenAndServe())
 }
 
-func initializeRoutes(u *handler.UserHandler) *http.ServeMux {
+func initializeRoutes(u *handler.UserHandler, j *handler.JwksHandler, o *handler.OidcHandler) *http.ServeMux {
 	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/jwks.json", j.HandleJwks)
 	mux.HandleFunc("POST /auth/register", u.HandleRegister)
 	mux.HandleFunc("POST /auth/login", u.HandleLogin)
+	mux.HandleFunc("POST /auth/refresh", u.HandleRefresh)
+	mux.HandleFunc("POST /auth/logout", u.HandleLogout)
+	mux.HandleFunc("POST /auth/verify", u.HandleVerifyEmail)
+	mux.HandleFunc("POST /auth/password/forgot", u.HandleForgotPassword)
+	mux.HandleFunc("POST /auth/password/reset", u.HandleResetPassword)
+	mux.HandleFunc("POST /auth/mfa/verify", u.HandleMfaVerify)
 	mux.HandleFunc("GET /users/me", u.HandleMe)
+	mux.HandleFunc("GET /users/search", u.HandleSearchUsers)
+	mux.HandleFunc("POST /users/batch", u.HandleBatchUsers)
+	mux.HandleFunc("DELETE /users/me/sessions", u.HandleRevokeSessions)
+	mux.HandleFunc("POST /users/me/verification", u.HandleResendVerification)
+	mux.HandleFunc("PUT /users/me/password", u.HandleChangePassword)
+	mux.HandleFunc("PUT /users/me/avatar", u.HandleSetAvatar)
+	mux.HandleFunc("DELETE /users/me/avatar", u.HandleRemoveAvatar)
+	mux.HandleFunc("POST /users/me/mfa/enroll", u.HandleMfaEnroll)
+	mux.HandleFunc("POST /users/me/mfa/confirm", u.HandleMfaConfirm)
+	mux.HandleFunc("DELETE /users/me/mfa", u.HandleMfaDisable)
+	mux.HandleFunc("DELETE /users/{userId}/mfa", u.HandleMfaReset)
+	mux.HandleFunc("GET /internal/revocations", u.HandleRevocations)
+	if o != nil {
+		mux.HandleFunc("GET /auth/oidc/login", o.HandleLogin)
+		mux.HandleFunc("GET /auth/oidc/callback", o.HandleCallback)
+		mux.HandleFunc("POST /auth/oidc/token", o.HandleToken)
+	}
 	return mux
 }
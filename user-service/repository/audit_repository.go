@@ -0,0 +1,39 @@
+package repository
+
+import (
+	"context"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoAuditRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoAuditRepository creates a new MongoAuditRepository.
+func NewMongoAuditRepository(client *mongo.Client, dbName, collectionName string) *MongoAuditRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoAuditRepository{collection: collection}
+}
+
+// EnsureIndexes creates the indexes to list the events of a user and of a type, newest first.
+func (repo *MongoAuditRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "username", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "type", Value: 1}, {Key: "createdAt", Value: -1}},
+		},
+	})
+	return err
+}
+
+// Save stores an audit event in the repository.
+func (repo *MongoAuditRepository) Save(ctx context.Context, event *structs.AuditEventEntity) error {
+	_, err := repo.collection.InsertOne(ctx, event)
+	return err
+}
@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoLoginAttemptRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoLoginAttemptRepository creates a new MongoLoginAttemptRepository.
+func NewMongoLoginAttemptRepository(client *mongo.Client, dbName, collectionName string) *MongoLoginAttemptRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoLoginAttemptRepository{collection: collection}
+}
+
+// EnsureIndexes creates the unique index on the key and a TTL index that lets MongoDB remove expired counts.
+func (repo *MongoLoginAttemptRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Get retrieves the failed login count for the key.
+func (repo *MongoLoginAttemptRepository) Get(ctx context.Context, key string) (*structs.LoginAttemptEntity, error) {
+	return getByKey[structs.LoginAttemptEntity](ctx, "key", key, repo.collection)
+}
+
+// RecordFailure increments the failed login count for the key and returns the updated count.
+// A count that has expired starts over at one. The increment is atomic, so concurrent failures are all counted.
+func (repo *MongoLoginAttemptRepository) RecordFailure(ctx context.Context, key string, failedAt, expiresAt time.Time) (*structs.LoginAttemptEntity, error) {
+	filter := bson.M{"key": key}
+	// The expressions of a pipeline stage see the document before the update. The TTL monitor only runs once a
+	// minute, so expired counts may still be there.
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.M{
+		"key": key,
+		"failures": bson.M{"$cond": bson.A{
+			bson.M{"$gt": bson.A{"$expiresAt", failedAt}},
+			bson.M{"$add": bson.A{"$failures", 1}},
+			1,
+		}},
+		"lastFailureAt": failedAt,
+		"expiresAt":     expiresAt,
+	}}}}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var attempt structs.LoginAttemptEntity
+	if err := repo.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&attempt); err != nil {
+		return nil, err
+	}
+	return &attempt, nil
+}
+
+// Reset removes the failed login count for the key.
+func (repo *MongoLoginAttemptRepository) Reset(ctx context.Context, key string) error {
+	_, err := repo.collection.DeleteOne(ctx, bson.M{"key": key})
+	return err
+}
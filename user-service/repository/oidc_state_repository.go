@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoOidcStateRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoOidcStateRepository creates a new MongoOidcStateRepository.
+func NewMongoOidcStateRepository(client *mongo.Client, dbName, collectionName string) *MongoOidcStateRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoOidcStateRepository{collection: collection}
+}
+
+// EnsureIndexes creates the unique index on the state hash and a TTL index that lets MongoDB remove logins that
+// were never finished.
+func (repo *MongoOidcStateRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "stateHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Save stores a started login in the repository.
+func (repo *MongoOidcStateRepository) Save(ctx context.Context, state *structs.OidcStateEntity) error {
+	_, err := repo.collection.InsertOne(ctx, state)
+	return err
+}
+
+// Consume deletes the unexpired login with the state hash and returns it, so that every state is used only once.
+// It returns mongo.ErrNoDocuments if there is no such login.
+func (repo *MongoOidcStateRepository) Consume(ctx context.Context, stateHash string, now time.Time) (*structs.OidcStateEntity, error) {
+	filter := bson.M{"stateHash": stateHash, "expiresAt": bson.M{"$gt": now}}
+	var state structs.OidcStateEntity
+	if err := repo.collection.FindOneAndDelete(ctx, filter).Decode(&state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
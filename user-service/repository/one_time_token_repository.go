@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoOneTimeTokenRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoOneTimeTokenRepository creates a new MongoOneTimeTokenRepository.
+func NewMongoOneTimeTokenRepository(client *mongo.Client, dbName, collectionName string) *MongoOneTimeTokenRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoOneTimeTokenRepository{collection: collection}
+}
+
+// EnsureIndexes creates the unique index on the token hash, the index to invalidate the tokens of a user, and a
+// TTL index that lets MongoDB remove expired tokens.
+func (repo *MongoOneTimeTokenRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Save stores a one-time token in the repository.
+func (repo *MongoOneTimeTokenRepository) Save(ctx context.Context, token *structs.OneTimeTokenEntity) error {
+	_, err := repo.collection.InsertOne(ctx, token)
+	return err
+}
+
+// GetByHash retrieves the unused, unexpired token with the hash and purpose.
+// It returns mongo.ErrNoDocuments if there is no such token.
+func (repo *MongoOneTimeTokenRepository) GetByHash(ctx context.Context, tokenHash, purpose string, now time.Time) (*structs.OneTimeTokenEntity, error) {
+	filter := bson.M{
+		"tokenHash": tokenHash,
+		"purpose":   purpose,
+		"usedAt":    bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": now},
+	}
+	var token structs.OneTimeTokenEntity
+	if err := repo.collection.FindOne(ctx, filter).Decode(&token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// Consume marks the unused, unexpired token with the hash and purpose as used and returns it.
+// The token is looked up and marked in one operation, so that of two concurrent uses only one succeeds.
+// It returns mongo.ErrNoDocuments if there is no such token.
+func (repo *MongoOneTimeTokenRepository) Consume(ctx context.Context, tokenHash, purpose string, usedAt time.Time) (*structs.OneTimeTokenEntity, error) {
+	filter := bson.M{
+		"tokenHash": tokenHash,
+		"purpose":   purpose,
+		"usedAt":    bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": usedAt},
+	}
+	update := bson.M{"$set": bson.M{"usedAt": usedAt}}
+	var token structs.OneTimeTokenEntity
+	err := repo.collection.FindOneAndUpdate(ctx, filter, update).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+// DeleteForUser deletes all tokens of a user issued for the purpose.
+func (repo *MongoOneTimeTokenRepository) DeleteForUser(ctx context.Context, userId, purpose string) error {
+	_, err := repo.collection.DeleteMany(ctx, bson.M{"userId": userId, "purpose": purpose})
+	return err
+}
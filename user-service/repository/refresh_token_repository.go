@@ -0,0 +1,111 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoRefreshTokenRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRefreshTokenRepository creates a new MongoRefreshTokenRepository.
+func NewMongoRefreshTokenRepository(client *mongo.Client, dbName, collectionName string) *MongoRefreshTokenRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoRefreshTokenRepository{collection: collection}
+}
+
+// EnsureIndexes creates the unique index on the token hash, the indexes to revoke token families and all tokens
+// of a user, and a TTL index that lets MongoDB remove expired refresh tokens.
+func (repo *MongoRefreshTokenRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "familyId", Value: 1}},
+		},
+		{
+			Keys: bson.D{{Key: "userId", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Save stores a refresh token in the repository.
+func (repo *MongoRefreshTokenRepository) Save(ctx context.Context, token *structs.RefreshTokenEntity) error {
+	_, err := repo.collection.InsertOne(ctx, token)
+	return err
+}
+
+// GetByHash retrieves a refresh token by the hash of the token.
+func (repo *MongoRefreshTokenRepository) GetByHash(ctx context.Context, tokenHash string) (*structs.RefreshTokenEntity, error) {
+	return getByKey[structs.RefreshTokenEntity](ctx, "tokenHash", tokenHash, repo.collection)
+}
+
+// MarkRotated marks a refresh token as rotated unless it already was rotated or revoked.
+// It reports whether the token was marked, so that of two concurrent refreshes with the same token only one wins.
+func (repo *MongoRefreshTokenRepository) MarkRotated(ctx context.Context, id string, rotatedAt time.Time) (bool, error) {
+	filter := bson.M{
+		"id":        id,
+		"rotatedAt": bson.M{"$exists": false},
+		"revokedAt": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"rotatedAt": rotatedAt}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// GetFamily retrieves all refresh tokens of a token family.
+func (repo *MongoRefreshTokenRepository) GetFamily(ctx context.Context, familyId string) ([]structs.RefreshTokenEntity, error) {
+	return repo.find(ctx, bson.M{"familyId": familyId})
+}
+
+// RevokeFamily revokes all refresh tokens of a token family that are not revoked yet.
+func (repo *MongoRefreshTokenRepository) RevokeFamily(ctx context.Context, familyId string, revokedAt time.Time) error {
+	filter := bson.M{
+		"familyId":  familyId,
+		"revokedAt": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revokedAt": revokedAt}}
+	_, err := repo.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// RevokeUser revokes all refresh tokens of a user that are not revoked yet.
+func (repo *MongoRefreshTokenRepository) RevokeUser(ctx context.Context, userId string, revokedAt time.Time) error {
+	filter := bson.M{
+		"userId":    userId,
+		"revokedAt": bson.M{"$exists": false},
+	}
+	update := bson.M{"$set": bson.M{"revokedAt": revokedAt}}
+	_, err := repo.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
+// find returns all refresh tokens matching the filter.
+func (repo *MongoRefreshTokenRepository) find(ctx context.Context, filter bson.M) ([]structs.RefreshTokenEntity, error) {
+	cursor, err := repo.collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []structs.RefreshTokenEntity
+	if err := cursor.All(ctx, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
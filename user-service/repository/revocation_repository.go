@@ -0,0 +1,61 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoRevocationRepository struct {
+	collection *mongo.Collection
+}
+
+// NewMongoRevocationRepository creates a new MongoRevocationRepository.
+func NewMongoRevocationRepository(client *mongo.Client, dbName, collectionName string) *MongoRevocationRepository {
+	collection := client.Database(dbName).Collection(collectionName)
+	return &MongoRevocationRepository{collection: collection}
+}
+
+// EnsureIndexes creates the index to list revocations by time and a TTL index that lets MongoDB remove
+// revocations once the tokens they revoke have expired.
+func (repo *MongoRevocationRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "revokedAt", Value: 1}},
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// Save stores a revocation in the repository.
+func (repo *MongoRevocationRepository) Save(ctx context.Context, revocation *structs.RevocationEntity) error {
+	_, err := repo.collection.InsertOne(ctx, revocation)
+	return err
+}
+
+// GetSince retrieves the revocations made at or after the given time that have not expired yet, oldest first.
+func (repo *MongoRevocationRepository) GetSince(ctx context.Context, since time.Time) ([]structs.RevocationEntity, error) {
+	filter := bson.M{
+		"revokedAt": bson.M{"$gte": since},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "revokedAt", Value: 1}})
+	cursor, err := repo.collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	revocations := make([]structs.RevocationEntity, 0)
+	if err := cursor.All(ctx, &revocations); err != nil {
+		return nil, err
+	}
+	return revocations, nil
+}
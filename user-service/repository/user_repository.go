@@ -2,11 +2,13 @@ package repository
 
 import (
 	"context"
+	"regexp"
 
 	"example.com/chat_app/user_service/structs"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type MongoUserRepository struct {
@@ -19,6 +21,16 @@ func NewMongoUserRepository(client *mongo.Client, dbName, collectionName string)
 	return &MongoUserRepository{collection: collection}
 }
 
+// EnsureIndexes creates the indexes to look up users by ID and to search them by username and display name.
+func (repo *MongoUserRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := repo.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}},
+		{Keys: bson.D{{Key: "username", Value: 1}}},
+		{Keys: bson.D{{Key: "displayName", Value: 1}}},
+	})
+	return err
+}
+
 // GetById retrieves a user by their ID.
 func (repo *MongoUserRepository) GetById(ctx context.Context, id string) (*structs.UserEntity, error) {
 	return getByKey[structs.UserEntity](ctx, "id", id, repo.collection)
@@ -38,6 +50,169 @@ func (repo *MongoUserRepository) Save(ctx context.Context, user *structs.UserEnt
 	return nil
 }
 
+// GetByIdentity retrieves the user the account at an OpenID Connect provider is linked to.
+func (repo *MongoUserRepository) GetByIdentity(ctx context.Context, issuer, subject string) (*structs.UserEntity, error) {
+	var user structs.UserEntity
+	filter := bson.M{"identities": bson.M{"$elemMatch": bson.M{"issuer": issuer, "subject": subject}}}
+	if err := repo.collection.FindOne(ctx, filter).Decode(&user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// AddIdentity links the account at an OpenID Connect provider to a user.
+func (repo *MongoUserRepository) AddIdentity(ctx context.Context, userId string, identity structs.ExternalIdentity) error {
+	filter := bson.M{"id": userId}
+	update := bson.M{"$push": bson.M{"identities": identity}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// ListByIds retrieves the users with the IDs. IDs without a user are left out.
+func (repo *MongoUserRepository) ListByIds(ctx context.Context, ids []string) ([]structs.UserEntity, error) {
+	cursor, err := repo.collection.Find(ctx, bson.M{"id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	users := make([]structs.UserEntity, 0, len(ids))
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Search retrieves a page of the users whose username or display name starts with the query, ignoring case,
+// ordered by username.
+func (repo *MongoUserRepository) Search(ctx context.Context, filter structs.UserFilter) ([]structs.UserEntity, error) {
+	prefix := caseInsensitiveRegex("^" + regexp.QuoteMeta(filter.Query))
+	query := bson.M{"$or": bson.A{
+		bson.M{"username": prefix},
+		bson.M{"displayName": prefix},
+	}}
+	if filter.After != "" {
+		query = bson.M{"$and": bson.A{query, bson.M{"username": bson.M{"$gt": filter.After}}}}
+	}
+	opts := options.Find().SetSort(bson.D{{Key: "username", Value: 1}}).SetLimit(filter.Limit)
+	cursor, err := repo.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]structs.UserEntity, 0)
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// ListByEmail retrieves all users with the email address. Email addresses are not unique, so there may be several.
+func (repo *MongoUserRepository) ListByEmail(ctx context.Context, email string) ([]structs.UserEntity, error) {
+	cursor, err := repo.collection.Find(ctx, bson.M{"email": email})
+	if err != nil {
+		return nil, err
+	}
+	var users []structs.UserEntity
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SetPassword sets the password hash of a user.
+func (repo *MongoUserRepository) SetPassword(ctx context.Context, userId, passwordHash string) error {
+	filter := bson.M{"id": userId}
+	update := bson.M{"$set": bson.M{"password": passwordHash}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// SetMfa sets the second factor of a user, or removes it if mfa is nil.
+func (repo *MongoUserRepository) SetMfa(ctx context.Context, userId string, mfa *structs.MfaEntity) error {
+	filter := bson.M{"id": userId}
+	update := bson.M{"$set": bson.M{"mfa": mfa}}
+	if mfa == nil {
+		update = bson.M{"$unset": bson.M{"mfa": ""}}
+	}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// UseMfaStep records the time step of an accepted TOTP code, unless a code of the same or a later step was used
+// before. It reports whether the step was recorded, so that of two logins with the same code only one succeeds.
+func (repo *MongoUserRepository) UseMfaStep(ctx context.Context, userId string, step int64) (bool, error) {
+	filter := bson.M{"id": userId, "mfa.lastUsedStep": bson.M{"$lt": step}}
+	update := bson.M{"$set": bson.M{"mfa.lastUsedStep": step}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// UseRecoveryCode removes the recovery code with the hash from the second factor of a user.
+// It reports whether the code was there, so that a recovery code can only be used once.
+func (repo *MongoUserRepository) UseRecoveryCode(ctx context.Context, userId, codeHash string) (bool, error) {
+	filter := bson.M{"id": userId, "mfa.recoveryCodes": codeHash}
+	update := bson.M{"$pull": bson.M{"mfa.recoveryCodes": codeHash}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// SetAvatar sets the avatar of a user, or removes it if avatar is nil.
+func (repo *MongoUserRepository) SetAvatar(ctx context.Context, userId string, avatar *structs.MediaFile) error {
+	filter := bson.M{"id": userId}
+	update := bson.M{"$set": bson.M{"avatar": avatar}}
+	if avatar == nil {
+		update = bson.M{"$unset": bson.M{"avatar": ""}}
+	}
+	_, err := repo.collection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+// SetEmailVerified marks the email address of a user as verified, provided it is still the given one.
+func (repo *MongoUserRepository) SetEmailVerified(ctx context.Context, userId, email string) error {
+	filter := bson.M{"id": userId, "email": email}
+	update := bson.M{"$set": bson.M{"emailVerified": true}, "$unset": bson.M{"emailUnconfirmed": ""}}
+	result, err := repo.collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+	return nil
+}
+
+// MigrateEmailVerified marks the users registered before email verification was introduced as verified, so that
+// the policy for unverified users does not lock them out. As they never proved to own their email address, they
+// are also marked as unconfirmed until they verify it. Users registered since then always have the field.
+func (repo *MongoUserRepository) MigrateEmailVerified(ctx context.Context) error {
+	filter := bson.M{"emailVerified": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"emailVerified": true, "emailUnconfirmed": true}}
+	_, err := repo.collection.UpdateMany(ctx, filter, update)
+	return err
+}
+
 // GetByKey filters the collection by the given key and returns the result.
 func getByKey[T, V any](ctx context.Context, key string, value V, collection *mongo.Collection) (*T, error) {
 	var entity T
@@ -48,3 +223,8 @@ func getByKey[T, V any](ctx context.Context, key string, value V, collection *mo
 	}
 	return &entity, nil
 }
+
+// caseInsensitiveRegex returns a case-insensitive regular expression filter for the pattern.
+func caseInsensitiveRegex(pattern string) bson.M {
+	return bson.M{"$regex": pattern, "$options": "i"}
+}
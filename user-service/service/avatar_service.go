@@ -0,0 +1,114 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/chat_app/user_service/client"
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrUnsupportedMedia is returned when an avatar is not an image in a supported format.
+	ErrUnsupportedMedia = client.ErrUnsupportedMedia
+	// ErrMediaTooLarge is returned when an avatar exceeds the allowed size or dimensions.
+	ErrMediaTooLarge = client.ErrMediaTooLarge
+	// ErrMediaInfected is returned when malware was found in an avatar.
+	ErrMediaInfected = client.ErrMediaInfected
+)
+
+// thumbVariant is the name of the resized variant media service generates for thumbnails.
+const thumbVariant = "thumb"
+
+// MediaClient is an interface for storing avatars in the media service.
+type MediaClient interface {
+	UploadAvatar(ctx context.Context, image []byte) (*client.BlobMetadata, error)
+	DeleteAvatar(ctx context.Context, blobId string) error
+}
+
+// SetAvatar uploads an image through the media service and makes it the avatar of the user.
+// The previous avatar, if any, is deleted from the media service.
+func (s *UserService) SetAvatar(ctx context.Context, userId string, image []byte) (*structs.UserDto, error) {
+	user, err := s.GetUserById(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := s.media.UploadAvatar(ctx, image)
+	if err != nil {
+		return nil, err
+	}
+	avatar := &structs.MediaFile{
+		Id:          uuid.New().String(),
+		Type:        client.AvatarContainer,
+		BlobId:      blob.BlobId,
+		Size:        blob.Size,
+		ContentType: blob.ContentType,
+		CreatedAt:   time.Now(),
+	}
+	if err := s.repo.SetAvatar(ctx, userId, avatar); err != nil {
+		if deleteErr := s.media.DeleteAvatar(ctx, blob.BlobId); deleteErr != nil {
+			log.Printf("Failed deleting avatar blob %s after failed update: %v", blob.BlobId, deleteErr)
+		}
+		return nil, err
+	}
+	s.deletePreviousAvatar(ctx, user.Avatar)
+	user.Avatar = avatar
+	return s.mapUser(user), nil
+}
+
+// RemoveAvatar removes the avatar of the user and deletes it from the media service.
+func (s *UserService) RemoveAvatar(ctx context.Context, userId string) (*structs.UserDto, error) {
+	user, err := s.GetUserById(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetAvatar(ctx, userId, nil); err != nil {
+		return nil, err
+	}
+	s.deletePreviousAvatar(ctx, user.Avatar)
+	user.Avatar = nil
+	return s.mapUser(user), nil
+}
+
+// deletePreviousAvatar releases the blob of a replaced avatar. Failures are only logged, as the user
+// already references the new avatar.
+func (s *UserService) deletePreviousAvatar(ctx context.Context, avatar *structs.MediaFile) {
+	if avatar == nil {
+		return
+	}
+	if err := s.media.DeleteAvatar(ctx, avatar.BlobId); err != nil {
+		log.Printf("Failed deleting previous avatar blob %s: %v", avatar.BlobId, err)
+	}
+}
+
+// mapUser maps a user to its DTO, with the avatar URLs signed for the user.
+func (s *UserService) mapUser(user *structs.UserEntity) *structs.UserDto {
+	userDto := MapUserEntityToDto(user)
+	userDto.Avatar = s.signAvatar(user.Avatar, user.Id)
+	return userDto
+}
+
+// mapPublicUser maps a user to the profile shown to other users, with the avatar URLs signed for the viewer.
+func (s *UserService) mapPublicUser(user *structs.UserEntity, viewerId string) *structs.PublicUserDto {
+	userDto := MapUserEntityToPublicDto(user)
+	userDto.Avatar = s.signAvatar(user.Avatar, viewerId)
+	return userDto
+}
+
+// signAvatar returns the signed URLs of an avatar image and its thumbnail for the user, or nil if there is no
+// avatar.
+func (s *UserService) signAvatar(avatar *structs.MediaFile, userId string) *structs.AvatarDto {
+	if avatar == nil {
+		return nil
+	}
+	url, expiresAt := s.signer.SignMediaUrl(avatar.Type, avatar.BlobId, "", userId)
+	thumbUrl, _ := s.signer.SignMediaUrl(avatar.Type, avatar.BlobId, thumbVariant, userId)
+	return &structs.AvatarDto{
+		MediaId:   avatar.Id,
+		Url:       url,
+		ThumbUrl:  thumbUrl,
+		ExpiresAt: expiresAt,
+	}
+}
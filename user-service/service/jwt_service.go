@@ -1,82 +1,117 @@
 package service
 
 import (
-	"crypto/rsa"
-	"errors"
 	"fmt"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultAccessTokenTTL is the lifetime of access tokens used when ACCESS_TOKEN_EXP_MINUTES is not set.
+	defaultAccessTokenTTL = 15 * time.Minute
+	// defaultIssuer is the iss claim of tokens used when JWT_ISSUER is not set.
+	defaultIssuer = "user-service"
+)
+
+// Every token is issued for exactly one audience, so that a token minted for one purpose can not be replayed
+// for another. Services do not present tokens to each other; they authenticate the requests they forward with
+// identity assertions instead.
+const (
+	// AudienceApi is the audience of access tokens for the HTTP API.
+	AudienceApi = "chat-app-api"
+	// AudienceAccount is the audience of access tokens that are only valid for managing the user's own account.
+	// They are issued to users who did not verify their email address under the restrict policy.
+	AudienceAccount = "chat-app-account"
 )
 
 // JwtService represents a JWT service.
 type JwtService struct {
-	expirationTimeHs int
-	privateKey       *rsa.PrivateKey
-	publicKey        *rsa.PublicKey
+	accessTokenTTL time.Duration
+	issuer         string
+	keys           *KeyRing
 }
 
 // NewJwtService creates a new instance of JwtService.
-// It initializes the JwtService with the expiration time, private key, and public key.
-// The expiration time is read from the TOKEN_EXPIRATION_HS environment variable.
-// The private key is read from the RSA_PRIVATE_KEY environment variable.
-// The public key is read from the RSA_PUBLIC_KEY environment variable.
-func NewJwtService() (*JwtService, error) {
-	// Read the expiration time from the environment variable
-	expirationTimeString := os.Getenv("TOKEN_EXP_HS")
-	if expirationTimeString == "" {
-		return nil, errors.New("TOKEN_EXP_HS env variable not set")
-	}
-
-	// Parse the expiration time from string to integer
-	expirationTimeHs, err := strconv.Atoi(expirationTimeString)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse TOKEN_EXP_HS: %v", err)
+// It initializes the JwtService with the access token lifetime and the KeyRing tokens are signed with.
+// The lifetime is read from the ACCESS_TOKEN_EXP_MINUTES environment variable. Access tokens are short-lived;
+// sessions are kept alive with refresh tokens. The iss claim is read from JWT_ISSUER.
+func NewJwtService(keys *KeyRing) (*JwtService, error) {
+	accessTokenTTL := defaultAccessTokenTTL
+	if ttlString := os.Getenv("ACCESS_TOKEN_EXP_MINUTES"); ttlString != "" {
+		minutes, err := strconv.Atoi(ttlString)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("invalid ACCESS_TOKEN_EXP_MINUTES: %q", ttlString)
+		}
+		accessTokenTTL = time.Duration(minutes) * time.Minute
 	}
 
-	// Get the RSA private key
-	privateKey, err := getRsaPrivateKey()
-	if err != nil {
-		return nil, fmt.Errorf("failed getting rsa private key %v", err)
+	issuer := os.Getenv("JWT_ISSUER")
+	if issuer == "" {
+		issuer = defaultIssuer
 	}
 
 	return &JwtService{
-		expirationTimeHs: expirationTimeHs,
-		privateKey:       privateKey,
+		accessTokenTTL: accessTokenTTL,
+		issuer:         issuer,
+		keys:           keys,
 	}, nil
 }
 
-// GenerateToken generates a JWT token for the given user ID and username.
-// It uses the RSA private key to sign the token.
-// The expiration time of the token is set based on the expiration time in hours.
-func (s *JwtService) GenerateToken(userId string, username string) (string, error) {
+// AccessToken is a signed JWT access token together with the claims needed to revoke it.
+type AccessToken struct {
+	Token     string
+	Id        string
+	ExpiresAt time.Time
+}
+
+// GenerateToken generates a JWT access token for the HTTP API for the given user ID and username.
+// The token expires after the access token lifetime.
+func (s *JwtService) GenerateToken(userId string, username string) (*AccessToken, error) {
+	return s.generateToken(userId, username, AudienceApi, s.accessTokenTTL)
+}
+
+// GenerateAccountToken generates a JWT access token that is only valid for the account endpoints of user service.
+// The token expires after the access token lifetime.
+func (s *JwtService) GenerateAccountToken(userId string, username string) (*AccessToken, error) {
+	return s.generateToken(userId, username, AudienceAccount, s.accessTokenTTL)
+}
+
+// generateToken generates a JWT for the audience that is valid from now on for the given lifetime.
+// It signs the token with the active key of the KeyRing. The token carries a unique ID in the jti claim,
+// by which it can be revoked before it expires. The iat claim has a precision of milliseconds, so that tokens issued
+// right after the sessions of the user were revoked are told apart from the revoked ones issued in the same second.
+func (s *JwtService) generateToken(userId, username, audience string, ttl time.Duration) (*AccessToken, error) {
+	now := time.Now()
+	accessToken := &AccessToken{
+		Id:        uuid.New().String(),
+		ExpiresAt: now.Add(ttl),
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      s.issuer,
+		"aud":      audience,
+		"sub":      userId,
+		"jti":      accessToken.Id,
 		"userId":   userId,
 		"username": username,
-		"exp":      jwt.NewNumericDate(time.Now().Add(time.Hour * time.Duration(s.expirationTimeHs))),
+		"iat":      float64(now.UnixMilli()) / 1000,
+		"nbf":      jwt.NewNumericDate(now),
+		"exp":      jwt.NewNumericDate(accessToken.ExpiresAt),
 	})
 
-	tokenString, err := token.SignedString(s.privateKey)
+	tokenString, err := s.keys.sign(token)
 	if err != nil {
-		return "", fmt.Errorf("failed to sign token: %v", err)
+		return nil, fmt.Errorf("failed to sign token: %v", err)
 	}
+	accessToken.Token = tokenString
 
-	return tokenString, nil
+	return accessToken, nil
 }
 
-// getRsaPrivateKey reads the RSA private key from the environment variable.
-// It parses the RSA private key and returns the parsed private key.
-func getRsaPrivateKey() (*rsa.PrivateKey, error) {
-	pemData, err := os.ReadFile("private_key.pem")
-	if err != nil {
-		return nil, fmt.Errorf("error reading rsa private key: %w", err)
-	}
-
-	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse RSA private key: %v", err)
-	}
-	return privateKey, nil
+// AccessTokenTTL returns the lifetime of the access tokens generated by the service.
+func (s *JwtService) AccessTokenTTL() time.Duration {
+	return s.accessTokenTTL
 }
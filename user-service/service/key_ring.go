@@ -0,0 +1,124 @@
+package service
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is an RSA private key of the KeyRing with the ID it is published under.
+type signingKey struct {
+	kid        string
+	privateKey *rsa.PrivateKey
+}
+
+// Jwk is an RSA public key in JSON Web Key format.
+type Jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Jwks is a JSON Web Key Set.
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// KeyRing holds the RSA keys tokens are signed with. One key is active and signs new tokens; the public keys of
+// all keys are published as a JWKS, so that verifiers pick the key by the kid header of a token.
+//
+// To rotate keys without downtime, the new key is added to the ring first and activated only after verifiers
+// have fetched the JWKS. The old key is removed once the tokens signed with it have expired.
+type KeyRing struct {
+	keys   []signingKey
+	active *signingKey
+}
+
+// NewKeyRing creates a new KeyRing.
+// The keys are read from the JWT_SIGNING_KEYS environment variable as a comma separated list of "kid:path" pairs
+// naming PEM encoded RSA private keys, and JWT_ACTIVE_KID selects the key that signs new tokens. Both must be set,
+// as no key is built into the image.
+func NewKeyRing() (*KeyRing, error) {
+	ring := &KeyRing{}
+	keysString := os.Getenv("JWT_SIGNING_KEYS")
+	if keysString == "" {
+		return nil, fmt.Errorf("JWT_SIGNING_KEYS environment variable not set")
+	}
+	activeKid := os.Getenv("JWT_ACTIVE_KID")
+	if activeKid == "" {
+		return nil, fmt.Errorf("JWT_ACTIVE_KID environment variable not set")
+	}
+	for _, entry := range strings.Split(keysString, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, path, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" || path == "" {
+			return nil, fmt.Errorf("invalid signing key entry %q, expected kid:path", entry)
+		}
+		privateKey, err := readRsaPrivateKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading signing key %q: %w", kid, err)
+		}
+		ring.keys = append(ring.keys, signingKey{kid: kid, privateKey: privateKey})
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("JWT_SIGNING_KEYS contains no keys")
+	}
+
+	for i := range ring.keys {
+		if ring.keys[i].kid == activeKid {
+			ring.active = &ring.keys[i]
+		}
+	}
+	if ring.active == nil {
+		return nil, fmt.Errorf("JWT_ACTIVE_KID %q is not in JWT_SIGNING_KEYS", activeKid)
+	}
+	return ring, nil
+}
+
+// Jwks returns the public keys of the ring as a JSON Web Key Set.
+func (r *KeyRing) Jwks() *Jwks {
+	jwks := &Jwks{Keys: make([]Jwk, 0, len(r.keys))}
+	for _, key := range r.keys {
+		publicKey := &key.privateKey.PublicKey
+		jwks.Keys = append(jwks.Keys, Jwk{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: key.kid,
+			N:   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		})
+	}
+	return jwks
+}
+
+// sign signs the token with the active key and sets its kid header.
+func (r *KeyRing) sign(token *jwt.Token) (string, error) {
+	token.Header["kid"] = r.active.kid
+	return token.SignedString(r.active.privateKey)
+}
+
+// readRsaPrivateKey reads a PEM encoded RSA private key from a file.
+func readRsaPrivateKey(path string) (*rsa.PrivateKey, error) {
+	pemData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading rsa private key: %w", err)
+	}
+
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA private key: %v", err)
+	}
+	return privateKey, nil
+}
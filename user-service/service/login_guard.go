@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// defaultMaxAccountFailures is the number of failed logins after which an account is locked, used when
+	// LOGIN_MAX_FAILURES is not set.
+	defaultMaxAccountFailures = 5
+	// defaultMaxIpFailures is the number of failed logins after which a client IP address is locked, used when
+	// LOGIN_MAX_FAILURES_PER_IP is not set. It is higher than the one of accounts, as many users may share an address.
+	defaultMaxIpFailures = 50
+	// lockoutBase is the duration of the first lockout. Every further failure doubles it.
+	lockoutBase = 30 * time.Second
+	// lockoutMax caps the duration of a lockout.
+	lockoutMax = 15 * time.Minute
+	// loginAttemptWindow is the time after the last failed login after which the count starts over.
+	loginAttemptWindow = time.Hour
+)
+
+// Audit event types recorded by the LoginGuard.
+const (
+	AuditAccountLocked = "login.account_locked"
+	AuditIpLocked      = "login.ip_locked"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a login fails, without telling whether the user does not exist or
+	// the password is incorrect.
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrLoginLocked is wrapped by LoginLockedError.
+	ErrLoginLocked = errors.New("too many failed login attempts")
+)
+
+// LoginLockedError is returned when a login is refused because the account or the client IP address is locked
+// after too many failed logins.
+type LoginLockedError struct {
+	// RetryAfter is the time until the lock ends.
+	RetryAfter time.Duration
+}
+
+func (e *LoginLockedError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrLoginLocked, e.RetryAfter)
+}
+
+func (e *LoginLockedError) Unwrap() error {
+	return ErrLoginLocked
+}
+
+// LoginAttemptRepository defines the interface for storage of failed login counts.
+type LoginAttemptRepository interface {
+	// Get retrieves the failed login count for the key.
+	Get(ctx context.Context, key string) (*structs.LoginAttemptEntity, error)
+	// RecordFailure increments the failed login count for the key and returns the updated count.
+	RecordFailure(ctx context.Context, key string, failedAt, expiresAt time.Time) (*structs.LoginAttemptEntity, error)
+	// Reset removes the failed login count for the key.
+	Reset(ctx context.Context, key string) error
+}
+
+// AuditRepository defines the interface for audit event storage.
+type AuditRepository interface {
+	// Save stores an audit event in the repository.
+	Save(ctx context.Context, event *structs.AuditEventEntity) error
+}
+
+// LoginGuard protects logins against password guessing.
+// It counts failed logins per account and per client IP address. Once a count reaches its limit, further logins
+// are refused for a lockout that starts at 30 seconds and doubles with every further failure, up to 15 minutes.
+// Failed logins for usernames that do not exist are counted like any other, so that lockouts do not tell which
+// accounts exist. Every lockout is recorded as an audit event.
+type LoginGuard struct {
+	attempts           LoginAttemptRepository
+	audit              AuditRepository
+	maxAccountFailures int
+	maxIpFailures      int
+}
+
+// NewLoginGuard creates a new LoginGuard.
+// The limits are read from the LOGIN_MAX_FAILURES and LOGIN_MAX_FAILURES_PER_IP environment variables.
+func NewLoginGuard(attempts LoginAttemptRepository, audit AuditRepository) (*LoginGuard, error) {
+	maxAccountFailures, err := readLimit("LOGIN_MAX_FAILURES", defaultMaxAccountFailures)
+	if err != nil {
+		return nil, err
+	}
+	maxIpFailures, err := readLimit("LOGIN_MAX_FAILURES_PER_IP", defaultMaxIpFailures)
+	if err != nil {
+		return nil, err
+	}
+	return &LoginGuard{
+		attempts:           attempts,
+		audit:              audit,
+		maxAccountFailures: maxAccountFailures,
+		maxIpFailures:      maxIpFailures,
+	}, nil
+}
+
+// Check returns a LoginLockedError if the account or the client IP address is locked.
+// The IP address is not checked if it is empty.
+func (g *LoginGuard) Check(ctx context.Context, username, ip string) error {
+	now := time.Now()
+	var retryAfter time.Duration
+	for key, max := range g.keys(username, ip) {
+		attempt, err := g.attempts.Get(ctx, key)
+		if err != nil {
+			if err == mongo.ErrNoDocuments {
+				continue
+			}
+			return err
+		}
+		if !attempt.ExpiresAt.After(now) {
+			continue
+		}
+		if wait := lockedUntil(attempt, max).Sub(now); wait > retryAfter {
+			retryAfter = wait
+		}
+	}
+	if retryAfter > 0 {
+		return &LoginLockedError{RetryAfter: retryAfter}
+	}
+	return nil
+}
+
+// RecordFailure counts a failed login for the account and the client IP address, and records an audit event for
+// every count that locks them. The user ID is empty if there is no user with the username.
+func (g *LoginGuard) RecordFailure(ctx context.Context, username, userId, ip string) error {
+	now := time.Now()
+	for key, max := range g.keys(username, ip) {
+		attempt, err := g.attempts.RecordFailure(ctx, key, now, now.Add(loginAttemptWindow))
+		if err != nil {
+			return err
+		}
+		if attempt.Failures < max {
+			continue
+		}
+
+		eventType := AuditAccountLocked
+		if key != accountKey(username) {
+			eventType = AuditIpLocked
+		}
+		until := lockedUntil(attempt, max)
+		log.Printf("Locked logins for %s after %d failures until %v", key, attempt.Failures, until)
+		err = g.audit.Save(ctx, &structs.AuditEventEntity{
+			Id:        uuid.New().String(),
+			Type:      eventType,
+			Username:  username,
+			UserId:    userId,
+			Ip:        ip,
+			Details:   fmt.Sprintf("%d failed logins, locked until %s", attempt.Failures, until.Format(time.RFC3339)),
+			CreatedAt: now,
+		})
+		if err != nil {
+			return fmt.Errorf("failed saving audit event: %w", err)
+		}
+	}
+	return nil
+}
+
+// RecordSuccess resets the failed login count of the account. The count of the client IP address is kept, so
+// that logging in to an account of one's own does not allow guessing the passwords of others.
+func (g *LoginGuard) RecordSuccess(ctx context.Context, username string) error {
+	return g.attempts.Reset(ctx, accountKey(username))
+}
+
+// keys returns the keys of the counts for the account and the client IP address, mapped to their limits.
+func (g *LoginGuard) keys(username, ip string) map[string]int {
+	keys := map[string]int{accountKey(username): g.maxAccountFailures}
+	if ip != "" {
+		keys["ip:"+ip] = g.maxIpFailures
+	}
+	return keys
+}
+
+// accountKey returns the key of the count for the account with the username.
+func accountKey(username string) string {
+	return "account:" + username
+}
+
+// lockedUntil returns the time until which the count locks logins, which is in the past if it does not.
+func lockedUntil(attempt *structs.LoginAttemptEntity, max int) time.Time {
+	if attempt.Failures < max {
+		return attempt.LastFailureAt
+	}
+	lockout := lockoutMax
+	if doublings := attempt.Failures - max; doublings < 10 {
+		lockout = min(lockoutBase<<doublings, lockoutMax)
+	}
+	return attempt.LastFailureAt.Add(lockout)
+}
+
+// readLimit reads a positive limit from the environment variable, or returns the default if it is not set.
+func readLimit(name string, defaultLimit int) (int, error) {
+	limitString := os.Getenv(name)
+	if limitString == "" {
+		return defaultLimit, nil
+	}
+	limit, err := strconv.Atoi(limitString)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, limitString)
+	}
+	return limit, nil
+}
+
+// dummyPasswordHash returns a bcrypt hash that logins for unknown usernames are compared against, so that they
+// take as long as logins with an incorrect password.
+var dummyPasswordHash = sync.OnceValue(func() []byte {
+	hash, err := bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Failed generating dummy password hash: %v", err)
+	}
+	return hash
+})
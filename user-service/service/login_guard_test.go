@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryLoginAttemptRepository is a LoginAttemptRepository that keeps the counts in memory.
+type memoryLoginAttemptRepository struct {
+	lock     sync.Mutex
+	attempts map[string]structs.LoginAttemptEntity
+}
+
+func (r *memoryLoginAttemptRepository) Get(ctx context.Context, key string) (*structs.LoginAttemptEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	attempt, ok := r.attempts[key]
+	if !ok {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &attempt, nil
+}
+
+func (r *memoryLoginAttemptRepository) RecordFailure(ctx context.Context, key string, failedAt, expiresAt time.Time) (*structs.LoginAttemptEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	attempt := r.attempts[key]
+	attempt.Key = key
+	attempt.Failures++
+	attempt.LastFailureAt = failedAt
+	attempt.ExpiresAt = expiresAt
+	r.attempts[key] = attempt
+	return &attempt, nil
+}
+
+func (r *memoryLoginAttemptRepository) Reset(ctx context.Context, key string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.attempts, key)
+	return nil
+}
+
+// memoryAuditRepository is an AuditRepository that keeps the events in memory.
+type memoryAuditRepository struct {
+	lock   sync.Mutex
+	events []structs.AuditEventEntity
+}
+
+func (r *memoryAuditRepository) Save(ctx context.Context, event *structs.AuditEventEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, *event)
+	return nil
+}
+
+func TestLockedUntil(t *testing.T) {
+	lastFailureAt := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		failures int
+		want     time.Duration
+	}{
+		{"below the limit", 4, 0},
+		{"at the limit", 5, 30 * time.Second},
+		{"one over the limit", 6, time.Minute},
+		{"four over the limit", 9, 8 * time.Minute},
+		{"capped", 10, 15 * time.Minute},
+		{"far over the limit", 100, 15 * time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attempt := &structs.LoginAttemptEntity{Failures: test.failures, LastFailureAt: lastFailureAt}
+			if got := lockedUntil(attempt, 5).Sub(lastFailureAt); got != test.want {
+				t.Errorf("lockedUntil is %v after the last failure, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// newLoginGuardTest returns a LoginGuard that locks accounts after 3 and client IP addresses after 5 failures.
+func newLoginGuardTest(t *testing.T) (*LoginGuard, *memoryAuditRepository) {
+	t.Helper()
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	t.Setenv("LOGIN_MAX_FAILURES_PER_IP", "5")
+	audit := &memoryAuditRepository{}
+	guard, err := NewLoginGuard(&memoryLoginAttemptRepository{attempts: make(map[string]structs.LoginAttemptEntity)}, audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guard, audit
+}
+
+func TestLoginGuardLocksAccount(t *testing.T) {
+	guard, audit := newLoginGuardTest(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := guard.RecordFailure(ctx, "alice", "user-1", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.Check(ctx, "alice", "10.0.0.1"); err != nil {
+		t.Fatalf("account locked before reaching the limit: %v", err)
+	}
+
+	if err := guard.RecordFailure(ctx, "alice", "user-1", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	var locked *LoginLockedError
+	if err := guard.Check(ctx, "alice", "10.0.0.2"); !errors.As(err, &locked) {
+		t.Fatalf("account not locked after reaching the limit: %v", err)
+	}
+	if locked.RetryAfter <= 0 || locked.RetryAfter > lockoutBase {
+		t.Errorf("RetryAfter is %v, want at most %v", locked.RetryAfter, lockoutBase)
+	}
+	if err := guard.Check(ctx, "bob", "10.0.0.1"); err != nil {
+		t.Errorf("other account locked: %v", err)
+	}
+	if len(audit.events) != 1 || audit.events[0].Type != AuditAccountLocked {
+		t.Errorf("audit events are %+v, want one account lock", audit.events)
+	}
+}
+
+func TestLoginGuardLocksIp(t *testing.T) {
+	guard, _ := newLoginGuardTest(t)
+	ctx := context.Background()
+	for _, username := range []string{"alice", "bob", "carol", "dave", "erin"} {
+		if err := guard.RecordFailure(ctx, username, "", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.Check(ctx, "frank", "10.0.0.1"); !errors.Is(err, ErrLoginLocked) {
+		t.Fatalf("ip address not locked after reaching the limit: %v", err)
+	}
+	if err := guard.Check(ctx, "frank", "10.0.0.2"); err != nil {
+		t.Errorf("other ip address locked: %v", err)
+	}
+}
+
+func TestLoginGuardSuccessKeepsIpCount(t *testing.T) {
+	guard, _ := newLoginGuardTest(t)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := guard.RecordFailure(ctx, "alice", "user-1", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.RecordSuccess(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.RecordFailure(ctx, "alice", "user-1", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard.Check(ctx, "alice", ""); err != nil {
+		t.Errorf("account locked although its count was reset: %v", err)
+	}
+
+	for _, username := range []string{"bob", "carol"} {
+		if err := guard.RecordFailure(ctx, username, "", "10.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := guard.Check(ctx, "dave", "10.0.0.1"); !errors.Is(err, ErrLoginLocked) {
+		t.Errorf("ip address not locked after its count reached the limit: %v", err)
+	}
+}
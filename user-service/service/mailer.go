@@ -0,0 +1,141 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Mail is a plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users.
+type Mailer interface {
+	// Send sends the mail.
+	Send(ctx context.Context, mail Mail) error
+}
+
+// NewMailer creates the Mailer selected by the MAILER environment variable.
+// "smtp", the default, sends mails through the SMTP server at SMTP_ADDR; "outbox" writes them as files to
+// MAIL_OUTBOX_DIR and is meant for development environments without a mail server.
+// The sender address is read from MAIL_FROM.
+func NewMailer() (Mailer, error) {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		return nil, fmt.Errorf("MAIL_FROM environment variable not set")
+	}
+	switch mailer := os.Getenv("MAILER"); mailer {
+	case "", "smtp":
+		address := os.Getenv("SMTP_ADDR")
+		if address == "" {
+			return nil, fmt.Errorf("SMTP_ADDR environment variable not set")
+		}
+		return NewSmtpMailer(address, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	case "outbox":
+		dir := os.Getenv("MAIL_OUTBOX_DIR")
+		if dir == "" {
+			dir = filepath.Join(os.TempDir(), "mail-outbox")
+		}
+		log.Printf("Using outbox mailer, mails are written to %s instead of being sent", dir)
+		return NewOutboxMailer(dir, from)
+	default:
+		return nil, fmt.Errorf("unknown MAILER: %q", mailer)
+	}
+}
+
+// SmtpMailer sends mails through an SMTP server.
+type SmtpMailer struct {
+	address string
+	auth    smtp.Auth
+	from    string
+}
+
+// NewSmtpMailer creates a new SmtpMailer for the SMTP server at the address ("host:port").
+// If a username is given, it authenticates with PLAIN auth, which net/smtp only allows over TLS or to localhost.
+func NewSmtpMailer(address, username, password, from string) (*SmtpMailer, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q: %v", address, err)
+	}
+	mailer := &SmtpMailer{address: address, from: from}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+// Send sends the mail. The context is not honored, as net/smtp does not support cancellation.
+func (m *SmtpMailer) Send(ctx context.Context, mail Mail) error {
+	message, err := formatMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+	if err := smtp.SendMail(m.address, m.auth, m.from, []string{mail.To}, message); err != nil {
+		return fmt.Errorf("failed sending mail to %s: %v", mail.To, err)
+	}
+	return nil
+}
+
+// OutboxMailer writes mails as .eml files to a directory instead of sending them.
+type OutboxMailer struct {
+	dir  string
+	from string
+}
+
+// NewOutboxMailer creates a new OutboxMailer writing to the directory, which is created if it does not exist.
+func NewOutboxMailer(dir, from string) (*OutboxMailer, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed creating mail outbox %s: %v", dir, err)
+	}
+	return &OutboxMailer{dir: dir, from: from}, nil
+}
+
+// Send writes the mail to a new file in the outbox. File names start with the time the mail was sent, so that
+// they sort chronologically.
+func (m *OutboxMailer) Send(ctx context.Context, mail Mail) error {
+	message, err := formatMail(m.from, mail)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000000000"), uuid.New().String())
+	path := filepath.Join(m.dir, name)
+	if err := os.WriteFile(path, message, 0o600); err != nil {
+		return fmt.Errorf("failed writing mail to %s: %v", path, err)
+	}
+	log.Printf("Wrote mail %q to %s", mail.Subject, path)
+	return nil
+}
+
+// formatMail formats the mail as an RFC 5322 message.
+// Addresses and subjects containing line breaks are rejected, as they could inject headers.
+func formatMail(from string, mail Mail) ([]byte, error) {
+	for _, header := range []string{from, mail.To, mail.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, errors.New("mail header contains a line break")
+		}
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return message.Bytes(), nil
+}
@@ -5,10 +5,24 @@ import (
 )
 
 // MapUserDtoToEntity maps UserDto to UserEntity
+// Email addresses that were only marked as verified by the migration are reported as unverified, so that clients
+// ask the user to verify them.
 func MapUserEntityToDto(user *structs.UserEntity) *structs.UserDto {
 	return &structs.UserDto{
-		Id:       user.Id,
-		Username: user.Username,
-		Email:    user.Email,
+		Id:            user.Id,
+		Username:      user.Username,
+		DisplayName:   user.DisplayName,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified && !user.EmailUnconfirmed,
+		MfaEnabled:    user.Mfa != nil && user.Mfa.Enabled,
+	}
+}
+
+// MapUserEntityToPublicDto maps a UserEntity to a PublicUserDto.
+func MapUserEntityToPublicDto(user *structs.UserEntity) *structs.PublicUserDto {
+	return &structs.PublicUserDto{
+		Id:          user.Id,
+		Username:    user.Username,
+		DisplayName: user.DisplayName,
 	}
 }
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultMfaIssuer is the issuer shown in authenticator apps used when MFA_ISSUER is not set.
+	defaultMfaIssuer = "Chat App"
+	// mfaChallengeTTL is the time a user has to enter the code after logging in with the password.
+	mfaChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount is the number of recovery codes generated on enrollment.
+	recoveryCodeCount = 10
+	// purposeMfaLogin is the purpose of one-time tokens that stand for a login waiting for the second factor.
+	purposeMfaLogin = "mfa-login"
+	// AuditMfaReset is the type of the audit event recorded when an admin resets the second factor of a user.
+	AuditMfaReset = "mfa.reset"
+)
+
+var (
+	// ErrMfaAlreadyEnabled is returned when a user with an enabled second factor enrolls another one.
+	ErrMfaAlreadyEnabled = errors.New("two-factor authentication already enabled")
+	// ErrMfaNotEnrolled is returned when a second factor is confirmed or disabled that was not enrolled.
+	ErrMfaNotEnrolled = errors.New("two-factor authentication not enrolled")
+	// ErrInvalidMfaCode is returned when a TOTP or recovery code is incorrect or was already used.
+	ErrInvalidMfaCode = errors.New("invalid two-factor authentication code")
+	// ErrInvalidMfaToken is returned when the token of a login waiting for the second factor is unknown or expired.
+	ErrInvalidMfaToken = errors.New("invalid two-factor authentication token")
+	// ErrNotAdmin is returned when a user who is not an admin attempts an admin operation.
+	ErrNotAdmin = errors.New("user is not an admin")
+	// ErrMfaRequired is wrapped by MfaRequiredError.
+	ErrMfaRequired = errors.New("two-factor authentication required")
+)
+
+// MfaRequiredError is returned when the password of a user with an enabled second factor was correct, and the
+// login has to be finished with a code.
+type MfaRequiredError struct {
+	// Challenge carries the token that stands for the login waiting for the second factor.
+	Challenge *structs.MfaChallenge
+}
+
+func (e *MfaRequiredError) Error() string {
+	return ErrMfaRequired.Error()
+}
+
+func (e *MfaRequiredError) Unwrap() error {
+	return ErrMfaRequired
+}
+
+// MfaService manages the optional TOTP second factor of users.
+// Enrolling generates a secret, which only becomes required at login once it is confirmed with a first code.
+// Confirming also generates one-time recovery codes for when the authenticator is lost; they are only shown
+// once and stored hashed. Secrets are stored encrypted, as they have to be read back to check codes.
+type MfaService struct {
+	users      UserRepository
+	tokens     OneTimeTokenRepository
+	audit      AuditRepository
+	loginGuard *LoginGuard
+	aead       cipher.AEAD
+	issuer     string
+	admins     map[string]bool
+}
+
+// NewMfaService creates a new MfaService.
+// The key the secrets are encrypted with is read from the MFA_ENCRYPTION_KEY environment variable, a base64
+// encoded 32 byte AES key, and the issuer shown in authenticator apps from MFA_ISSUER. The users who may reset the
+// second factor of others are listed by ID in ADMIN_USER_IDS, separated by commas. Incorrect codes for disabling
+// the second factor are counted by the LoginGuard like failed logins.
+func NewMfaService(users UserRepository, tokens OneTimeTokenRepository, audit AuditRepository, loginGuard *LoginGuard) (*MfaService, error) {
+	encodedKey := os.Getenv("MFA_ENCRYPTION_KEY")
+	if encodedKey == "" {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY environment variable not set")
+	}
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("MFA_ENCRYPTION_KEY must be a base64 encoded key of 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	issuer := os.Getenv("MFA_ISSUER")
+	if issuer == "" {
+		issuer = defaultMfaIssuer
+	}
+	admins := make(map[string]bool)
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			admins[id] = true
+		}
+	}
+
+	return &MfaService{
+		users:      users,
+		tokens:     tokens,
+		audit:      audit,
+		loginGuard: loginGuard,
+		aead:       aead,
+		issuer:     issuer,
+		admins:     admins,
+	}, nil
+}
+
+// Enroll generates a new TOTP secret for the user and returns it to be added to an authenticator app.
+// Enrolling again before confirming replaces the secret.
+func (s *MfaService) Enroll(ctx context.Context, userId string) (*structs.MfaEnrollment, error) {
+	user, err := s.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.Mfa != nil && user.Mfa.Enabled {
+		return nil, ErrMfaAlreadyEnabled
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed generating mfa secret: %w", err)
+	}
+	encryptedSecret, err := s.encrypt(secret)
+	if err != nil {
+		return nil, err
+	}
+	err = s.users.SetMfa(ctx, user.Id, &structs.MfaEntity{
+		Secret:    encryptedSecret,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &structs.MfaEnrollment{
+		Secret:     totpEncoding.EncodeToString(secret),
+		OtpauthUri: otpauthUri(s.issuer, user.Username, secret),
+	}, nil
+}
+
+// ConfirmEnrollment enables the enrolled second factor of the user if the TOTP code is correct, and returns the
+// recovery codes. Confirming again generates new recovery codes, invalidating the old ones.
+func (s *MfaService) ConfirmEnrollment(ctx context.Context, userId, code string) ([]string, error) {
+	user, err := s.getUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.Mfa == nil {
+		return nil, ErrMfaNotEnrolled
+	}
+	secret, err := s.decrypt(user.Mfa.Secret)
+	if err != nil {
+		return nil, err
+	}
+	step, ok := matchTotpCode(secret, normalizeCode(code), time.Now())
+	if !ok || step <= user.Mfa.LastUsedStep {
+		return nil, ErrInvalidMfaCode
+	}
+
+	recoveryCodes := make([]string, recoveryCodeCount)
+	recoveryCodeHashes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		recoveryCodes[i], err = generateRecoveryCode()
+		if err != nil {
+			return nil, fmt.Errorf("failed generating recovery code: %w", err)
+		}
+		recoveryCodeHashes[i] = hashToken(normalizeCode(recoveryCodes[i]))
+	}
+
+	now := time.Now()
+	mfa := *user.Mfa
+	mfa.Enabled = true
+	mfa.RecoveryCodes = recoveryCodeHashes
+	mfa.LastUsedStep = step
+	mfa.EnabledAt = &now
+	if err := s.users.SetMfa(ctx, user.Id, &mfa); err != nil {
+		return nil, err
+	}
+	log.Printf("Enabled two-factor authentication of user %s", user.Id)
+	return recoveryCodes, nil
+}
+
+// Disable removes the second factor of the user, who has to prove to have it with a TOTP or recovery code.
+// Incorrect codes return ErrInvalidMfaCode and count as failed logins of the account, so that a stolen access
+// token does not allow guessing codes; while the account or the client IP address is locked, it returns a
+// LoginLockedError.
+func (s *MfaService) Disable(ctx context.Context, userId, code, clientIp string) error {
+	user, err := s.getUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if user.Mfa == nil || !user.Mfa.Enabled {
+		return ErrMfaNotEnrolled
+	}
+	if err := s.loginGuard.Check(ctx, user.Username, clientIp); err != nil {
+		return err
+	}
+	if err := s.checkCode(ctx, user, code); err != nil {
+		if err == ErrInvalidMfaCode {
+			if err := s.loginGuard.RecordFailure(ctx, user.Username, user.Id, clientIp); err != nil {
+				log.Printf("Failed recording failed login for %q: %v", user.Username, err)
+			}
+		}
+		return err
+	}
+	if err := s.users.SetMfa(ctx, user.Id, nil); err != nil {
+		return err
+	}
+	log.Printf("Disabled two-factor authentication of user %s", user.Id)
+	return nil
+}
+
+// Reset removes the second factor of the user on behalf of an admin, for users who lost both their authenticator
+// and their recovery codes. It returns ErrNotAdmin if the acting user is not an admin. Resets are recorded as
+// audit events.
+func (s *MfaService) Reset(ctx context.Context, adminId, userId string) error {
+	if !s.admins[adminId] {
+		return ErrNotAdmin
+	}
+	user, err := s.getUser(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if user.Mfa == nil {
+		return ErrMfaNotEnrolled
+	}
+	if err := s.users.SetMfa(ctx, user.Id, nil); err != nil {
+		return err
+	}
+	log.Printf("Admin %s reset two-factor authentication of user %s", adminId, user.Id)
+	return s.audit.Save(ctx, &structs.AuditEventEntity{
+		Id:        uuid.New().String(),
+		Type:      AuditMfaReset,
+		Username:  user.Username,
+		UserId:    user.Id,
+		Details:   fmt.Sprintf("reset by admin %s", adminId),
+		CreatedAt: time.Now(),
+	})
+}
+
+// Required reports whether the user has to enter a code at login.
+func (s *MfaService) Required(user *structs.UserEntity) bool {
+	return user.Mfa != nil && user.Mfa.Enabled
+}
+
+// Challenge stores a login of the user waiting for the second factor and returns the token that stands for it.
+func (s *MfaService) Challenge(ctx context.Context, user *structs.UserEntity) (*structs.MfaChallenge, error) {
+	token, err := generateSecretToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating mfa token: %w", err)
+	}
+	now := time.Now()
+	err = s.tokens.Save(ctx, &structs.OneTimeTokenEntity{
+		Id:        uuid.New().String(),
+		Purpose:   purposeMfaLogin,
+		UserId:    user.Id,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(mfaChallengeTTL),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed saving mfa token: %w", err)
+	}
+	return &structs.MfaChallenge{
+		Token:     token,
+		ExpiresIn: int64(mfaChallengeTTL.Seconds()),
+	}, nil
+}
+
+// PendingUser returns the user of the login waiting for the second factor that the token stands for.
+func (s *MfaService) PendingUser(ctx context.Context, token string) (*structs.UserEntity, error) {
+	entity, err := s.tokens.GetByHash(ctx, hashToken(token), purposeMfaLogin, time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidMfaToken
+		}
+		return nil, err
+	}
+	user, err := s.users.GetById(ctx, entity.UserId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidMfaToken
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// CompleteChallenge checks the code of the user of a login waiting for the second factor, and uses up the token
+// if it is correct. A user whose second factor was disabled in the meantime needs no code.
+func (s *MfaService) CompleteChallenge(ctx context.Context, token string, user *structs.UserEntity, code string) error {
+	if s.Required(user) {
+		if err := s.checkCode(ctx, user, code); err != nil {
+			return err
+		}
+	}
+	if _, err := s.tokens.Consume(ctx, hashToken(token), purposeMfaLogin, time.Now()); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidMfaToken
+		}
+		return err
+	}
+	return nil
+}
+
+// checkCode checks a TOTP code or, if it is not one, a recovery code of the user, and marks it as used.
+func (s *MfaService) checkCode(ctx context.Context, user *structs.UserEntity, code string) error {
+	code = normalizeCode(code)
+	if len(code) == totpDigits {
+		secret, err := s.decrypt(user.Mfa.Secret)
+		if err != nil {
+			return err
+		}
+		step, ok := matchTotpCode(secret, code, time.Now())
+		if !ok {
+			return ErrInvalidMfaCode
+		}
+		used, err := s.users.UseMfaStep(ctx, user.Id, step)
+		if err != nil {
+			return err
+		}
+		if !used {
+			return ErrInvalidMfaCode
+		}
+		return nil
+	}
+
+	used, err := s.users.UseRecoveryCode(ctx, user.Id, hashToken(code))
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidMfaCode
+	}
+	log.Printf("User %s used a recovery code", user.Id)
+	return nil
+}
+
+// getUser retrieves the user with the ID, returning ErrNoUser if there is none.
+func (s *MfaService) getUser(ctx context.Context, userId string) (*structs.UserEntity, error) {
+	user, err := s.users.GetById(ctx, userId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrNoUser
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// encrypt encrypts the secret and returns the nonce followed by the ciphertext, base64 encoded.
+func (s *MfaService) encrypt(secret []byte) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed generating nonce: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, secret, nil)), nil
+}
+
+// decrypt decrypts a secret encrypted with encrypt.
+func (s *MfaService) decrypt(encryptedSecret string) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encryptedSecret)
+	if err != nil || len(sealed) < s.aead.NonceSize() {
+		return nil, errors.New("malformed mfa secret")
+	}
+	nonceSize := s.aead.NonceSize()
+	secret, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting mfa secret: %w", err)
+	}
+	return secret, nil
+}
+
+// generateRecoveryCode generates a recovery code of ten random base32 characters, formatted as "xxxxx-xxxxx".
+func generateRecoveryCode() (string, error) {
+	random := make([]byte, 7)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	code := strings.ToLower(totpEncoding.EncodeToString(random))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+// normalizeCode removes the separators users may type or paste with a code and lower-cases it.
+func normalizeCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
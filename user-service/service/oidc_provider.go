@@ -0,0 +1,372 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// oidcLeeway is the clock skew allowed when checking the times of ID tokens.
+	oidcLeeway = 30 * time.Second
+	// oidcJwksMinRefreshInterval limits how often an ID token with an unknown kid can trigger fetching the JWKS.
+	oidcJwksMinRefreshInterval = 30 * time.Second
+)
+
+// ErrUnknownKey is returned when an ID token names a key that is not in the provider's JWKS.
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// oidcSigningMethods are the algorithms accepted for ID token signatures. The symmetric ones are left out, as the
+// client secret is optional and must not be usable to forge tokens.
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// oidcConfiguration is the part of the discovery document of an OpenID provider that is used.
+type oidcConfiguration struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// oidcJwk is an RSA or EC public key in JSON Web Key format.
+type oidcJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// IdTokenClaims are the claims of an ID token that are used.
+type IdTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string    `json:"nonce"`
+	AuthorizedParty   string    `json:"azp"`
+	Email             string    `json:"email"`
+	EmailVerified     claimBool `json:"email_verified"`
+	PreferredUsername string    `json:"preferred_username"`
+	Name              string    `json:"name"`
+}
+
+// claimBool is a boolean claim, which some providers send as a string.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true", `"true"`:
+		*b = true
+	case "false", `"false"`, "null":
+		*b = false
+	default:
+		return fmt.Errorf("invalid boolean claim %s", data)
+	}
+	return nil
+}
+
+// OidcProvider talks to an OpenID provider as a relying party with the authorization code flow.
+// The discovery document of the provider is fetched on first use, so that user service starts while the provider
+// is unavailable. The keys ID tokens are signed with are cached and fetched again when a token names an unknown
+// key, so that rotated keys are picked up right away.
+type OidcProvider struct {
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+	scopes       string
+	httpClient   *http.Client
+
+	lock          sync.Mutex
+	configuration *oidcConfiguration
+	keys          map[string]any
+	lastJwksFetch time.Time
+}
+
+// NewOidcProvider creates a new OidcProvider for the provider with the issuer URL.
+// The client secret is optional; public clients are protected by PKCE alone.
+func NewOidcProvider(issuer, clientId, clientSecret, redirectUrl, scopes string) *OidcProvider {
+	return &OidcProvider{
+		issuer:       issuer,
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		redirectUrl:  redirectUrl,
+		scopes:       scopes,
+		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		keys:         make(map[string]any),
+	}
+}
+
+// AuthorizationUrl returns the URL of the provider's authorization endpoint to send the browser to.
+// The code challenge is the S256 PKCE challenge of the code verifier that has to be presented to Exchange.
+func (p *OidcProvider) AuthorizationUrl(ctx context.Context, state, nonce, codeChallenge string) (string, error) {
+	configuration, err := p.getConfiguration(ctx)
+	if err != nil {
+		return "", err
+	}
+	authorizationUrl, err := url.Parse(configuration.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint %q: %w", configuration.AuthorizationEndpoint, err)
+	}
+	query := authorizationUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.clientId)
+	query.Set("redirect_uri", p.redirectUrl)
+	query.Set("scope", p.scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", codeChallenge)
+	query.Set("code_challenge_method", "S256")
+	authorizationUrl.RawQuery = query.Encode()
+	return authorizationUrl.String(), nil
+}
+
+// Exchange redeems the authorization code at the provider's token endpoint and returns the ID token.
+func (p *OidcProvider) Exchange(ctx context.Context, code, codeVerifier string) (string, error) {
+	configuration, err := p.getConfiguration(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectUrl)
+	form.Set("code_verifier", codeVerifier)
+	if p.clientSecret == "" {
+		form.Set("client_id", p.clientId)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, configuration.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.clientId), url.QueryEscape(p.clientSecret))
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokenResponse struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("failed decoding token response with status code %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s %s", resp.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription)
+	}
+	if tokenResponse.IdToken == "" {
+		return "", errors.New("token response contains no id token")
+	}
+	return tokenResponse.IdToken, nil
+}
+
+// VerifyIdToken checks the signature of the ID token against the provider's JWKS, that it was issued by the
+// provider for this client and has not expired, and that it carries the nonce of the login.
+func (p *OidcProvider) VerifyIdToken(ctx context.Context, idToken, nonce string) (*IdTokenClaims, error) {
+	claims := &IdTokenClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(p.issuer),
+		jwt.WithAudience(p.clientId),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcLeeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid id token: missing subject")
+	}
+	// A token issued for several clients must name this one as the party it was issued to.
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != p.clientId {
+		return nil, fmt.Errorf("invalid id token: authorized party %q", claims.AuthorizedParty)
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// getConfiguration returns the discovery document of the provider, fetching it on first use.
+func (p *OidcProvider) getConfiguration(ctx context.Context) (*oidcConfiguration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.configuration != nil {
+		return p.configuration, nil
+	}
+
+	var configuration oidcConfiguration
+	discoveryUrl := strings.TrimSuffix(p.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJson(ctx, discoveryUrl, &configuration); err != nil {
+		return nil, fmt.Errorf("failed fetching oidc discovery document: %w", err)
+	}
+	// The issuer is compared exactly, as it has to match the iss claim of the ID tokens.
+	if configuration.Issuer != p.issuer {
+		return nil, fmt.Errorf("oidc discovery document names issuer %q instead of %q", configuration.Issuer, p.issuer)
+	}
+	if configuration.AuthorizationEndpoint == "" || configuration.TokenEndpoint == "" || configuration.JwksUri == "" {
+		return nil, errors.New("oidc discovery document lacks endpoints")
+	}
+	p.configuration = &configuration
+	return p.configuration, nil
+}
+
+// getKey returns the public key with the kid. If it is not cached, the JWKS is fetched again, at most once every
+// oidcJwksMinRefreshInterval. An empty kid matches the only key of a JWKS with a single key.
+func (p *OidcProvider) getKey(ctx context.Context, kid string) (any, error) {
+	configuration, err := p.getConfiguration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	if time.Since(p.lastJwksFetch) < oidcJwksMinRefreshInterval {
+		return nil, ErrUnknownKey
+	}
+	p.lastJwksFetch = time.Now()
+
+	var jwks struct {
+		Keys []oidcJwk `json:"keys"`
+	}
+	if err := p.getJson(ctx, configuration.JwksUri, &jwks); err != nil {
+		return nil, fmt.Errorf("failed fetching oidc jwks: %w", err)
+	}
+	keys := make(map[string]any, len(jwks.Keys))
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		publicKey, err := parseOidcJwk(key)
+		if err != nil {
+			log.Printf("Skipping invalid key %q in oidc jwks: %v", key.Kid, err)
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	p.keys = keys
+
+	if key, ok := p.lookupKey(kid); ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+// lookupKey returns the cached key with the kid. The lock must be held.
+func (p *OidcProvider) lookupKey(kid string) (any, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// getJson fetches the URL and decodes the JSON response into the value.
+func (p *OidcProvider) getJson(ctx context.Context, url string, value any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// parseOidcJwk converts an RSA or EC JWK into a public key.
+func parseOidcJwk(key oidcJwk) (any, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(key.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(key.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		var ecdhCurve ecdh.Curve
+		switch key.Crv {
+		case "P-256":
+			curve, ecdhCurve = elliptic.P256(), ecdh.P256()
+		case "P-384":
+			curve, ecdhCurve = elliptic.P384(), ecdh.P384()
+		case "P-521":
+			curve, ecdhCurve = elliptic.P521(), ecdh.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) != size || len(y) != size {
+			return nil, errors.New("invalid coordinate length")
+		}
+		// Parsing the point as an ECDH key checks that it is on the curve.
+		point := append(append([]byte{4}, x...), y...)
+		if _, err := ecdhCurve.NewPublicKey(point); err != nil {
+			return nil, fmt.Errorf("invalid point: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.Kty)
+	}
+}
+
+// pkceChallenge returns the S256 PKCE code challenge of the code verifier.
+func pkceChallenge(codeVerifier string) string {
+	hash := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
@@ -0,0 +1,378 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultOidcScopes are the scopes requested when OIDC_SCOPES is not set.
+	defaultOidcScopes = "openid email profile"
+	// defaultOidcCompleteUrl is the page logins are handed back to when OIDC_COMPLETE_URL is not set.
+	defaultOidcCompleteUrl = "http://localhost:5173/login/oidc"
+	// oidcStateTTL is the time a user has to log in at the provider.
+	oidcStateTTL = 10 * time.Minute
+	// oidcLoginTokenTTL is the time the page logins are handed back to has to redeem the login token.
+	oidcLoginTokenTTL = 2 * time.Minute
+	// purposeOidcLogin is the purpose of one-time tokens that stand for a finished login through a provider.
+	purposeOidcLogin = "oidc-login"
+	// maxUsernameAttempts is the number of usernames tried when provisioning a user before giving up.
+	maxUsernameAttempts = 5
+)
+
+var (
+	// ErrInvalidOidcState is returned when the state of a login through a provider is unknown, expired or used.
+	ErrInvalidOidcState = errors.New("invalid oidc state")
+	// ErrOidcLoginFailed is wrapped by the errors returned when the provider does not confirm a login.
+	ErrOidcLoginFailed = errors.New("oidc login failed")
+	// ErrOidcEmailNotVerified is returned when the provider has not verified the email address of an account that
+	// is not linked to a user yet.
+	ErrOidcEmailNotVerified = errors.New("oidc email address not verified")
+	// ErrOidcAccountConflict is returned when several users with a verified email address match an account.
+	ErrOidcAccountConflict = errors.New("several users match oidc account")
+	// ErrOidcNoAccount is returned when no user matches an account and users are not provisioned.
+	ErrOidcNoAccount = errors.New("no user matches oidc account")
+	// ErrOidcEmailUnconfirmed is returned when the only users matching an account have an email address that was
+	// marked as verified by the migration, and have to verify it before the account can be linked.
+	ErrOidcEmailUnconfirmed = errors.New("email address of matching user not confirmed")
+	// ErrInvalidOidcLoginToken is returned when a login token is unknown, expired or already used.
+	ErrInvalidOidcLoginToken = errors.New("invalid oidc login token")
+)
+
+// OidcStateRepository defines the interface for storage of logins through a provider that are not finished yet.
+type OidcStateRepository interface {
+	// Save stores a started login in the repository.
+	Save(ctx context.Context, state *structs.OidcStateEntity) error
+	// Consume deletes the unexpired login with the state hash and returns it.
+	Consume(ctx context.Context, stateHash string, now time.Time) (*structs.OidcStateEntity, error)
+}
+
+// OidcService lets users log in through an external OpenID Connect provider, with the authorization code flow
+// and PKCE. The login starts with a redirect to the provider; the provider redirects back with a code, which is
+// exchanged for an ID token. The account the token identifies is matched to a user by the issuer and subject it
+// was linked with before, or else by the email address if the provider has verified it. Accounts no user matches
+// get a new user, unless provisioning is turned off. Users logged in this way get sessions like any other.
+//
+// The browser is then sent to a page of the frontend with a short-lived one-time login token, which the page
+// redeems for the tokens of the session, so that they never end up in URLs.
+type OidcService struct {
+	provider      *OidcProvider
+	states        OidcStateRepository
+	tokens        OneTimeTokenRepository
+	users         UserRepository
+	autoProvision bool
+	completeUrl   string
+}
+
+// NewOidcService creates a new OidcService, or returns nil if logins through a provider are not configured.
+// The provider is read from the OIDC_ISSUER_URL environment variable and the client registered with it from
+// OIDC_CLIENT_ID, OIDC_CLIENT_SECRET, which is optional for public clients, and OIDC_REDIRECT_URL, the URL of
+// /auth/oidc/callback as reachable by browsers. OIDC_SCOPES overrides the scopes requested, and OIDC_AUTO_PROVISION
+// set to "false" keeps users from being created for unknown accounts. The frontend page logins are handed back to
+// is read from OIDC_COMPLETE_URL; it is expected to post the token from its "token" query parameter to
+// /auth/oidc/token, and to show the error from its "error" query parameter if there is one.
+func NewOidcService(states OidcStateRepository, tokens OneTimeTokenRepository, users UserRepository) (*OidcService, error) {
+	issuer := os.Getenv("OIDC_ISSUER_URL")
+	if issuer == "" {
+		return nil, nil
+	}
+	clientId := os.Getenv("OIDC_CLIENT_ID")
+	if clientId == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID environment variable not set")
+	}
+	redirectUrl := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectUrl == "" {
+		return nil, fmt.Errorf("OIDC_REDIRECT_URL environment variable not set")
+	}
+	if _, err := url.Parse(redirectUrl); err != nil {
+		return nil, fmt.Errorf("invalid OIDC_REDIRECT_URL: %q", redirectUrl)
+	}
+	scopes := os.Getenv("OIDC_SCOPES")
+	if scopes == "" {
+		scopes = defaultOidcScopes
+	}
+	autoProvision := true
+	if autoProvisionString := os.Getenv("OIDC_AUTO_PROVISION"); autoProvisionString != "" {
+		var err error
+		autoProvision, err = strconv.ParseBool(autoProvisionString)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OIDC_AUTO_PROVISION: %q", autoProvisionString)
+		}
+	}
+	completeUrl := os.Getenv("OIDC_COMPLETE_URL")
+	if completeUrl == "" {
+		completeUrl = defaultOidcCompleteUrl
+	}
+	if _, err := url.Parse(completeUrl); err != nil {
+		return nil, fmt.Errorf("invalid OIDC_COMPLETE_URL: %q", completeUrl)
+	}
+
+	return &OidcService{
+		provider:      NewOidcProvider(issuer, clientId, os.Getenv("OIDC_CLIENT_SECRET"), redirectUrl, scopes),
+		states:        states,
+		tokens:        tokens,
+		users:         users,
+		autoProvision: autoProvision,
+		completeUrl:   completeUrl,
+	}, nil
+}
+
+// StartLogin starts a login through the provider and returns the URL to send the browser to, along with the
+// state, which the caller has to bind to the browser, so that a login started by someone else is not accepted.
+func (s *OidcService) StartLogin(ctx context.Context) (string, string, error) {
+	state, err := generateSecretToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed generating oidc state: %w", err)
+	}
+	nonce, err := generateSecretToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed generating oidc nonce: %w", err)
+	}
+	codeVerifier, err := generateSecretToken()
+	if err != nil {
+		return "", "", fmt.Errorf("failed generating pkce code verifier: %w", err)
+	}
+
+	authorizationUrl, err := s.provider.AuthorizationUrl(ctx, state, nonce, pkceChallenge(codeVerifier))
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	err = s.states.Save(ctx, &structs.OidcStateEntity{
+		StateHash:    hashToken(state),
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcStateTTL),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("failed saving oidc state: %w", err)
+	}
+	return authorizationUrl, state, nil
+}
+
+// FinishLogin finishes the login with the state with the authorization code the provider redirected back with.
+// It finds or provisions the user of the account and returns a login token to redeem for a session.
+func (s *OidcService) FinishLogin(ctx context.Context, state, code string) (string, error) {
+	entity, err := s.states.Consume(ctx, hashToken(state), time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return "", ErrInvalidOidcState
+		}
+		return "", err
+	}
+
+	idToken, err := s.provider.Exchange(ctx, code, entity.CodeVerifier)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOidcLoginFailed, err)
+	}
+	claims, err := s.provider.VerifyIdToken(ctx, idToken, entity.Nonce)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrOidcLoginFailed, err)
+	}
+	user, err := s.resolveUser(ctx, claims)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := generateSecretToken()
+	if err != nil {
+		return "", fmt.Errorf("failed generating oidc login token: %w", err)
+	}
+	now := time.Now()
+	err = s.tokens.Save(ctx, &structs.OneTimeTokenEntity{
+		Id:        uuid.New().String(),
+		Purpose:   purposeOidcLogin,
+		UserId:    user.Id,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(oidcLoginTokenTTL),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed saving oidc login token: %w", err)
+	}
+	return token, nil
+}
+
+// RedeemLoginToken consumes the login token and returns the user it was issued for.
+func (s *OidcService) RedeemLoginToken(ctx context.Context, token string) (*structs.UserEntity, error) {
+	entity, err := s.tokens.Consume(ctx, hashToken(token), purposeOidcLogin, time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidOidcLoginToken
+		}
+		return nil, err
+	}
+	user, err := s.users.GetById(ctx, entity.UserId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidOidcLoginToken
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// CompleteUrl returns the URL of the frontend page that logins are handed back to, with the login token, or with
+// the error code if the login failed.
+func (s *OidcService) CompleteUrl(token, errorCode string) string {
+	if errorCode != "" {
+		link, _ := url.Parse(s.completeUrl)
+		query := link.Query()
+		query.Set("error", errorCode)
+		link.RawQuery = query.Encode()
+		return link.String()
+	}
+	return linkWithToken(s.completeUrl, token)
+}
+
+// resolveUser returns the user linked to the account the ID token identifies. An account that is not linked yet
+// is linked to the user with the same verified email address, or gets a new user. Users who did not verify their
+// email address are never linked, so that registering with the address of someone else does not take over their
+// login. This includes the users the migration marked as verified, who are asked to verify their address instead.
+func (s *OidcService) resolveUser(ctx context.Context, claims *IdTokenClaims) (*structs.UserEntity, error) {
+	user, err := s.users.GetByIdentity(ctx, claims.Issuer, claims.Subject)
+	if err == nil {
+		return user, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, ErrOidcEmailNotVerified
+	}
+	identity := structs.ExternalIdentity{
+		Issuer:   claims.Issuer,
+		Subject:  claims.Subject,
+		LinkedAt: time.Now(),
+	}
+
+	users, err := s.users.ListByEmail(ctx, claims.Email)
+	if err != nil {
+		return nil, err
+	}
+	var matches []structs.UserEntity
+	unconfirmed := false
+	for _, candidate := range users {
+		if candidate.EmailVerified && candidate.EmailUnconfirmed {
+			unconfirmed = true
+		} else if candidate.EmailVerified {
+			matches = append(matches, candidate)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		if unconfirmed {
+			return nil, ErrOidcEmailUnconfirmed
+		}
+	case 1:
+		user := &matches[0]
+		if err := s.users.AddIdentity(ctx, user.Id, identity); err != nil {
+			return nil, err
+		}
+		log.Printf("Linked oidc account %s of %s to user %s", claims.Subject, claims.Issuer, user.Id)
+		return user, nil
+	default:
+		return nil, ErrOidcAccountConflict
+	}
+
+	if !s.autoProvision {
+		return nil, ErrOidcNoAccount
+	}
+	return s.provisionUser(ctx, claims, identity)
+}
+
+// provisionUser creates a user for the account. The user has no password and logs in through the provider only,
+// until a password is set by resetting it.
+func (s *OidcService) provisionUser(ctx context.Context, claims *IdTokenClaims, identity structs.ExternalIdentity) (*structs.UserEntity, error) {
+	username, err := s.availableUsername(ctx, claims)
+	if err != nil {
+		return nil, err
+	}
+	user := &structs.UserEntity{
+		Id:            uuid.New().String(),
+		Username:      username,
+		DisplayName:   displayName(claims.Name),
+		Email:         claims.Email,
+		EmailVerified: true,
+		Identities:    []structs.ExternalIdentity{identity},
+	}
+	if err := s.users.Save(ctx, user); err != nil {
+		return nil, fmt.Errorf("failed saving user %q to the database: %w", user.Username, err)
+	}
+	log.Printf("Provisioned user %s for oidc account %s of %s", user.Id, claims.Subject, claims.Issuer)
+	return user, nil
+}
+
+// availableUsername derives a username that is not taken yet from the preferred username of the account, or else
+// from its email address, adding a random number if needed.
+func (s *OidcService) availableUsername(ctx context.Context, claims *IdTokenClaims) (string, error) {
+	base := sanitizeUsername(claims.PreferredUsername)
+	if base == "" {
+		local, _, _ := strings.Cut(claims.Email, "@")
+		base = sanitizeUsername(local)
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	username := base
+	for attempt := 0; attempt < maxUsernameAttempts; attempt++ {
+		if attempt > 0 {
+			suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return "", err
+			}
+			username = fmt.Sprintf("%s-%04d", base, suffix.Int64())
+		}
+		_, err := s.users.GetByUsername(ctx, username)
+		if err == mongo.ErrNoDocuments {
+			return username, nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("failed finding available username for %q", base)
+}
+
+// displayName returns the name of the account as display name, or an empty one if it is too long.
+func displayName(name string) string {
+	name = strings.TrimSpace(name)
+	if ValidateDisplayName(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// sanitizeUsername keeps the letters, digits, dots, dashes and underscores of the name and shortens it, so that
+// a random number can be added within the limit of 30 characters.
+func sanitizeUsername(name string) string {
+	var username strings.Builder
+	for _, char := range name {
+		switch {
+		case char >= 'a' && char <= 'z', char >= 'A' && char <= 'Z', char >= '0' && char <= '9',
+			char == '.', char == '-', char == '_':
+			username.WriteRune(char)
+		}
+		if username.Len() == 25 {
+			break
+		}
+	}
+	return username.String()
+}
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/chat_app/user_service/internal/oidctest"
+	"example.com/chat_app/user_service/structs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	testOidcClientId    = "chat-app"
+	testOidcRedirectUrl = "http://localhost:8080/auth/oidc/callback"
+)
+
+// memoryOidcStateRepository is an OidcStateRepository that keeps the states in memory.
+type memoryOidcStateRepository struct {
+	lock   sync.Mutex
+	states map[string]structs.OidcStateEntity
+}
+
+func (r *memoryOidcStateRepository) Save(ctx context.Context, state *structs.OidcStateEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.states[state.StateHash] = *state
+	return nil
+}
+
+func (r *memoryOidcStateRepository) Consume(ctx context.Context, stateHash string, now time.Time) (*structs.OidcStateEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.states[stateHash]
+	delete(r.states, stateHash)
+	if !ok || !state.ExpiresAt.After(now) {
+		return nil, mongo.ErrNoDocuments
+	}
+	return &state, nil
+}
+
+// memoryOneTimeTokenRepository is a OneTimeTokenRepository that keeps the tokens in memory.
+// The methods the tests do not use are left to the embedded nil interface.
+type memoryOneTimeTokenRepository struct {
+	OneTimeTokenRepository
+	lock   sync.Mutex
+	tokens map[string]structs.OneTimeTokenEntity
+}
+
+func (r *memoryOneTimeTokenRepository) Save(ctx context.Context, token *structs.OneTimeTokenEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tokens[token.TokenHash] = *token
+	return nil
+}
+
+func (r *memoryOneTimeTokenRepository) Consume(ctx context.Context, tokenHash, purpose string, usedAt time.Time) (*structs.OneTimeTokenEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	token, ok := r.tokens[tokenHash]
+	if !ok || token.Purpose != purpose || token.UsedAt != nil || !token.ExpiresAt.After(usedAt) {
+		return nil, mongo.ErrNoDocuments
+	}
+	token.UsedAt = &usedAt
+	r.tokens[tokenHash] = token
+	return &token, nil
+}
+
+// memoryUserRepository is a UserRepository that keeps the users in memory.
+// The methods the tests do not use are left to the embedded nil interface.
+type memoryUserRepository struct {
+	UserRepository
+	lock  sync.Mutex
+	users []structs.UserEntity
+}
+
+func (r *memoryUserRepository) find(match func(user *structs.UserEntity) bool) (*structs.UserEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.users {
+		if match(&r.users[i]) {
+			user := r.users[i]
+			return &user, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (r *memoryUserRepository) GetById(ctx context.Context, id string) (*structs.UserEntity, error) {
+	return r.find(func(user *structs.UserEntity) bool { return user.Id == id })
+}
+
+func (r *memoryUserRepository) GetByUsername(ctx context.Context, username string) (*structs.UserEntity, error) {
+	return r.find(func(user *structs.UserEntity) bool { return user.Username == username })
+}
+
+func (r *memoryUserRepository) GetByIdentity(ctx context.Context, issuer, subject string) (*structs.UserEntity, error) {
+	return r.find(func(user *structs.UserEntity) bool {
+		for _, identity := range user.Identities {
+			if identity.Issuer == issuer && identity.Subject == subject {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (r *memoryUserRepository) ListByEmail(ctx context.Context, email string) ([]structs.UserEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var users []structs.UserEntity
+	for _, user := range r.users {
+		if user.Email == email {
+			users = append(users, user)
+		}
+	}
+	return users, nil
+}
+
+func (r *memoryUserRepository) Save(ctx context.Context, user *structs.UserEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.users = append(r.users, *user)
+	return nil
+}
+
+func (r *memoryUserRepository) AddIdentity(ctx context.Context, userId string, identity structs.ExternalIdentity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.users {
+		if r.users[i].Id == userId {
+			r.users[i].Identities = append(r.users[i].Identities, identity)
+			return nil
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+// oidcTest is an OidcService logging in through the mock provider.
+type oidcTest struct {
+	service *OidcService
+	users   *memoryUserRepository
+	issuer  string
+	client  *http.Client
+}
+
+// newOidcTest starts the mock provider and creates an OidcService for it with the users.
+func newOidcTest(t *testing.T, autoProvision bool, users ...structs.UserEntity) *oidcTest {
+	t.Helper()
+	server := httptest.NewUnstartedServer(nil)
+	issuer := "http://" + server.Listener.Addr().String()
+	provider, err := oidctest.NewProvider(issuer, testOidcClientId, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Config.Handler = provider.Handler()
+	server.Start()
+	t.Cleanup(server.Close)
+
+	t.Setenv("OIDC_ISSUER_URL", issuer)
+	t.Setenv("OIDC_CLIENT_ID", testOidcClientId)
+	t.Setenv("OIDC_CLIENT_SECRET", "")
+	t.Setenv("OIDC_REDIRECT_URL", testOidcRedirectUrl)
+	if autoProvision {
+		t.Setenv("OIDC_AUTO_PROVISION", "true")
+	} else {
+		t.Setenv("OIDC_AUTO_PROVISION", "false")
+	}
+
+	userRepo := &memoryUserRepository{users: users}
+	service, err := NewOidcService(
+		&memoryOidcStateRepository{states: make(map[string]structs.OidcStateEntity)},
+		&memoryOneTimeTokenRepository{tokens: make(map[string]structs.OneTimeTokenEntity)},
+		userRepo,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &oidcTest{
+		service: service,
+		users:   userRepo,
+		issuer:  issuer,
+		client: &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}},
+	}
+}
+
+// authorize starts a login and submits the login form of the mock provider with the claims. The parameters of
+// the authorization request can be overridden through the claims. It returns the state and the authorization
+// code the provider redirected back with.
+func (o *oidcTest) authorize(t *testing.T, claims url.Values) (string, string) {
+	t.Helper()
+	authorizationUrl, state, err := o.service.StartLogin(context.Background())
+	if err != nil {
+		t.Fatalf("StartLogin: %v", err)
+	}
+	parsed, err := url.Parse(authorizationUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authorizationUrl, o.issuer+"/authorize?") {
+		t.Fatalf("authorization url %q does not point at the provider", authorizationUrl)
+	}
+
+	form := parsed.Query()
+	for name := range claims {
+		form.Set(name, claims.Get(name))
+	}
+	resp, err := o.client.PostForm(o.issuer+"/authorize", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize returned %d", resp.StatusCode)
+	}
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(location.String(), testOidcRedirectUrl+"?") {
+		t.Fatalf("provider redirected to %q", location)
+	}
+	if location.Query().Get("state") != state {
+		t.Fatalf("provider returned state %q instead of %q", location.Query().Get("state"), state)
+	}
+	return state, location.Query().Get("code")
+}
+
+// login logs in through the provider as the account with the claims and redeems the login token.
+func (o *oidcTest) login(t *testing.T, claims url.Values) (*structs.UserEntity, error) {
+	t.Helper()
+	state, code := o.authorize(t, claims)
+	token, err := o.service.FinishLogin(context.Background(), state, code)
+	if err != nil {
+		return nil, err
+	}
+	return o.service.RedeemLoginToken(context.Background(), token)
+}
+
+// accountClaims returns the claims of an account at the provider with a verified email address.
+func accountClaims(subject, email string) url.Values {
+	return url.Values{
+		"sub":                {subject},
+		"email":              {email},
+		"email_verified":     {"true"},
+		"preferred_username": {"alice"},
+		"name":               {"Alice"},
+	}
+}
+
+func TestOidcLoginProvisionsUser(t *testing.T) {
+	o := newOidcTest(t, true)
+
+	user, err := o.login(t, accountClaims("subject-1", "alice@example.com"))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if user.Username != "alice" || user.Email != "alice@example.com" || !user.EmailVerified || user.DisplayName != "Alice" {
+		t.Errorf("provisioned user %+v", user)
+	}
+	if len(user.Identities) != 1 || user.Identities[0].Issuer != o.issuer || user.Identities[0].Subject != "subject-1" {
+		t.Errorf("provisioned user has identities %+v", user.Identities)
+	}
+
+	// Logging in again finds the user by the linked account.
+	again, err := o.login(t, accountClaims("subject-1", "alice@example.com"))
+	if err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	if again.Id != user.Id {
+		t.Errorf("second login returned user %s instead of %s", again.Id, user.Id)
+	}
+	if len(o.users.users) != 1 {
+		t.Errorf("%d users after two logins, want 1", len(o.users.users))
+	}
+}
+
+func TestOidcLoginRejectsWrongNonce(t *testing.T) {
+	o := newOidcTest(t, true)
+
+	claims := accountClaims("subject-1", "alice@example.com")
+	claims.Set("nonce", "not-the-nonce-of-the-login")
+	_, err := o.login(t, claims)
+	if !errors.Is(err, ErrOidcLoginFailed) {
+		t.Fatalf("login with wrong nonce returned %v, want %v", err, ErrOidcLoginFailed)
+	}
+	if len(o.users.users) != 0 {
+		t.Errorf("login with wrong nonce provisioned a user")
+	}
+}
+
+func TestOidcLoginRejectsReplayedState(t *testing.T) {
+	o := newOidcTest(t, true)
+
+	state, code := o.authorize(t, accountClaims("subject-1", "alice@example.com"))
+	if _, err := o.service.FinishLogin(context.Background(), state, code); err != nil {
+		t.Fatalf("FinishLogin: %v", err)
+	}
+	if _, err := o.service.FinishLogin(context.Background(), state, code); err != ErrInvalidOidcState {
+		t.Fatalf("replayed state returned %v, want %v", err, ErrInvalidOidcState)
+	}
+}
+
+func TestOidcLoginLinksUserWithVerifiedEmail(t *testing.T) {
+	o := newOidcTest(t, false, structs.UserEntity{
+		Id:            "user-1",
+		Username:      "alice_local",
+		Email:         "alice@example.com",
+		EmailVerified: true,
+	})
+
+	user, err := o.login(t, accountClaims("subject-1", "alice@example.com"))
+	if err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if user.Id != "user-1" {
+		t.Fatalf("login returned user %s instead of user-1", user.Id)
+	}
+	if len(user.Identities) != 1 || user.Identities[0].Subject != "subject-1" {
+		t.Errorf("linked user has identities %+v", user.Identities)
+	}
+}
+
+func TestOidcLoginDoesNotLinkUnverifiedEmail(t *testing.T) {
+	o := newOidcTest(t, false,
+		structs.UserEntity{Id: "user-1", Username: "unverified", Email: "alice@example.com"},
+		structs.UserEntity{Id: "user-2", Username: "migrated", Email: "bob@example.com", EmailVerified: true, EmailUnconfirmed: true},
+	)
+
+	if _, err := o.login(t, accountClaims("subject-1", "alice@example.com")); err != ErrOidcNoAccount {
+		t.Errorf("login matching an unverified user returned %v, want %v", err, ErrOidcNoAccount)
+	}
+	if _, err := o.login(t, accountClaims("subject-2", "bob@example.com")); err != ErrOidcEmailUnconfirmed {
+		t.Errorf("login matching a migrated user returned %v, want %v", err, ErrOidcEmailUnconfirmed)
+	}
+
+	claims := accountClaims("subject-3", "alice@example.com")
+	claims.Set("email_verified", "false")
+	if _, err := o.login(t, claims); err != ErrOidcEmailNotVerified {
+		t.Errorf("login with unverified email at the provider returned %v, want %v", err, ErrOidcEmailNotVerified)
+	}
+	for _, user := range o.users.users {
+		if len(user.Identities) != 0 {
+			t.Errorf("user %s was linked to %+v", user.Id, user.Identities)
+		}
+	}
+}
+
+func TestOidcLoginRejectsSeveralMatchingUsers(t *testing.T) {
+	o := newOidcTest(t, true,
+		structs.UserEntity{Id: "user-1", Username: "alice1", Email: "alice@example.com", EmailVerified: true},
+		structs.UserEntity{Id: "user-2", Username: "alice2", Email: "alice@example.com", EmailVerified: true},
+	)
+
+	if _, err := o.login(t, accountClaims("subject-1", "alice@example.com")); err != ErrOidcAccountConflict {
+		t.Fatalf("login matching several users returned %v, want %v", err, ErrOidcAccountConflict)
+	}
+	if len(o.users.users) != 2 {
+		t.Errorf("login matching several users provisioned a user")
+	}
+}
+
+func TestOidcLoginWithoutProvisioning(t *testing.T) {
+	o := newOidcTest(t, false)
+
+	if _, err := o.login(t, accountClaims("subject-1", "alice@example.com")); err != ErrOidcNoAccount {
+		t.Fatalf("login without provisioning returned %v, want %v", err, ErrOidcNoAccount)
+	}
+	if len(o.users.users) != 0 {
+		t.Errorf("login without provisioning created a user")
+	}
+}
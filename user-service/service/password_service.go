@@ -0,0 +1,190 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// defaultPasswordResetTTL is the lifetime of reset tokens used when PASSWORD_RESET_EXP_MINUTES is not set.
+	defaultPasswordResetTTL = time.Hour
+	// defaultPasswordResetUrl is the page reset links point to when PASSWORD_RESET_URL is not set.
+	defaultPasswordResetUrl = "http://localhost:5173/reset-password"
+	// purposeResetPassword is the purpose of one-time tokens that reset a password.
+	purposeResetPassword = "reset-password"
+)
+
+var (
+	// ErrInvalidResetToken is returned when a password reset token is unknown, expired or already used.
+	ErrInvalidResetToken = errors.New("invalid password reset token")
+	// ErrInvalidPassword is returned when a new password does not meet the password requirements.
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+// PasswordService changes the passwords of users and lets them reset forgotten ones.
+// Resetting works like email verification: a link with a single-use token, stored hashed, is mailed to the
+// address of the account. Every password change ends all sessions of the user.
+type PasswordService struct {
+	users    UserRepository
+	tokens   OneTimeTokenRepository
+	sessions *SessionService
+	mailer   Mailer
+	ttl      time.Duration
+	linkUrl  string
+}
+
+// NewPasswordService creates a new PasswordService.
+// The lifetime of reset tokens is read from the PASSWORD_RESET_EXP_MINUTES environment variable, and the page
+// the mailed links point to from PASSWORD_RESET_URL. The page is expected to post the token from its "token"
+// query parameter together with the new password to /auth/password/reset.
+func NewPasswordService(users UserRepository, tokens OneTimeTokenRepository, sessions *SessionService, mailer Mailer) (*PasswordService, error) {
+	ttl := defaultPasswordResetTTL
+	if ttlString := os.Getenv("PASSWORD_RESET_EXP_MINUTES"); ttlString != "" {
+		minutes, err := strconv.Atoi(ttlString)
+		if err != nil || minutes <= 0 {
+			return nil, fmt.Errorf("invalid PASSWORD_RESET_EXP_MINUTES: %q", ttlString)
+		}
+		ttl = time.Duration(minutes) * time.Minute
+	}
+	linkUrl := os.Getenv("PASSWORD_RESET_URL")
+	if linkUrl == "" {
+		linkUrl = defaultPasswordResetUrl
+	}
+	if _, err := url.Parse(linkUrl); err != nil {
+		return nil, fmt.Errorf("invalid PASSWORD_RESET_URL: %q", linkUrl)
+	}
+	return &PasswordService{
+		users:    users,
+		tokens:   tokens,
+		sessions: sessions,
+		mailer:   mailer,
+		ttl:      ttl,
+		linkUrl:  linkUrl,
+	}, nil
+}
+
+// ForgotPassword mails a reset link to every account with the email address, invalidating earlier links.
+// It does not tell whether there is such an account, so that it can not be used to find out who is registered.
+func (s *PasswordService) ForgotPassword(ctx context.Context, email string) error {
+	users, err := s.users.ListByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	for i := range users {
+		if err := s.sendResetLink(ctx, &users[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetPassword consumes the reset token and sets the new password of the account it was mailed for.
+// Opening the mailed link proves that the user owns the email address, so it is marked as verified as well.
+func (s *PasswordService) ResetPassword(ctx context.Context, token, newPassword string) error {
+	// The password is checked first, so that a rejected password does not use up the token.
+	if err := ValidatePassword(newPassword); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPassword, err)
+	}
+	entity, err := s.tokens.Consume(ctx, hashToken(token), purposeResetPassword, time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+	if err := s.setPassword(ctx, entity.UserId, newPassword); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidResetToken
+		}
+		return err
+	}
+	if err := s.users.SetEmailVerified(ctx, entity.UserId, entity.Email); err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	return nil
+}
+
+// ChangePassword sets the new password of the user after checking the current one.
+// It returns ErrWrongPassword if the current password is incorrect.
+func (s *PasswordService) ChangePassword(ctx context.Context, userId, currentPassword, newPassword string) error {
+	user, err := s.users.GetById(ctx, userId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrNoUser
+		}
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(currentPassword)); err != nil {
+		return ErrWrongPassword
+	}
+	if err := ValidatePassword(newPassword); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPassword, err)
+	}
+	return s.setPassword(ctx, user.Id, newPassword)
+}
+
+// setPassword hashes and stores the new password of the user and ends all of the user's sessions, including
+// the one the password was changed from, so that a session opened with the old password does not outlive it.
+// Pending reset links are invalidated as well.
+func (s *PasswordService) setPassword(ctx context.Context, userId, newPassword string) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed hashing password: %w", err)
+	}
+	if err := s.users.SetPassword(ctx, userId, string(hashedPassword)); err != nil {
+		return err
+	}
+	if err := s.tokens.DeleteForUser(ctx, userId, purposeResetPassword); err != nil {
+		return fmt.Errorf("failed invalidating reset tokens: %w", err)
+	}
+	if err := s.sessions.RevokeUserSessions(ctx, userId); err != nil {
+		return fmt.Errorf("failed revoking sessions: %w", err)
+	}
+	log.Printf("Changed password of user %s", userId)
+	return nil
+}
+
+// sendResetLink mails a new reset link to the user, invalidating the links mailed before.
+func (s *PasswordService) sendResetLink(ctx context.Context, user *structs.UserEntity) error {
+	if err := s.tokens.DeleteForUser(ctx, user.Id, purposeResetPassword); err != nil {
+		return fmt.Errorf("failed invalidating reset tokens: %w", err)
+	}
+
+	token, err := generateSecretToken()
+	if err != nil {
+		return fmt.Errorf("failed generating reset token: %w", err)
+	}
+	now := time.Now()
+	err = s.tokens.Save(ctx, &structs.OneTimeTokenEntity{
+		Id:        uuid.New().String(),
+		Purpose:   purposeResetPassword,
+		UserId:    user.Id,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed saving reset token: %w", err)
+	}
+
+	return s.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nsomeone asked to reset the password of your account. To choose a new password, "+
+			"open the following link:\n\n%s\n\nThe link expires in %d minutes. If you did not ask for this, you can "+
+			"ignore this mail and your password stays unchanged.\n",
+			user.Username, linkWithToken(s.linkUrl, token), int(s.ttl.Minutes())),
+	})
+}
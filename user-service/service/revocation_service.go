@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+)
+
+// RevocationRepository defines the interface for the storage of access token revocations.
+type RevocationRepository interface {
+	// Save stores a revocation in the repository.
+	Save(ctx context.Context, revocation *structs.RevocationEntity) error
+	// GetSince retrieves the revocations made at or after the given time that have not expired yet, oldest first.
+	GetSince(ctx context.Context, since time.Time) ([]structs.RevocationEntity, error)
+}
+
+// GetRevocations returns the revocations made at or after the given time that have not expired yet.
+// The gateway polls them to keep its denylist of access tokens in sync.
+func (s *SessionService) GetRevocations(ctx context.Context, since time.Time) ([]structs.RevocationEntity, error) {
+	return s.revocationRepo.GetSince(ctx, since)
+}
+
+// RevokeUserSessions ends all sessions of a user: every refresh token is revoked, and so is every access token
+// issued until now.
+func (s *SessionService) RevokeUserSessions(ctx context.Context, userId string) error {
+	now := time.Now()
+	if err := s.tokenRepo.RevokeUser(ctx, userId, now); err != nil {
+		return err
+	}
+	// The iat claim has a precision of milliseconds, so tokens issued in the current millisecond are revoked as well.
+	issuedBefore := now.Truncate(time.Millisecond).Add(time.Millisecond)
+	err := s.revocationRepo.Save(ctx, &structs.RevocationEntity{
+		Id:           uuid.New().String(),
+		UserId:       userId,
+		IssuedBefore: &issuedBefore,
+		RevokedAt:    now,
+		ExpiresAt:    issuedBefore.Add(s.jwt.AccessTokenTTL()),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Revoked all sessions of user %s", userId)
+	return nil
+}
+
+// revokeFamily revokes all refresh tokens of a token family together with the access tokens issued with them
+// that have not expired yet.
+func (s *SessionService) revokeFamily(ctx context.Context, familyId string, now time.Time) error {
+	tokens, err := s.tokenRepo.GetFamily(ctx, familyId)
+	if err != nil {
+		return err
+	}
+	if err := s.tokenRepo.RevokeFamily(ctx, familyId, now); err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		if token.AccessTokenId == "" || !token.AccessTokenExpiresAt.After(now) {
+			continue
+		}
+		err := s.revocationRepo.Save(ctx, &structs.RevocationEntity{
+			Id:        uuid.New().String(),
+			TokenId:   token.AccessTokenId,
+			UserId:    token.UserId,
+			RevokedAt: now,
+			ExpiresAt: token.AccessTokenExpiresAt,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// defaultRefreshTokenTTL is the lifetime of refresh tokens used when REFRESH_TOKEN_EXP_HS is not set.
+const defaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// UnverifiedUserPolicy decides what users who did not verify their email address are allowed to do.
+type UnverifiedUserPolicy string
+
+const (
+	// PolicyAllow lets unverified users use the whole application.
+	PolicyAllow UnverifiedUserPolicy = "allow"
+	// PolicyRestrict lets unverified users log in, but only with access tokens for managing their own account.
+	PolicyRestrict UnverifiedUserPolicy = "restrict"
+	// PolicyDeny keeps unverified users from logging in.
+	PolicyDeny UnverifiedUserPolicy = "deny"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned when a refresh token is unknown, expired or revoked.
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token is used after it was rotated.
+	// The token may have been stolen, so all tokens of its family are revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+	// ErrEmailNotVerified is returned when a user who did not verify their email address may not log in.
+	ErrEmailNotVerified = errors.New("email address not verified")
+)
+
+// RefreshTokenRepository defines the interface for refresh token storage.
+type RefreshTokenRepository interface {
+	// Save stores a refresh token in the repository.
+	Save(ctx context.Context, token *structs.RefreshTokenEntity) error
+	// GetByHash retrieves a refresh token by the hash of the token.
+	GetByHash(ctx context.Context, tokenHash string) (*structs.RefreshTokenEntity, error)
+	// MarkRotated marks a refresh token as rotated and reports whether it was not rotated or revoked before.
+	MarkRotated(ctx context.Context, id string, rotatedAt time.Time) (bool, error)
+	// GetFamily retrieves all refresh tokens of a token family.
+	GetFamily(ctx context.Context, familyId string) ([]structs.RefreshTokenEntity, error)
+	// RevokeFamily revokes all refresh tokens of a token family.
+	RevokeFamily(ctx context.Context, familyId string, revokedAt time.Time) error
+	// RevokeUser revokes all refresh tokens of a user.
+	RevokeUser(ctx context.Context, userId string, revokedAt time.Time) error
+}
+
+// SessionService issues the tokens of user sessions and renews them.
+// A session consists of a short-lived access token and an opaque refresh token. Refresh tokens are stored
+// hashed and rotated on every use; all refresh tokens issued for one login form a family, which is revoked
+// as a whole on logout or when a rotated token is used again. Access tokens of revoked sessions are published
+// as revocations, so that the gateway rejects them before they expire.
+// Sessions of users who did not verify their email address are limited by the UnverifiedUserPolicy.
+type SessionService struct {
+	tokenRepo        RefreshTokenRepository
+	revocationRepo   RevocationRepository
+	userRepo         UserRepository
+	jwt              *JwtService
+	refreshTokenTTL  time.Duration
+	unverifiedPolicy UnverifiedUserPolicy
+}
+
+// NewSessionService creates a new SessionService.
+// The lifetime of refresh tokens is read from the REFRESH_TOKEN_EXP_HS environment variable, and the policy for
+// unverified users from UNVERIFIED_USER_POLICY, which is one of "allow", "restrict" (the default) and "deny".
+func NewSessionService(tokenRepo RefreshTokenRepository, revocationRepo RevocationRepository, userRepo UserRepository, jwt *JwtService) (*SessionService, error) {
+	refreshTokenTTL := defaultRefreshTokenTTL
+	if ttlString := os.Getenv("REFRESH_TOKEN_EXP_HS"); ttlString != "" {
+		hours, err := strconv.Atoi(ttlString)
+		if err != nil || hours <= 0 {
+			return nil, fmt.Errorf("invalid REFRESH_TOKEN_EXP_HS: %q", ttlString)
+		}
+		refreshTokenTTL = time.Duration(hours) * time.Hour
+	}
+	unverifiedPolicy := PolicyRestrict
+	switch policy := UnverifiedUserPolicy(os.Getenv("UNVERIFIED_USER_POLICY")); policy {
+	case "":
+	case PolicyAllow, PolicyRestrict, PolicyDeny:
+		unverifiedPolicy = policy
+	default:
+		return nil, fmt.Errorf("invalid UNVERIFIED_USER_POLICY: %q", policy)
+	}
+	return &SessionService{
+		tokenRepo:        tokenRepo,
+		revocationRepo:   revocationRepo,
+		userRepo:         userRepo,
+		jwt:              jwt,
+		refreshTokenTTL:  refreshTokenTTL,
+		unverifiedPolicy: unverifiedPolicy,
+	}, nil
+}
+
+// StartSession issues the tokens of a new session of the user, starting a new refresh token family.
+// It returns ErrEmailNotVerified if the policy keeps the user from logging in.
+func (s *SessionService) StartSession(ctx context.Context, user *structs.UserEntity) (*structs.TokenPair, error) {
+	if !user.EmailVerified && s.unverifiedPolicy == PolicyDeny {
+		return nil, ErrEmailNotVerified
+	}
+	return s.issueTokens(ctx, user, uuid.New().String())
+}
+
+// Refresh rotates the refresh token and issues new tokens for its session.
+// Using a refresh token that was already rotated revokes its whole family and returns ErrRefreshTokenReused.
+// The new access token reflects whether the user has verified their email address since the last refresh.
+func (s *SessionService) Refresh(ctx context.Context, refreshToken string) (*structs.TokenPair, error) {
+	token, err := s.tokenRepo.GetByHash(ctx, hashToken(refreshToken))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	now := time.Now()
+	if token.RevokedAt != nil || now.After(token.ExpiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if token.RotatedAt != nil {
+		return nil, s.revokeReusedFamily(ctx, token, now)
+	}
+	rotated, err := s.tokenRepo.MarkRotated(ctx, token.Id, now)
+	if err != nil {
+		return nil, err
+	}
+	if !rotated {
+		return nil, s.revokeReusedFamily(ctx, token, now)
+	}
+
+	user, err := s.userRepo.GetById(ctx, token.UserId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			if err := s.revokeFamily(ctx, token.FamilyId, now); err != nil {
+				return nil, err
+			}
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+	if !user.EmailVerified && s.unverifiedPolicy == PolicyDeny {
+		return nil, ErrEmailNotVerified
+	}
+	return s.issueTokens(ctx, user, token.FamilyId)
+}
+
+// EndSession revokes the refresh token family of the session and its access tokens. Unknown tokens are ignored.
+func (s *SessionService) EndSession(ctx context.Context, refreshToken string) error {
+	token, err := s.tokenRepo.GetByHash(ctx, hashToken(refreshToken))
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil
+		}
+		return err
+	}
+	return s.revokeFamily(ctx, token.FamilyId, time.Now())
+}
+
+// revokeReusedFamily revokes the family of a refresh token that was used after it was rotated.
+func (s *SessionService) revokeReusedFamily(ctx context.Context, token *structs.RefreshTokenEntity, now time.Time) error {
+	log.Printf("Refresh token %s of user %s was reused, revoking token family %s", token.Id, token.UserId, token.FamilyId)
+	if err := s.revokeFamily(ctx, token.FamilyId, now); err != nil {
+		return err
+	}
+	return ErrRefreshTokenReused
+}
+
+// issueTokens generates an access token and stores a new refresh token in the given family.
+// Under the restrict policy, unverified users only get an access token for their own account.
+func (s *SessionService) issueTokens(ctx context.Context, user *structs.UserEntity, familyId string) (*structs.TokenPair, error) {
+	generateToken := s.jwt.GenerateToken
+	if !user.EmailVerified && s.unverifiedPolicy == PolicyRestrict {
+		generateToken = s.jwt.GenerateAccountToken
+	}
+	accessToken, err := generateToken(user.Id, user.Username)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating jwt token: %w", err)
+	}
+
+	refreshToken, err := generateSecretToken()
+	if err != nil {
+		return nil, fmt.Errorf("failed generating refresh token: %w", err)
+	}
+	now := time.Now()
+	err = s.tokenRepo.Save(ctx, &structs.RefreshTokenEntity{
+		Id:        uuid.New().String(),
+		FamilyId:  familyId,
+		UserId:    user.Id,
+		TokenHash: hashToken(refreshToken),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTokenTTL),
+
+		AccessTokenId:        accessToken.Id,
+		AccessTokenExpiresAt: accessToken.ExpiresAt,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed saving refresh token: %w", err)
+	}
+
+	return &structs.TokenPair{
+		AccessToken:  accessToken.Token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(s.jwt.AccessTokenTTL().Seconds()),
+	}, nil
+}
+
+// generateSecretToken generates an opaque token from 32 random bytes, base64url encoded.
+func generateSecretToken() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken returns the hex encoded SHA-256 hash under which an opaque token is stored.
+// The tokens are random, so a plain hash suffices to keep leaked database contents from being usable.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memoryRefreshTokenRepository is a RefreshTokenRepository that keeps the tokens in memory.
+type memoryRefreshTokenRepository struct {
+	lock   sync.Mutex
+	tokens []structs.RefreshTokenEntity
+}
+
+func (r *memoryRefreshTokenRepository) Save(ctx context.Context, token *structs.RefreshTokenEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.tokens = append(r.tokens, *token)
+	return nil
+}
+
+func (r *memoryRefreshTokenRepository) GetByHash(ctx context.Context, tokenHash string) (*structs.RefreshTokenEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, token := range r.tokens {
+		if token.TokenHash == tokenHash {
+			return &token, nil
+		}
+	}
+	return nil, mongo.ErrNoDocuments
+}
+
+func (r *memoryRefreshTokenRepository) MarkRotated(ctx context.Context, id string, rotatedAt time.Time) (bool, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.tokens {
+		if r.tokens[i].Id == id && r.tokens[i].RotatedAt == nil && r.tokens[i].RevokedAt == nil {
+			r.tokens[i].RotatedAt = &rotatedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *memoryRefreshTokenRepository) GetFamily(ctx context.Context, familyId string) ([]structs.RefreshTokenEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var family []structs.RefreshTokenEntity
+	for _, token := range r.tokens {
+		if token.FamilyId == familyId {
+			family = append(family, token)
+		}
+	}
+	return family, nil
+}
+
+func (r *memoryRefreshTokenRepository) RevokeFamily(ctx context.Context, familyId string, revokedAt time.Time) error {
+	r.revoke(func(token *structs.RefreshTokenEntity) bool { return token.FamilyId == familyId }, revokedAt)
+	return nil
+}
+
+func (r *memoryRefreshTokenRepository) RevokeUser(ctx context.Context, userId string, revokedAt time.Time) error {
+	r.revoke(func(token *structs.RefreshTokenEntity) bool { return token.UserId == userId }, revokedAt)
+	return nil
+}
+
+func (r *memoryRefreshTokenRepository) revoke(match func(token *structs.RefreshTokenEntity) bool, revokedAt time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i := range r.tokens {
+		if match(&r.tokens[i]) && r.tokens[i].RevokedAt == nil {
+			r.tokens[i].RevokedAt = &revokedAt
+		}
+	}
+}
+
+// memoryRevocationRepository is a RevocationRepository that keeps the revocations in memory.
+type memoryRevocationRepository struct {
+	lock        sync.Mutex
+	revocations []structs.RevocationEntity
+}
+
+func (r *memoryRevocationRepository) Save(ctx context.Context, revocation *structs.RevocationEntity) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.revocations = append(r.revocations, *revocation)
+	return nil
+}
+
+func (r *memoryRevocationRepository) GetSince(ctx context.Context, since time.Time) ([]structs.RevocationEntity, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var revocations []structs.RevocationEntity
+	for _, revocation := range r.revocations {
+		if !revocation.RevokedAt.Before(since) {
+			revocations = append(revocations, revocation)
+		}
+	}
+	return revocations, nil
+}
+
+// revokedTokenIds returns the IDs of the access tokens that were revoked one by one.
+func (r *memoryRevocationRepository) revokedTokenIds() map[string]bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ids := make(map[string]bool)
+	for _, revocation := range r.revocations {
+		if revocation.TokenId != "" {
+			ids[revocation.TokenId] = true
+		}
+	}
+	return ids
+}
+
+// newSessionTest returns a SessionService for a verified user with the ID "user-1", which signs access tokens with
+// a key generated for the test.
+func newSessionTest(t *testing.T) (*SessionService, *memoryRefreshTokenRepository, *memoryRevocationRepository) {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "key.pem")
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	if err := os.WriteFile(keyPath, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_SIGNING_KEYS", "test:"+keyPath)
+	t.Setenv("JWT_ACTIVE_KID", "test")
+
+	keys, err := NewKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwt, err := NewJwtService(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := &memoryRefreshTokenRepository{}
+	revocations := &memoryRevocationRepository{}
+	users := &memoryUserRepository{users: []structs.UserEntity{
+		{Id: "user-1", Username: "alice", Email: "alice@example.com", EmailVerified: true},
+	}}
+	sessions, err := NewSessionService(tokens, revocations, users, jwt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions, tokens, revocations
+}
+
+// startSession starts a session of the test user.
+func startSession(t *testing.T, sessions *SessionService) *structs.TokenPair {
+	t.Helper()
+	pair, err := sessions.StartSession(context.Background(), &structs.UserEntity{Id: "user-1", Username: "alice", EmailVerified: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+func TestRefreshRotatesToken(t *testing.T) {
+	sessions, _, revocations := newSessionTest(t)
+	ctx := context.Background()
+	first := startSession(t, sessions)
+
+	second, err := sessions.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refreshing failed: %v", err)
+	}
+	if second.RefreshToken == first.RefreshToken || second.AccessToken == "" {
+		t.Fatalf("refreshing did not issue new tokens")
+	}
+	if _, err := sessions.Refresh(ctx, second.RefreshToken); err != nil {
+		t.Fatalf("refreshing with the rotated token failed: %v", err)
+	}
+	if len(revocations.revokedTokenIds()) != 0 {
+		t.Errorf("refreshing revoked access tokens")
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	sessions, tokens, revocations := newSessionTest(t)
+	ctx := context.Background()
+	first := startSession(t, sessions)
+	second, err := sessions.Refresh(ctx, first.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.Refresh(ctx, first.RefreshToken); err != ErrRefreshTokenReused {
+		t.Fatalf("reusing a rotated token returned %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := sessions.Refresh(ctx, second.RefreshToken); err != ErrInvalidRefreshToken {
+		t.Fatalf("refreshing after the reuse returned %v, want ErrInvalidRefreshToken", err)
+	}
+
+	revoked := revocations.revokedTokenIds()
+	for _, token := range tokens.tokens {
+		if token.RevokedAt == nil {
+			t.Errorf("refresh token %s of the family was not revoked", token.Id)
+		}
+		if !revoked[token.AccessTokenId] {
+			t.Errorf("access token %s of the family was not revoked", token.AccessTokenId)
+		}
+	}
+}
+
+func TestRefreshReuseKeepsOtherSessions(t *testing.T) {
+	sessions, _, _ := newSessionTest(t)
+	ctx := context.Background()
+	stolen := startSession(t, sessions)
+	other := startSession(t, sessions)
+	if _, err := sessions.Refresh(ctx, stolen.RefreshToken); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sessions.Refresh(ctx, stolen.RefreshToken); !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reusing a rotated token returned %v, want ErrRefreshTokenReused", err)
+	}
+	if _, err := sessions.Refresh(ctx, other.RefreshToken); err != nil {
+		t.Fatalf("refreshing another session failed: %v", err)
+	}
+}
+
+func TestRefreshRejectsUnknownToken(t *testing.T) {
+	sessions, _, _ := newSessionTest(t)
+	if _, err := sessions.Refresh(context.Background(), "unknown"); err != ErrInvalidRefreshToken {
+		t.Fatalf("refreshing an unknown token returned %v, want ErrInvalidRefreshToken", err)
+	}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+const (
+	// totpPeriod is the time step of TOTP codes.
+	totpPeriod = 30 * time.Second
+	// totpDigits is the number of digits of TOTP codes.
+	totpDigits = 6
+	// totpSkew is the number of time steps before and after the current one whose codes are accepted, so that
+	// clocks that are slightly off and codes entered just before they change still work.
+	totpSkew = 1
+)
+
+// totpEncoding is the base32 encoding authenticator apps expect secrets in.
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpStep returns the TOTP time step of the time.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// totpCode computes the TOTP code of the secret for the time step as defined by RFC 6238, with HMAC-SHA1 and
+// six digits as supported by all common authenticator apps.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000)
+}
+
+// matchTotpCode returns the time step around now whose code matches, or false if none does.
+func matchTotpCode(secret []byte, code string, now time.Time) (int64, bool) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// otpauthUri returns the otpauth URI of the secret, which authenticator apps import from a QR code.
+func otpauthUri(issuer, accountName string, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(int(totpPeriod.Seconds())))
+	label := url.PathEscape(issuer + ":" + accountName)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+
+	"example.com/chat_app/user_service/structs"
+)
+
+// maxBatchSize is the largest number of IDs users can be looked up by at once.
+const maxBatchSize = 100
+
+var (
+	// ErrInvalidCursor is returned when a paging cursor is malformed.
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrTooManyIds is returned when more users are looked up at once than allowed.
+	ErrTooManyIds = errors.New("too many ids")
+)
+
+// SearchUsers returns a page of the users whose username or display name starts with the query of the filter,
+// ignoring case, ordered by username. The cursor returned with a page continues the search at the next page.
+// Avatar URLs are signed for the viewer.
+func (s *UserService) SearchUsers(ctx context.Context, filter structs.UserFilter, cursor, viewerId string) (*structs.UserPage, error) {
+	if cursor != "" {
+		after, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || len(after) == 0 {
+			return nil, ErrInvalidCursor
+		}
+		filter.After = string(after)
+	}
+
+	// Fetch one user more than requested to find out whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	users, err := s.repo.Search(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &structs.UserPage{Items: make([]structs.PublicUserDto, 0, len(users))}
+	if int64(len(users)) > limit {
+		users = users[:limit]
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(users[limit-1].Username))
+	}
+	for i := range users {
+		page.Items = append(page.Items, *s.mapPublicUser(&users[i], viewerId))
+	}
+	return page, nil
+}
+
+// GetUsersByIds returns the users with the IDs, in no particular order. IDs without a user are left out.
+// Avatar URLs are signed for the viewer, who may be empty for lookups other services make.
+func (s *UserService) GetUsersByIds(ctx context.Context, ids []string, viewerId string) ([]structs.PublicUserDto, error) {
+	unique := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	if len(unique) > maxBatchSize {
+		return nil, ErrTooManyIds
+	}
+	if len(unique) == 0 {
+		return []structs.PublicUserDto{}, nil
+	}
+
+	users, err := s.repo.ListByIds(ctx, unique)
+	if err != nil {
+		return nil, err
+	}
+	dtos := make([]structs.PublicUserDto, 0, len(users))
+	for i := range users {
+		dtos = append(dtos, *s.mapPublicUser(&users[i], viewerId))
+	}
+	return dtos, nil
+}
@@ -4,7 +4,10 @@ import (
     "context"
     "errors"
     "fmt"
+    "log"
+    "strings"
 
+    "example.com/chat_app/identity"
     "example.com/chat_app/user_service/structs"
     "github.com/google/uuid"
 
@@ -27,30 +30,68 @@ type UserRepository interface {
     GetById(ctx context.Context, id string) (*structs.UserEntity, error)
     // GetByUsername retrieves a user by their username.
     GetByUsername(ctx context.Context, username string) (*structs.UserEntity, error)
+    // GetByIdentity retrieves the user the account at an OpenID Connect provider is linked to.
+    GetByIdentity(ctx context.Context, issuer, subject string) (*structs.UserEntity, error)
+    // ListByIds retrieves the users with the IDs.
+    ListByIds(ctx context.Context, ids []string) ([]structs.UserEntity, error)
+    // Search retrieves a page of the users whose username or display name starts with the query.
+    Search(ctx context.Context, filter structs.UserFilter) ([]structs.UserEntity, error)
+    // ListByEmail retrieves all users with the email address.
+    ListByEmail(ctx context.Context, email string) ([]structs.UserEntity, error)
     // Save stores a user entity in the repository.
     Save(ctx context.Context, user *structs.UserEntity) error
+    // AddIdentity links the account at an OpenID Connect provider to a user.
+    AddIdentity(ctx context.Context, userId string, identity structs.ExternalIdentity) error
+    // SetPassword sets the password hash of a user.
+    SetPassword(ctx context.Context, userId, passwordHash string) error
+    // SetMfa sets the second factor of a user, or removes it if mfa is nil.
+    SetMfa(ctx context.Context, userId string, mfa *structs.MfaEntity) error
+    // UseMfaStep records the time step of an accepted TOTP code, unless it or a later one was used before.
+    UseMfaStep(ctx context.Context, userId string, step int64) (bool, error)
+    // UseRecoveryCode removes the recovery code with the hash and reports whether it was there.
+    UseRecoveryCode(ctx context.Context, userId, codeHash string) (bool, error)
+    // SetAvatar sets the avatar of a user, or removes it if avatar is nil.
+    SetAvatar(ctx context.Context, userId string, avatar *structs.MediaFile) error
+    // SetEmailVerified marks the email address of a user as verified, provided it is still the given one.
+    SetEmailVerified(ctx context.Context, userId, email string) error
 }
 
 // UserService provides methods for user management.
 type UserService struct {
-    repo UserRepository
-    jwt  *JwtService
+    repo         UserRepository
+    sessions     *SessionService
+    verification *VerificationService
+    loginGuard   *LoginGuard
+    mfa          *MfaService
+    media        MediaClient
+    signer       *identity.UrlSigner
 }
 
 // NewUserService creates a new UserService.
-// It initializes the UserService with the provided UserRepository and JwtService.
-func NewUserService(repo UserRepository, jwt *JwtService) *UserService {
+// It initializes the UserService with the provided UserRepository, SessionService, VerificationService,
+// LoginGuard, MfaService, MediaClient and UrlSigner. New users are asked to verify their email address through the
+// VerificationService, and logins are protected against password guessing by the LoginGuard. Users with an
+// enabled second factor finish their logins through the MfaService.
+// Avatars are stored through the MediaClient and their URLs signed with the UrlSigner.
+func NewUserService(repo UserRepository, sessions *SessionService, verification *VerificationService, loginGuard *LoginGuard, mfa *MfaService, media MediaClient, signer *identity.UrlSigner) *UserService {
     return &UserService{
-        repo: repo,
-        jwt:  jwt,
+        repo:         repo,
+        sessions:     sessions,
+        verification: verification,
+        loginGuard:   loginGuard,
+        mfa:          mfa,
+        media:        media,
+        signer:       signer,
     }
 }
 
 // RegistrationRequest represents the data required to register a new user.
 type RegistrationRequest struct {
-    Username string `json:"username"`
-    Email    string `json:"email"`
-    Password string `json:"password"`
+    Username    string `json:"username"`
+    Email       string `json:"email"`
+    Password    string `json:"password"`
+    // DisplayName is optional.
+    DisplayName string `json:"displayName"`
 }
 
 // LoginRequest represents the data required to log in a user.
@@ -65,7 +106,7 @@ func (s *UserService) GetUserDto(ctx context.Context, userId string) (*structs.U
     if err != nil {
         return nil, err
     }
-    userDto := MapUserEntityToDto(user)
+    userDto := s.mapUser(user)
     return userDto, nil
 }
 
@@ -93,71 +134,151 @@ func (s *UserService) GetUserById(ctx context.Context, id string) (*structs.User
     return user, nil
 }
 
-// RegisterUser registers a new user and returns the user DTO and JWT token.
-// It validates the registration request, hashes the password, saves the user entity,
-// and generates a JWT token.
-func (s *UserService) RegisterUser(ctx context.Context, r RegistrationRequest) (*structs.UserDto, string, error) {
+// RegisterUser registers a new user and returns the user DTO and the tokens of a new session.
+// It validates the registration request, hashes the password, saves the unverified user entity,
+// mails a verification link and starts a session. If the policy for unverified users keeps them from
+// logging in, no session is started and the tokens are nil.
+func (s *UserService) RegisterUser(ctx context.Context, r RegistrationRequest) (*structs.UserDto, *structs.TokenPair, error) {
     err := s.validateRegistrationRequest(r)
     if err != nil {
-        return nil, "", fmt.Errorf("registration request invalid: %w", err)
+        return nil, nil, fmt.Errorf("registration request invalid: %w", err)
     }
 
     exists := s.checkIfUserExists(ctx, r.Username)
     if exists {
-        return nil, "", ErrUserExists
+        return nil, nil, ErrUserExists
     }
 
     hashedPassword, err := bcrypt.GenerateFromPassword([]byte(r.Password), bcrypt.DefaultCost)
     if err != nil {
-        return nil, "", fmt.Errorf("failed hashing password: %w", err)
+        return nil, nil, fmt.Errorf("failed hashing password: %w", err)
     }
 
     user := &structs.UserEntity{
         Id:       uuid.New().String(),
-        Username: r.Username,
-        Email:    r.Email,
-        Password: string(hashedPassword),
+        Username:    r.Username,
+        Email:       r.Email,
+        Password:    string(hashedPassword),
+        DisplayName: strings.TrimSpace(r.DisplayName),
     }
     err = s.repo.Save(ctx, user)
     if err != nil {
-        return nil, "", fmt.Errorf("failed saving user %q to the database: %w", user.Username, err)
+        return nil, nil, fmt.Errorf("failed saving user %q to the database: %w", user.Username, err)
     }
 
-    token, err := s.jwt.GenerateToken(user.Id, user.Username)
-    if err != nil {
-        return nil, "", fmt.Errorf("failed generating jwt token: %w", err)
+    // The user can request another mail, so failing to send this one does not fail the registration.
+    if err := s.verification.SendVerification(ctx, user); err != nil {
+        log.Printf("Failed sending verification mail to user %s: %v", user.Id, err)
+    }
+
+    tokens, err := s.sessions.StartSession(ctx, user)
+    if err != nil && err != ErrEmailNotVerified {
+        return nil, nil, err
     }
 
-    userDto := MapUserEntityToDto(user)
+    userDto := s.mapUser(user)
 
-    return userDto, token, nil
+    return userDto, tokens, nil
 }
 
-// LoginUser logs in a user and returns the user DTO and JWT token.
-// It retrieves the user entity by username, compares the hashed password,
-// and generates a JWT token.
-func (s *UserService) LoginUser(ctx context.Context, r LoginRequest) (*structs.UserDto, string, error) {
+// LoginUser logs in a user and returns the user DTO and the tokens of a new session.
+// It checks that neither the account nor the client IP address is locked, retrieves the user entity by username,
+// compares the hashed password, and starts a session. Unknown usernames and incorrect passwords both return
+// ErrInvalidCredentials and count as failed logins; locked logins return a LoginLockedError.
+// Users with an enabled second factor get no session yet; an MfaRequiredError is returned instead, carrying the
+// token to finish the login with through VerifyMfaLogin.
+func (s *UserService) LoginUser(ctx context.Context, r LoginRequest, clientIp string) (*structs.UserDto, *structs.TokenPair, error) {
+    if err := s.loginGuard.Check(ctx, r.Username, clientIp); err != nil {
+        return nil, nil, err
+    }
+
     user, err := s.repo.GetByUsername(ctx, r.Username)
     if err != nil {
         if err == mongo.ErrNoDocuments {
-            return nil, "", ErrNoUser
+            // Unknown usernames take as long as incorrect passwords, so that timing does not tell them apart.
+            bcrypt.CompareHashAndPassword(dummyPasswordHash(), []byte(r.Password))
+            return nil, nil, s.loginFailed(ctx, r.Username, "", clientIp)
         }
-        return nil, "", err
+        return nil, nil, err
     }
 
     err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(r.Password))
     if err != nil {
-        return nil, "", ErrWrongPassword
+        return nil, nil, s.loginFailed(ctx, r.Username, user.Id, clientIp)
+    }
+
+    if s.mfa.Required(user) {
+        challenge, err := s.mfa.Challenge(ctx, user)
+        if err != nil {
+            return nil, nil, err
+        }
+        return nil, nil, &MfaRequiredError{Challenge: challenge}
+    }
+
+    return s.completeLogin(ctx, user)
+}
+
+// VerifyMfaLogin finishes a login waiting for the second factor and returns the user DTO and the tokens of a new
+// session. The code is a TOTP code or a recovery code. Incorrect codes return ErrInvalidMfaCode and count as
+// failed logins of the account like incorrect passwords, so the LoginGuard locks out guessing them as well.
+func (s *UserService) VerifyMfaLogin(ctx context.Context, mfaToken, code, clientIp string) (*structs.UserDto, *structs.TokenPair, error) {
+    user, err := s.mfa.PendingUser(ctx, mfaToken)
+    if err != nil {
+        return nil, nil, err
+    }
+    if err := s.loginGuard.Check(ctx, user.Username, clientIp); err != nil {
+        return nil, nil, err
+    }
+
+    if err := s.mfa.CompleteChallenge(ctx, mfaToken, user, code); err != nil {
+        if err == ErrInvalidMfaCode {
+            if err := s.loginGuard.RecordFailure(ctx, user.Username, user.Id, clientIp); err != nil {
+                log.Printf("Failed recording failed login for %q: %v", user.Username, err)
+            }
+        }
+        return nil, nil, err
     }
 
-    token, err := s.jwt.GenerateToken(user.Id, user.Username)
+    return s.completeLogin(ctx, user)
+}
+
+// LoginExternal logs in a user who was authenticated by an external identity provider and returns the user DTO
+// and the tokens of a new session. Like LoginUser, it returns an MfaRequiredError for users with an enabled second
+// factor.
+func (s *UserService) LoginExternal(ctx context.Context, user *structs.UserEntity) (*structs.UserDto, *structs.TokenPair, error) {
+    if s.mfa.Required(user) {
+        challenge, err := s.mfa.Challenge(ctx, user)
+        if err != nil {
+            return nil, nil, err
+        }
+        return nil, nil, &MfaRequiredError{Challenge: challenge}
+    }
+
+    return s.completeLogin(ctx, user)
+}
+
+// completeLogin resets the failed login count of the user and starts a session.
+func (s *UserService) completeLogin(ctx context.Context, user *structs.UserEntity) (*structs.UserDto, *structs.TokenPair, error) {
+    if err := s.loginGuard.RecordSuccess(ctx, user.Username); err != nil {
+        return nil, nil, err
+    }
+
+    tokens, err := s.sessions.StartSession(ctx, user)
     if err != nil {
-        return nil, "", fmt.Errorf("failed generating jwt token: %w", err)
+        return nil, nil, err
     }
 
-    userDto := MapUserEntityToDto(user)
+    userDto := s.mapUser(user)
+
+    return userDto, tokens, nil
+}
 
-    return userDto, token, nil
+// loginFailed counts a failed login and returns ErrInvalidCredentials.
+func (s *UserService) loginFailed(ctx context.Context, username, userId, clientIp string) error {
+    if err := s.loginGuard.RecordFailure(ctx, username, userId, clientIp); err != nil {
+        log.Printf("Failed recording failed login for %q: %v", username, err)
+    }
+    return ErrInvalidCredentials
 }
 
 // validateRegistrationRequest validates the registration request data.
@@ -175,6 +296,10 @@ func (s *UserService) validateRegistrationRequest(r RegistrationRequest) error {
     if err != nil {
         return err
     }
+    err = ValidateDisplayName(r.DisplayName)
+    if err != nil {
+        return err
+    }
     return nil
 }
 
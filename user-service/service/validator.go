@@ -3,7 +3,9 @@ package service
 import (
 	"errors"
 	"regexp"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 
@@ -28,6 +30,15 @@ func ValidateUsername(username string) error {
 	return nil
 }
 
+// ValidateDisplayName validates the length of the given display name, which may be empty.
+// It returns an error if the display name is longer than 50 characters.
+func ValidateDisplayName(displayName string) error {
+	if utf8.RuneCountInString(strings.TrimSpace(displayName)) > 50 {
+		return errors.New("display name must be at most 50 characters")
+	}
+	return nil
+}
+
 // ValidatePassword validates the length and composition of the given password.
 // It returns an error if the password length is less than 8 characters or if it does not contain at least one uppercase letter, one lowercase letter, one digit, and one special character.
 func ValidatePassword(password string) error {
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"example.com/chat_app/user_service/structs"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	// defaultVerificationTTL is the lifetime of verification tokens used when EMAIL_VERIFICATION_EXP_HS is not set.
+	defaultVerificationTTL = 24 * time.Hour
+	// defaultVerificationUrl is the page verification links point to when EMAIL_VERIFICATION_URL is not set.
+	defaultVerificationUrl = "http://localhost:5173/verify-email"
+	// purposeVerifyEmail is the purpose of one-time tokens that verify an email address.
+	purposeVerifyEmail = "verify-email"
+)
+
+var (
+	// ErrInvalidVerificationToken is returned when a verification token is unknown, expired or already used.
+	ErrInvalidVerificationToken = errors.New("invalid verification token")
+	// ErrEmailAlreadyVerified is returned when a verification mail is requested for a verified email address.
+	ErrEmailAlreadyVerified = errors.New("email address already verified")
+)
+
+// OneTimeTokenRepository defines the interface for storage of one-time tokens mailed to users.
+type OneTimeTokenRepository interface {
+	// Save stores a one-time token in the repository.
+	Save(ctx context.Context, token *structs.OneTimeTokenEntity) error
+	// GetByHash retrieves the unused, unexpired token with the hash and purpose.
+	GetByHash(ctx context.Context, tokenHash, purpose string, now time.Time) (*structs.OneTimeTokenEntity, error)
+	// Consume marks the unused, unexpired token with the hash and purpose as used and returns it.
+	Consume(ctx context.Context, tokenHash, purpose string, usedAt time.Time) (*structs.OneTimeTokenEntity, error)
+	// DeleteForUser deletes all tokens of a user issued for the purpose.
+	DeleteForUser(ctx context.Context, userId, purpose string) error
+}
+
+// VerificationService verifies that users own the email address they registered with.
+// It mails a link with a single-use token to the address, and marks the address as verified when the token is
+// consumed. Tokens are stored hashed, and requesting a new mail invalidates the tokens mailed before.
+type VerificationService struct {
+	tokens  OneTimeTokenRepository
+	users   UserRepository
+	mailer  Mailer
+	ttl     time.Duration
+	linkUrl string
+}
+
+// NewVerificationService creates a new VerificationService.
+// The lifetime of verification tokens is read from the EMAIL_VERIFICATION_EXP_HS environment variable, and the
+// page the mailed links point to from EMAIL_VERIFICATION_URL. The page is expected to post the token from its
+// "token" query parameter to /auth/verify.
+func NewVerificationService(tokens OneTimeTokenRepository, users UserRepository, mailer Mailer) (*VerificationService, error) {
+	ttl := defaultVerificationTTL
+	if ttlString := os.Getenv("EMAIL_VERIFICATION_EXP_HS"); ttlString != "" {
+		hours, err := strconv.Atoi(ttlString)
+		if err != nil || hours <= 0 {
+			return nil, fmt.Errorf("invalid EMAIL_VERIFICATION_EXP_HS: %q", ttlString)
+		}
+		ttl = time.Duration(hours) * time.Hour
+	}
+	linkUrl := os.Getenv("EMAIL_VERIFICATION_URL")
+	if linkUrl == "" {
+		linkUrl = defaultVerificationUrl
+	}
+	if _, err := url.Parse(linkUrl); err != nil {
+		return nil, fmt.Errorf("invalid EMAIL_VERIFICATION_URL: %q", linkUrl)
+	}
+	return &VerificationService{
+		tokens:  tokens,
+		users:   users,
+		mailer:  mailer,
+		ttl:     ttl,
+		linkUrl: linkUrl,
+	}, nil
+}
+
+// SendVerification mails a new verification link to the email address of the user.
+// Users whose address was only marked as verified by the migration can verify it as well.
+func (s *VerificationService) SendVerification(ctx context.Context, user *structs.UserEntity) error {
+	if user.EmailVerified && !user.EmailUnconfirmed {
+		return ErrEmailAlreadyVerified
+	}
+	if err := s.tokens.DeleteForUser(ctx, user.Id, purposeVerifyEmail); err != nil {
+		return fmt.Errorf("failed invalidating verification tokens: %w", err)
+	}
+
+	token, err := generateSecretToken()
+	if err != nil {
+		return fmt.Errorf("failed generating verification token: %w", err)
+	}
+	now := time.Now()
+	err = s.tokens.Save(ctx, &structs.OneTimeTokenEntity{
+		Id:        uuid.New().String(),
+		Purpose:   purposeVerifyEmail,
+		UserId:    user.Id,
+		Email:     user.Email,
+		TokenHash: hashToken(token),
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	})
+	if err != nil {
+		return fmt.Errorf("failed saving verification token: %w", err)
+	}
+
+	return s.mailer.Send(ctx, Mail{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nplease confirm your email address by opening the following link:\n\n%s\n\n"+
+			"The link expires in %d hours. If you did not create an account, you can ignore this mail.\n",
+			user.Username, linkWithToken(s.linkUrl, token), int(s.ttl.Hours())),
+	})
+}
+
+// ResendVerification mails a new verification link to the user with the ID, invalidating earlier links.
+func (s *VerificationService) ResendVerification(ctx context.Context, userId string) error {
+	user, err := s.users.GetById(ctx, userId)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrNoUser
+		}
+		return err
+	}
+	return s.SendVerification(ctx, user)
+}
+
+// VerifyEmail consumes the verification token and marks the email address it was mailed to as verified.
+// Tokens mailed to an address the user no longer has are rejected.
+func (s *VerificationService) VerifyEmail(ctx context.Context, token string) error {
+	entity, err := s.tokens.Consume(ctx, hashToken(token), purposeVerifyEmail, time.Now())
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidVerificationToken
+		}
+		return err
+	}
+	if err := s.users.SetEmailVerified(ctx, entity.UserId, entity.Email); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return ErrInvalidVerificationToken
+		}
+		return err
+	}
+	return nil
+}
+
+// linkWithToken returns the URL with the token added as "token" query parameter.
+// The URL must have been validated with url.Parse.
+func linkWithToken(linkUrl, token string) string {
+	link, _ := url.Parse(linkUrl)
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+	return link.String()
+}
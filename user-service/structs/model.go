@@ -1,8 +1,134 @@
 package structs
 
+import "time"
+
 type UserEntity struct {
 	Id       string `bson:"id" json:"id"`
 	Username string `bson:"username" json:"username"`
 	Email    string `bson:"email" json:"email"`
 	Password string `bson:"password" json:"password"`
+	// DisplayName is the name shown to other users besides the username. It is optional.
+	DisplayName string `bson:"displayName,omitempty" json:"displayName,omitempty"`
+	// EmailVerified is set once the user proved to own the email address by consuming a verification token.
+	EmailVerified bool `bson:"emailVerified" json:"emailVerified"`
+	// EmailUnconfirmed is set for the users the migration marked as verified without proof that they own the email
+	// address. They are not locked out, but their address is not trusted until they verify it.
+	EmailUnconfirmed bool `bson:"emailUnconfirmed,omitempty" json:"-"`
+	// Avatar is the image uploaded to media service that is shown as the avatar of the user.
+	Avatar *MediaFile `bson:"avatar,omitempty" json:"avatar,omitempty"`
+	// Mfa is the TOTP second factor of the user, if the user enrolled one.
+	Mfa *MfaEntity `bson:"mfa,omitempty" json:"-"`
+	// Identities are the accounts at external OpenID Connect providers the user logs in with.
+	Identities []ExternalIdentity `bson:"identities,omitempty" json:"-"`
+}
+
+// ExternalIdentity identifies an account at an OpenID Connect provider by the issuer and subject of its ID tokens.
+type ExternalIdentity struct {
+	Issuer   string    `bson:"issuer"`
+	Subject  string    `bson:"subject"`
+	LinkedAt time.Time `bson:"linkedAt"`
+}
+
+// MfaEntity is the TOTP second factor of a user. It is only required at login once enrollment was confirmed
+// with a first code.
+type MfaEntity struct {
+	// Secret is the TOTP secret, encrypted with AES-GCM and base64 encoded.
+	Secret  string `bson:"secret"`
+	Enabled bool   `bson:"enabled"`
+	// RecoveryCodes holds the SHA-256 hashes of the unused recovery codes.
+	RecoveryCodes []string `bson:"recoveryCodes"`
+	// LastUsedStep is the time step of the last accepted code, so that a code can not be used twice.
+	LastUsedStep int64      `bson:"lastUsedStep"`
+	CreatedAt    time.Time  `bson:"createdAt"`
+	EnabledAt    *time.Time `bson:"enabledAt,omitempty"`
+}
+
+// MediaFile references a blob stored in media service.
+type MediaFile struct {
+	Id          string    `bson:"id" json:"id"`
+	Type        string    `bson:"type" json:"type"`
+	BlobId      string    `bson:"blobId" json:"blobId"`
+	Size        int64     `bson:"size" json:"size"`
+	ContentType string    `bson:"contentType,omitempty" json:"contentType,omitempty"`
+	CreatedAt   time.Time `bson:"createdAt" json:"createdAt"`
+}
+
+// RefreshTokenEntity is a refresh token of a session, stored by the SHA-256 hash of the token.
+// Every refresh rotates the token: the used token is marked as rotated and a new one is issued in the same family.
+type RefreshTokenEntity struct {
+	Id        string     `bson:"id"`
+	FamilyId  string     `bson:"familyId"`
+	UserId    string     `bson:"userId"`
+	TokenHash string     `bson:"tokenHash"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	RotatedAt *time.Time `bson:"rotatedAt,omitempty"`
+	RevokedAt *time.Time `bson:"revokedAt,omitempty"`
+	// AccessTokenId is the jti of the access token issued together with the refresh token.
+	// It is revoked when the family of the refresh token is revoked.
+	AccessTokenId        string    `bson:"accessTokenId"`
+	AccessTokenExpiresAt time.Time `bson:"accessTokenExpiresAt"`
+}
+
+// RevocationEntity revokes access tokens before they expire: either the single token with the TokenId, or all
+// tokens of the user issued before IssuedBefore. Revocations are kept until the tokens they revoke have expired.
+type RevocationEntity struct {
+	Id           string     `bson:"id" json:"id"`
+	TokenId      string     `bson:"tokenId,omitempty" json:"jti,omitempty"`
+	UserId       string     `bson:"userId" json:"userId"`
+	IssuedBefore *time.Time `bson:"issuedBefore,omitempty" json:"issuedBefore,omitempty"`
+	RevokedAt    time.Time  `bson:"revokedAt" json:"revokedAt"`
+	ExpiresAt    time.Time  `bson:"expiresAt" json:"expiresAt"`
+}
+
+// OneTimeTokenEntity is a single-use token mailed to a user, stored by the SHA-256 hash of the token.
+// Purpose tells what the token may be used for, so that a token mailed for one flow is not accepted by another.
+type OneTimeTokenEntity struct {
+	Id        string     `bson:"id"`
+	Purpose   string     `bson:"purpose"`
+	UserId    string     `bson:"userId"`
+	Email     string     `bson:"email"`
+	TokenHash string     `bson:"tokenHash"`
+	CreatedAt time.Time  `bson:"createdAt"`
+	ExpiresAt time.Time  `bson:"expiresAt"`
+	UsedAt    *time.Time `bson:"usedAt,omitempty"`
+}
+
+// LoginAttemptEntity counts the failed logins for an account or a client IP address, identified by Key.
+// The count starts over once ExpiresAt has passed without another failure.
+type LoginAttemptEntity struct {
+	Key           string    `bson:"key"`
+	Failures      int       `bson:"failures"`
+	LastFailureAt time.Time `bson:"lastFailureAt"`
+	ExpiresAt     time.Time `bson:"expiresAt"`
+}
+
+// AuditEventEntity records a security relevant event, such as an account being locked after failed logins.
+type AuditEventEntity struct {
+	Id        string    `bson:"id"`
+	Type      string    `bson:"type"`
+	Username  string    `bson:"username,omitempty"`
+	UserId    string    `bson:"userId,omitempty"`
+	Ip        string    `bson:"ip,omitempty"`
+	Details   string    `bson:"details,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+}
+
+// UserFilter selects the users whose username or display name starts with the query, ignoring case, ordered by
+// username.
+type UserFilter struct {
+	Query string
+	// After continues the listing after the user with the username, as returned in the previous page.
+	After string
+	Limit int64
+}
+
+// OidcStateEntity is a login through an OpenID Connect provider that was started but not finished yet, stored by
+// the SHA-256 hash of its state parameter. It keeps the PKCE code verifier and the nonce the ID token has to carry.
+type OidcStateEntity struct {
+	StateHash    string    `bson:"stateHash"`
+	CodeVerifier string    `bson:"codeVerifier"`
+	Nonce        string    `bson:"nonce"`
+	CreatedAt    time.Time `bson:"createdAt"`
+	ExpiresAt    time.Time `bson:"expiresAt"`
 }
@@ -1,7 +1,58 @@
 package structs
 
+import "time"
+
 type UserDto struct {
-	Id       string `json:"id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
+	Id            string     `json:"id"`
+	Username      string     `json:"username"`
+	DisplayName   string     `json:"displayName,omitempty"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"emailVerified"`
+	MfaEnabled    bool       `json:"mfaEnabled"`
+	Avatar        *AvatarDto `json:"avatar,omitempty"`
+}
+
+// PublicUserDto is the profile of a user that is shown to other users. Unlike UserDto, it leaves out the email
+// address and the state of the account.
+type PublicUserDto struct {
+	Id          string     `json:"id"`
+	Username    string     `json:"username"`
+	DisplayName string     `json:"displayName,omitempty"`
+	Avatar      *AvatarDto `json:"avatar,omitempty"`
+}
+
+// UserPage is one page of a user search.
+type UserPage struct {
+	Items      []PublicUserDto `json:"items"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+}
+
+// AvatarDto holds short-lived signed URLs of an avatar image and of its thumbnail.
+type AvatarDto struct {
+	MediaId   string    `json:"mediaId"`
+	Url       string    `json:"url"`
+	ThumbUrl  string    `json:"thumbUrl"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// TokenPair holds the tokens of a session: a short-lived access token and the refresh token to renew it.
+type TokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+	// ExpiresIn is the lifetime of the access token in seconds.
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+// MfaEnrollment carries the secret of a TOTP second factor that is being enrolled, both plain and as otpauth URI.
+type MfaEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauthUri"`
+}
+
+// MfaChallenge is returned instead of tokens when a user with a second factor logs in. The token has to be
+// presented together with a code to complete the login.
+type MfaChallenge struct {
+	Token string `json:"token"`
+	// ExpiresIn is the lifetime of the token in seconds.
+	ExpiresIn int64 `json:"expiresIn"`
 }